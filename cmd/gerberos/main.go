@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"os"
 	"runtime/debug"
 
 	gerberos "github.com/bitflipp/gerberos/internal"
@@ -57,8 +58,15 @@ func setGlobalLogLevel(c *gerberos.Configuration) {
 
 func main() {
 	cfp := flag.String("c", "./gerberos.toml", "Path to TOML configuration file")
+	check := flag.Bool("check", false, "Validate configuration file and exit")
+	dryRun := flag.Bool("dry-run", false, "Log bans instead of performing them, not touching the firewall")
 	flag.Parse()
 
+	if flag.Arg(0) == "replay" {
+		replay(*cfp, flag.Args()[1:])
+		return
+	}
+
 	c := &gerberos.Configuration{}
 	if err := c.ReadFile(*cfp); err != nil {
 		log.Fatal().Err(err).Msg("failed to read configuration file")
@@ -68,6 +76,19 @@ func main() {
 	logVersionAndBuildInfo()
 
 	rn := gerberos.NewRunner(c)
+	if *check {
+		errs := rn.Check()
+		for _, err := range errs {
+			log.Error().Err(err).Msg("invalid configuration")
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		log.Info().Str("path", *cfp).Msg("valid configuration")
+		return
+	}
+
+	rn.SetDryRun(*dryRun)
 	if err := rn.Initialize(); err != nil {
 		log.Fatal().Err(err).Msg("failed to initialize runner")
 	}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	gerberos "github.com/bitflipp/gerberos/internal"
+)
+
+const replayUsage = `Usage: gerberos [-c <path>] replay [-c <path>] <rule> <file>
+
+Feeds the lines of a plain or gzip-compressed log file through a rule and
+prints matched lines, unmatched lines containing an IP and the IPs that would
+have been banned. Matched lines without a timestamp, neither captured by the
+rule nor found in the line or a line before, are not counted as occurrences.
+Nothing is banned.
+
+Flags:
+`
+
+func replay(path string, args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	cfp := fs.String("c", path, "Path to TOML configuration file")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), replayUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c := &gerberos.Configuration{}
+	if err := c.ReadFile(*cfp); err != nil {
+		fmt.Fprintf(os.Stderr, "gerberos: failed to read configuration file: %s\n", err)
+		os.Exit(1)
+	}
+	setGlobalLogLevel(c)
+
+	rr, err := gerberos.NewRunner(c).Replay(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gerberos: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Matched lines (%d):\n", len(rr.Matched))
+	for _, l := range rr.Matched {
+		fmt.Println(l)
+	}
+	fmt.Printf("\nUnmatched lines containing an IP (%d):\n", len(rr.Suspicious))
+	for _, l := range rr.Suspicious {
+		fmt.Println(l)
+	}
+	fmt.Printf("\nLines: %d, matched: %d, ignored: %d, without timestamp: %d, unmatched containing an IP: %d\n\n", rr.Lines, len(rr.Matched), rr.Ignored, rr.Untimed, len(rr.Suspicious))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "IP\tMATCHES\tBANS")
+	for _, b := range rr.Bans {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", b.IP, b.Matches, b.Bans)
+	}
+}
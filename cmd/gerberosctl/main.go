@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	gerberos "github.com/bitflipp/gerberos/internal"
+)
+
+const usage = `Usage: gerberosctl [-s <path>] <command> [arguments...]
+
+Commands:
+  status                  show backend, start time and numbers of rules and bans
+  list                    list banned IPs with remaining durations and rules
+  ban <ip> <duration>     ban an IP, subnet or IP from a port (like "1.2.3.4,tcp:22")
+  unban <ip>              lift all bans covering an IP
+  rules                   show counters of all rules
+
+Flags:
+`
+
+func formatRemaining(d time.Duration) string {
+	if d == 0 {
+		return "permanent"
+	}
+
+	return d.Round(time.Second).String()
+}
+
+func main() {
+	sp := flag.String("s", "/run/gerberos/gerberos.sock", "Path to control socket (controlSocketPath)")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	q := &gerberos.ControlRequest{Command: flag.Arg(0), Arguments: flag.Args()[1:]}
+	s, err := gerberos.SendControlRequest(*sp, q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gerberosctl: %s\n", err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	switch q.Command {
+	case "status":
+		fmt.Fprintf(w, "backend:\t%s\n", s.Status.Backend)
+		fmt.Fprintf(w, "started:\t%s (%s ago)\n", s.Status.Started.Format(time.RFC3339), time.Since(s.Status.Started).Round(time.Second))
+		fmt.Fprintf(w, "rules:\t%d\n", s.Status.Rules)
+		fmt.Fprintf(w, "bans:\t%d\n", s.Status.Bans)
+	case "list":
+		fmt.Fprintln(w, "ELEMENT\tREMAINING\tRULE")
+		for _, b := range s.Bans {
+			r := b.Rule
+			if r == "" {
+				r = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", b.Element, formatRemaining(b.Remaining), r)
+		}
+	case "ban":
+		fmt.Fprintf(w, "banned %s\n", strings.Join(s.Elements, ", "))
+	case "unban":
+		if len(s.Elements) == 0 {
+			fmt.Fprintf(w, "%s is not banned\n", q.Arguments[0])
+			break
+		}
+		fmt.Fprintf(w, "unbanned %s\n", strings.Join(s.Elements, ", "))
+	case "rules":
+		fmt.Fprintln(w, "RULE\tLINES\tMATCHES\tACTIONS\tACTION FAILURES")
+		for _, r := range s.Rules {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", r.Name, r.Lines, r.Matches, r.Actions, r.ActionFailures)
+		}
+	}
+}
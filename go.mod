@@ -5,10 +5,10 @@ go 1.24.0
 require (
 	github.com/BurntSushi/toml v1.6.0
 	github.com/rs/zerolog v1.34.0
+	golang.org/x/sys v0.40.0
 )
 
 require (
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	golang.org/x/sys v0.40.0 // indirect
 )
@@ -3,19 +3,105 @@ package gerberos
 import (
 	"errors"
 	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	banDefaultWindow   = 7 * 24 * time.Hour
+	banDefaultProtocol = "tcp"
+)
+
+var durationDaysWeeksRegexp = regexp.MustCompile(`(\d+(?:\.\d+)?)([dw])`)
+
+// parseDuration is like time.ParseDuration, but also accepts days ("d") and
+// weeks ("w"). "permanent" is parsed as 0.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "permanent" {
+		return 0, nil
+	}
+
+	var err error
+	t := durationDaysWeeksRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		n, perr := strconv.ParseFloat(m[:len(m)-1], 64)
+		if perr != nil {
+			err = perr
+			return m
+		}
+		if m[len(m)-1] == 'w' {
+			n *= 7
+		}
+		return strconv.FormatFloat(n*24, 'f', -1, 64) + "h"
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return time.ParseDuration(t)
+}
+
 type action interface {
 	initialize(r *rule) error
 	perform(m *match) error
 }
 
+// parseMessage parses the template of a message parameter. It is executed with
+// the variables of each match, e.g. "{{.user}} from {{.ip}}". Variables not
+// captured are empty.
+func parseMessage(s string) (*template.Template, error) {
+	return template.New("message").Option("missingkey=zero").Parse(s)
+}
+
+// initializeMessage parses a "message=<template>" parameter.
+func initializeMessage(p string) (*template.Template, error) {
+	k, v, ok := strings.Cut(p, "=")
+	if !ok || k != "message" || v == "" {
+		return nil, fmt.Errorf(`invalid parameter "%s"`, p)
+	}
+	t, err := parseMessage(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message parameter: %w", err)
+	}
+
+	return t, nil
+}
+
+func (r *rule) message(t *template.Template, m *match) string {
+	b := &strings.Builder{}
+	if err := t.Execute(b, m.variables(r)); err != nil {
+		log.Warn().Str("rule", r.name).Err(err).Msg("failed to execute message template")
+		return ""
+	}
+
+	return b.String()
+}
+
 type banAction struct {
 	rule     *rule
 	duration time.Duration
+	// Optional, durations of subsequent bans of the same IP within the window
+	escalation []time.Duration
+	// Optional, factor applied to the duration for each previous ban
+	factor int64
+	window time.Duration
+	// Optional, prefix lengths of subnets to ban instead of single IPs
+	prefix4 int
+	prefix6 int
+	// Optional, number of distinct IPs within a subnet which have to be banned
+	// within the window before the subnet is banned
+	prefixThreshold int
+	// Optional, destination ports to ban IPs from instead of all traffic
+	ports []*port
+	// Optional, logged along with bans
+	message *template.Template
 }
 
 func (a *banAction) initialize(r *rule) error {
@@ -25,33 +111,363 @@ func (a *banAction) initialize(r *rule) error {
 		return errors.New("missing duration parameter")
 	}
 
-	d, err := time.ParseDuration(r.Action[1])
+	d, err := parseDuration(r.Action[1])
 	if err != nil {
 		return fmt.Errorf("failed to parse duration parameter: %w", err)
 	}
 	a.duration = d
 
-	if len(r.Action) > 2 {
-		return errors.New("superfluous parameter(s)")
+	a.window = banDefaultWindow
+	hw := false
+	pr, pns := "", ""
+	for _, p := range r.Action[2:] {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || v == "" {
+			return fmt.Errorf(`invalid parameter "%s"`, p)
+		}
+		switch k {
+		case "escalate":
+			if err := a.initializeEscalation(v); err != nil {
+				return fmt.Errorf("failed to parse escalate parameter: %w", err)
+			}
+		case "prefix":
+			if err := a.initializePrefix(v); err != nil {
+				return fmt.Errorf("failed to parse prefix parameter: %w", err)
+			}
+		case "ports":
+			pns = v
+		case "protocol":
+			if _, ok := portProtocols[v]; !ok {
+				return fmt.Errorf(`invalid protocol parameter: unsupported protocol "%s"`, v)
+			}
+			pr = v
+		case "prefixThreshold":
+			t, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse prefixThreshold parameter: %w", err)
+			}
+			if t < 2 {
+				return errors.New("invalid prefixThreshold parameter: must be > 1")
+			}
+			a.prefixThreshold = t
+		case "window":
+			w, err := parseDuration(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse window parameter: %w", err)
+			}
+			if w <= 0 {
+				return errors.New("invalid window parameter: must be > 0")
+			}
+			a.window, hw = w, true
+		case "message":
+			t, err := parseMessage(v)
+			if err != nil {
+				return fmt.Errorf("failed to parse message parameter: %w", err)
+			}
+			a.message = t
+		default:
+			return fmt.Errorf(`unknown parameter "%s"`, k)
+		}
+	}
+
+	if a.prefixThreshold > 0 && a.prefix4 == 0 {
+		return errors.New("prefixThreshold parameter requires prefix parameter")
+	}
+
+	if pns != "" {
+		if a.prefix4 > 0 {
+			return errors.New("prefix parameter must not be used with ports parameter")
+		}
+		if pr == "" {
+			pr = banDefaultProtocol
+		}
+		if err := a.initializePorts(pr, pns); err != nil {
+			return fmt.Errorf("failed to parse ports parameter: %w", err)
+		}
+	} else if pr != "" {
+		return errors.New("protocol parameter requires ports parameter")
+	}
+
+	if !a.recording() {
+		if hw {
+			return errors.New("window parameter requires escalate or prefixThreshold parameter")
+		}
+		return nil
+	}
+	r.runner.offences.retain(a.window)
+
+	return nil
+}
+
+// initializePrefix parses the prefix lengths for IPv4 and IPv6 like "24,64".
+func (a *banAction) initializePrefix(s string) error {
+	s4, s6, ok := strings.Cut(s, ",")
+	if !ok {
+		return errors.New("missing IPv6 prefix length")
 	}
 
+	p4, err := strconv.Atoi(s4)
+	if err != nil {
+		return err
+	}
+	if p4 < 1 || p4 > 32 {
+		return errors.New("IPv4 prefix length must be within [1, 32]")
+	}
+
+	p6, err := strconv.Atoi(s6)
+	if err != nil {
+		return err
+	}
+	if p6 < 1 || p6 > 128 {
+		return errors.New("IPv6 prefix length must be within [1, 128]")
+	}
+
+	a.prefix4, a.prefix6 = p4, p6
+
 	return nil
 }
 
+// initializePorts parses a list of ports like "22,2222".
+func (a *banAction) initializePorts(protocol string, s string) error {
+	a.ports = make([]*port, 0)
+	for _, n := range strings.Split(s, ",") {
+		p, err := parsePort(protocol + ":" + n)
+		if err != nil {
+			return err
+		}
+		if slices.ContainsFunc(a.ports, func(o *port) bool { return *o == *p }) {
+			return fmt.Errorf("duplicate port %d", p.number)
+		}
+		a.ports = append(a.ports, p)
+	}
+
+	return nil
+}
+
+func (a *banAction) portStrings() []string {
+	ss := make([]string, 0, len(a.ports))
+	for _, p := range a.ports {
+		ss = append(ss, p.String())
+	}
+
+	return ss
+}
+
+// recording reports whether bans have to be recorded as offences.
+func (a *banAction) recording() bool {
+	return a.escalation != nil || a.factor > 0 || a.prefixThreshold > 0
+}
+
+// target returns the network to ban for a match, either the single IP or the
+// subnet containing it.
+func (a *banAction) target(m *match) *net.IPNet {
+	h := hostNet(m.ip)
+	if a.prefix4 == 0 {
+		return h
+	}
+
+	l, b := a.prefix4, 32
+	if m.ipv6 {
+		l, b = a.prefix6, 128
+	}
+	mk := net.CIDRMask(l, b)
+	p := &net.IPNet{IP: m.ip.Mask(mk), Mask: mk}
+
+	if a.rule.ignoresAny(p) {
+		log.Debug().Str("rule", a.rule.name).IPAddr("ip", m.ip).Str("subnet", p.String()).Msg("not banning subnet overlapping ignore list")
+		return h
+	}
+
+	if a.prefixThreshold > 0 && a.rule.runner.offences.distinct(p, a.window, netElement(h)) < a.prefixThreshold {
+		return h
+	}
+
+	return p
+}
+
+// initializeEscalation parses either a list of durations like
+// "1d,1w,permanent" or a factor like "x2".
+func (a *banAction) initializeEscalation(s string) error {
+	if f, ok := strings.CutPrefix(s, "x"); ok {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < 2 {
+			return errors.New("factor must be > 1")
+		}
+		if a.duration == 0 {
+			return errors.New("factor cannot be applied to permanent bans")
+		}
+		a.factor = n
+		return nil
+	}
+
+	a.escalation = make([]time.Duration, 0)
+	for _, e := range strings.Split(s, ",") {
+		d, err := parseDuration(e)
+		if err != nil {
+			return err
+		}
+		a.escalation = append(a.escalation, d)
+	}
+
+	return nil
+}
+
+// durationFor returns the duration of a ban given the number of previous bans
+// within the window.
+func (a *banAction) durationFor(n int) time.Duration {
+	if n == 0 || a.duration == 0 {
+		return a.duration
+	}
+
+	if a.factor > 0 {
+		d := a.duration
+		for range n {
+			if d > math.MaxInt64/time.Duration(a.factor) {
+				// Practically permanent
+				return 0
+			}
+			d *= time.Duration(a.factor)
+		}
+		return d
+	}
+
+	return a.escalation[min(n, len(a.escalation))-1]
+}
+
 func (a *banAction) perform(m *match) error {
-	err := a.rule.runner.backend.ban(m.ip, m.ipv6, a.duration)
+	t := a.target(m)
+	k := netElement(t)
+	n := 0
+	escalating := a.escalation != nil || a.factor > 0
+	if escalating {
+		n = a.rule.runner.offences.count(k, a.window)
+	}
+	d := a.durationFor(n)
+
+	if a.rule.runner.dryRun {
+		ev := log.Info().Str("rule", a.rule.name).IPAddr("ip", m.ip).Str("element", k).Dur("duration", d)
+		if len(a.ports) > 0 {
+			ev = ev.Strs("ports", a.portStrings())
+		}
+		if m.origin != "" {
+			ev = ev.Str("origin", m.origin)
+		}
+		if a.message != nil {
+			ev = ev.Str("message", a.rule.message(a.message, m))
+		}
+		ev.Msg("would have banned IP")
+		return nil
+	}
+
+	ps := a.ports
+	if len(ps) == 0 {
+		// All traffic
+		ps = []*port{nil}
+	}
+	var err error
+	banned := false
+	for _, p := range ps {
+		err = a.rule.runner.backend.ban(t, m.ipv6, d, p)
+		if errors.Is(err, errAlreadyBanned) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		a.rule.runner.bans.add(portElement(t, p), a.rule.name)
+		banned = true
+	}
+	if err == nil && !banned {
+		log.Debug().Str("rule", a.rule.name).IPAddr("ip", m.ip).Str("element", k).Msg("IP already banned")
+		return nil
+	}
 	if err != nil {
-		log.Warn().Str("rule", a.rule.name).IPAddr("ip", m.ip).Err(err).Msg("failed to ban IP")
+		log.Warn().Str("rule", a.rule.name).IPAddr("ip", m.ip).Str("element", k).Err(err).Msg("failed to ban IP")
 	} else {
-		log.Info().Str("rule", a.rule.name).IPAddr("ip", m.ip).Dur("duration", a.duration).Msg("banned IP")
+		if a.recording() {
+			a.rule.runner.offences.add(k, &offence{Rule: a.rule.name, Time: time.Now()})
+		}
+		ev := log.Info().Str("rule", a.rule.name).IPAddr("ip", m.ip).Dur("duration", d)
+		if !isHostNet(t) {
+			ev = ev.Str("subnet", k)
+		}
+		if len(a.ports) > 0 {
+			ev = ev.Strs("ports", a.portStrings())
+		}
+		if d == 0 {
+			ev = ev.Bool("permanent", true)
+		}
+		if escalating {
+			ev = ev.Int("previousBans", n)
+		}
+		if m.origin != "" {
+			ev = ev.Str("origin", m.origin)
+		}
+		if a.message != nil {
+			ev = ev.Str("message", a.rule.message(a.message, m))
+		}
+		ev.Msg("banned IP")
 	}
 
 	return err
 }
 
+type unbanAction struct {
+	rule *rule
+	// Optional, logged along with unbans
+	message *template.Template
+}
+
+func (a *unbanAction) initialize(r *rule) error {
+	a.rule = r
+
+	if len(r.Action) > 2 {
+		return errors.New("superfluous parameter(s)")
+	}
+
+	if len(r.Action) > 1 {
+		t, err := initializeMessage(r.Action[1])
+		if err != nil {
+			return err
+		}
+		a.message = t
+	}
+
+	return nil
+}
+
+func (a *unbanAction) perform(m *match) error {
+	ks, err := a.rule.runner.liftBans(m.ip, m.ipv6)
+	if err != nil {
+		log.Warn().Str("rule", a.rule.name).IPAddr("ip", m.ip).Strs("elements", ks).Err(err).Msg("failed to unban IP")
+		return err
+	}
+	if len(ks) == 0 {
+		log.Debug().Str("rule", a.rule.name).IPAddr("ip", m.ip).Msg("IP not banned")
+		return nil
+	}
+
+	ev := log.Info().Str("rule", a.rule.name).IPAddr("ip", m.ip).Strs("elements", ks)
+	if m.origin != "" {
+		ev = ev.Str("origin", m.origin)
+	}
+	if a.message != nil {
+		ev = ev.Str("message", a.rule.message(a.message, m))
+	}
+	ev.Msg("unbanned IP")
+
+	return nil
+}
+
 type logAction struct {
 	rule     *rule
 	extended bool
+	// Optional, replaces the empty message
+	message *template.Template
 }
 
 func (a *logAction) initialize(r *rule) error {
@@ -70,19 +486,39 @@ func (a *logAction) initialize(r *rule) error {
 		return errors.New("invalid type parameter")
 	}
 
-	if len(r.Action) > 2 {
+	if len(r.Action) > 3 {
 		return errors.New("superfluous parameter(s)")
 	}
 
+	if len(r.Action) > 2 {
+		t, err := initializeMessage(r.Action[2])
+		if err != nil {
+			return err
+		}
+		a.message = t
+	}
+
 	return nil
 }
 
 func (a *logAction) perform(m *match) error {
 	ev := log.Info().Str("rule", a.rule.name).Bool("ipv6", m.ipv6).Time("time", m.time).IPAddr("ip", m.ip)
+	if m.origin != "" {
+		ev = ev.Str("origin", m.origin)
+	}
 	if a.extended {
-		ev = ev.Str("line", m.line).Str("regexp", m.regexp.String())
+		ev = ev.Str("line", m.line)
+		// Not set for JSON lines
+		if m.regexp != nil {
+			ev = ev.Str("regexp", m.regexp.String())
+			ev = ev.Interface("captures", m.captures)
+		}
+	}
+	msg := ""
+	if a.message != nil {
+		msg = a.rule.message(a.message, m)
 	}
-	ev.Msg("")
+	ev.Msg(msg)
 
 	return nil
 }
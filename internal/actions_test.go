@@ -0,0 +1,281 @@
+package gerberos
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	pd := func(s string, e time.Duration) {
+		t.Helper()
+		d, err := parseDuration(s)
+		testNoError(t, err)
+		if d != e {
+			t.Errorf(`expected "%s" to be parsed as %s, got %s`, s, e, d)
+		}
+	}
+
+	pd("1h", time.Hour)
+	pd("1d", 24*time.Hour)
+	pd("1.5d", 36*time.Hour)
+	pd("2w", 14*24*time.Hour)
+	pd("1d12h30m", 36*time.Hour+30*time.Minute)
+	pd("permanent", 0)
+
+	for _, s := range []string{"", "1", "1y", "d", "forever"} {
+		_, err := parseDuration(s)
+		testError(t, err)
+	}
+}
+
+func TestBanActionEscalation(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.backend = &testBackend{runner: rn}
+
+	ba := func(a ...string) *banAction {
+		t.Helper()
+		r := newTestValidRule()
+		r.Action = a
+		testNoError(t, r.initialize(rn))
+		return r.action.(*banAction)
+	}
+
+	ed := func(a *banAction, n int, e time.Duration) {
+		t.Helper()
+		if d := a.durationFor(n); d != e {
+			t.Errorf("expected duration %s after %d bans, got %s", e, n, d)
+		}
+	}
+
+	a := ba("ban", "1h", "escalate=1d,1w,permanent", "window=30d")
+	if a.window != 30*24*time.Hour || rn.offences.retention != a.window {
+		t.Error("unexpected window")
+	}
+	ed(a, 0, time.Hour)
+	ed(a, 1, 24*time.Hour)
+	ed(a, 2, 7*24*time.Hour)
+	ed(a, 3, 0)
+	ed(a, 10, 0)
+
+	a = ba("ban", "1h", "escalate=x3")
+	if a.window != banDefaultWindow {
+		t.Error("expected default window")
+	}
+	ed(a, 0, time.Hour)
+	ed(a, 2, 9*time.Hour)
+	ed(a, 100, 0)
+
+	a = ba("ban", "permanent", "escalate=1d")
+	ed(a, 1, 0)
+
+	// Bans are recorded
+	ip := net.ParseIP("192.0.2.1")
+	a = ba("ban", "1h", "escalate=1d")
+	testNoError(t, a.perform(&match{ip: ip}))
+	testNoError(t, a.perform(&match{ip: ip}))
+	if c := rn.offences.count(ip.String(), a.window); c != 2 {
+		t.Errorf("expected 2 offences, got %d", c)
+	}
+
+	// Bans are only recorded if escalating
+	ip = net.ParseIP("192.0.2.2")
+	a = ba("ban", "1h")
+	testNoError(t, a.perform(&match{ip: ip}))
+	if c := rn.offences.count(ip.String(), time.Hour); c != 0 {
+		t.Errorf("expected no offence, got %d", c)
+	}
+
+	// Failed bans are not recorded
+	ip = net.ParseIP("192.0.2.3")
+	a = ba("ban", "1h", "escalate=1d")
+	rn.backend = &testBackend{runner: rn, banErr: errFault}
+	testError(t, a.perform(&match{ip: ip}))
+	if c := rn.offences.count(ip.String(), time.Hour); c != 0 {
+		t.Errorf("expected no offence, got %d", c)
+	}
+}
+
+func TestBanActionPrefix(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.backend = &testBackend{runner: rn}
+
+	ba := func(a ...string) *banAction {
+		t.Helper()
+		r := newTestValidRule()
+		r.Action = a
+		testNoError(t, r.initialize(rn))
+		return r.action.(*banAction)
+	}
+
+	et := func(a *banAction, h string, e string) {
+		t.Helper()
+		ip := net.ParseIP(h)
+		m := &match{ip: ip, ipv6: ip.To4() == nil}
+		if n := netElement(a.target(m)); n != e {
+			t.Errorf(`expected "%s" to be banned as "%s", got "%s"`, h, e, n)
+		}
+		testNoError(t, a.perform(m))
+	}
+
+	a := ba("ban", "1h")
+	et(a, "192.0.2.1", "192.0.2.1")
+	et(a, "2001:db8::1", "2001:db8::1")
+
+	a = ba("ban", "1h", "prefix=24,64")
+	et(a, "192.0.2.1", "192.0.2.0/24")
+	et(a, "2001:db8::1", "2001:db8::/64")
+
+	// Subnets overlapping the ignore list are not banned
+	a.rule.ignore, err = newIgnoreList([]string{"192.0.2.128/25"})
+	testNoError(t, err)
+	et(a, "192.0.2.1", "192.0.2.1")
+	il, err := newIgnoreList([]string{"192.0.0.0/16"})
+	testNoError(t, err)
+	rn.ignore.Store(il)
+	et(a, "192.0.3.1", "192.0.3.1")
+	rn.ignore.Store(nil)
+
+	// Subnets are banned once enough distinct IPs within have been banned
+	a = ba("ban", "1h", "prefix=24,48", "prefixThreshold=3")
+	et(a, "198.51.100.1", "198.51.100.1")
+	et(a, "198.51.100.1", "198.51.100.1")
+	et(a, "198.51.101.1", "198.51.101.1")
+	et(a, "198.51.100.2", "198.51.100.2")
+	et(a, "198.51.100.3", "198.51.100.0/24")
+	et(a, "2001:db8:1::1", "2001:db8:1::1")
+	et(a, "2001:db8:1:1::1", "2001:db8:1:1::1")
+	et(a, "2001:db8:1:2::1", "2001:db8:1::/48")
+	if c := rn.offences.count("198.51.100.0/24", a.window); c != 1 {
+		t.Errorf("expected 1 offence of subnet, got %d", c)
+	}
+}
+
+// testPortBackend records bans and reports repeated ones.
+type testPortBackend struct {
+	testBackend
+	banned map[string]bool
+}
+
+func (b *testPortBackend) ban(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error {
+	e := portElement(n, p)
+	if b.banned[e] {
+		return errAlreadyBanned
+	}
+	b.banned[e] = true
+
+	return b.banErr
+}
+
+func (b *testPortBackend) unban(n *net.IPNet, ipv6 bool, p *port) error {
+	e := portElement(n, p)
+	if !b.banned[e] {
+		return errNotBanned
+	}
+	delete(b.banned, e)
+
+	return b.banErr
+}
+
+func (b *testPortBackend) list() (map[string]time.Duration, error) {
+	es := make(map[string]time.Duration)
+	for e := range b.banned {
+		es[e] = 0
+	}
+
+	return es, b.banErr
+}
+
+func TestBanActionPorts(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	b := &testPortBackend{testBackend: testBackend{runner: rn}, banned: make(map[string]bool)}
+	rn.backend = b
+
+	r := newTestValidRule()
+	r.Action = []string{"ban", "1h", "ports=22,2222", "escalate=x2"}
+	testNoError(t, r.initialize(rn))
+	a := r.action.(*banAction)
+
+	m := &match{ip: net.ParseIP("192.0.2.1")}
+	testNoError(t, a.perform(m))
+	for _, e := range []string{"192.0.2.1,tcp:22", "192.0.2.1,tcp:2222"} {
+		if !b.banned[e] {
+			t.Errorf("expected %s to be banned", e)
+		}
+	}
+	if len(b.banned) != 2 {
+		t.Errorf("expected 2 bans, got %v", b.banned)
+	}
+
+	// Already banned from all ports, not recorded again
+	testNoError(t, a.perform(m))
+	if c := rn.offences.count("192.0.2.1", a.window); c != 1 {
+		t.Errorf("expected 1 offence, got %d", c)
+	}
+
+	// Errors are reported
+	b.banErr = errFault
+	testError(t, a.perform(&match{ip: net.ParseIP("192.0.2.2")}))
+
+	r = newTestValidRule()
+	r.Action = []string{"ban", "1h", "protocol=sctp", "ports=5060"}
+	testNoError(t, r.initialize(rn))
+	b.banErr = nil
+	testNoError(t, r.action.perform(m))
+	if !b.banned["192.0.2.1,sctp:5060"] {
+		t.Errorf("expected sctp port to be banned, got %v", b.banned)
+	}
+}
+
+func TestBanActionDryRun(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	b := &testPortBackend{testBackend: testBackend{runner: rn}, banned: make(map[string]bool)}
+	rn.backend = b
+	rn.SetDryRun(true)
+
+	r := newTestValidRule()
+	r.Action = []string{"ban", "1h", "ports=22"}
+	testNoError(t, r.initialize(rn))
+	testNoError(t, r.action.perform(&match{ip: net.ParseIP("192.0.2.1")}))
+	if len(b.banned) != 0 {
+		t.Errorf("expected no bans, got %v", b.banned)
+	}
+	if c := rn.offences.count("192.0.2.1", r.action.(*banAction).window); c != 0 {
+		t.Errorf("expected no offences, got %d", c)
+	}
+}
+
+func TestUnbanAction(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	b := &testPortBackend{testBackend: testBackend{runner: rn}, banned: make(map[string]bool)}
+	rn.backend = b
+	for _, e := range []string{"192.0.2.1", "192.0.2.1,tcp:22", "192.0.2.0/24", "192.0.2.2", "2001:db8::1"} {
+		b.banned[e] = true
+	}
+
+	r := newTestValidRule()
+	r.Action = []string{"unban"}
+	testNoError(t, r.initialize(rn))
+
+	testNoError(t, r.action.perform(&match{ip: net.ParseIP("192.0.2.1")}))
+	if len(b.banned) != 2 || !b.banned["192.0.2.2"] || !b.banned["2001:db8::1"] {
+		t.Errorf("expected unrelated bans to remain, got %v", b.banned)
+	}
+
+	// Not banned
+	testNoError(t, r.action.perform(&match{ip: net.ParseIP("192.0.2.1")}))
+
+	testNoError(t, r.action.perform(&match{ip: net.ParseIP("2001:db8::1"), ipv6: true}))
+	if b.banned["2001:db8::1"] {
+		t.Error("expected IPv6 ban to be lifted")
+	}
+
+	// Errors are reported
+	b.banErr = errFault
+	testError(t, r.action.perform(&match{ip: net.ParseIP("192.0.2.2")}))
+}
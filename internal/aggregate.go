@@ -7,8 +7,17 @@ import (
 	"time"
 )
 
+type aggregateEntry struct {
+	ip   net.IP
+	time time.Time
+	// Time of the match, differs from the time registered if the timestamp
+	// option is used
+	matched  time.Time
+	captures map[string]string
+}
+
 type aggregate struct {
-	registry      map[string]net.IP
+	registry      map[string]*aggregateEntry
 	registryMutex sync.Mutex
 	interval      time.Duration
 	regexp        []*regexp.Regexp
@@ -16,7 +25,7 @@ type aggregate struct {
 
 func newAggregate(interval time.Duration, res []*regexp.Regexp) *aggregate {
 	return &aggregate{
-		registry: make(map[string]net.IP),
+		registry: make(map[string]*aggregateEntry),
 		interval: interval,
 		regexp:   res,
 	}
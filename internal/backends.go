@@ -1,55 +1,212 @@
 package gerberos
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/fs"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// errAlreadyBanned is returned by backends able to tell whether an IP or
+	// subnet has been banned already.
+	errAlreadyBanned = errors.New("already banned")
+	// errNotBanned is returned when lifting a ban which does not exist.
+	errNotBanned = errors.New("not banned")
 )
 
 type backend interface {
 	initialize() error
-	ban(ip net.IP, ipv6 bool, d time.Duration) error
+	// Bans either a single IP or a subnet, only from the port if given. Ports
+	// are not supported for subnets.
+	ban(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error
+	// Lifts a ban as passed to ban
+	unban(n *net.IPNet, ipv6 bool, p *port) error
+	// Returns all bans as formatted by portElement along with their remaining
+	// durations (zero if permanent)
+	list() (map[string]time.Duration, error)
 	finalize() error
 }
 
-type ipsetBackend struct {
-	runner     *Runner
-	chainName  string
-	ipset4Name string
-	ipset6Name string
+// portProtocols maps the supported protocols to their numbers.
+var portProtocols = map[string]uint8{
+	"tcp":  unix.IPPROTO_TCP,
+	"udp":  unix.IPPROTO_UDP,
+	"sctp": unix.IPPROTO_SCTP,
 }
 
-func (b *ipsetBackend) deleteIpsetsAndIptablesEntries() error {
-	if s, ec, _ := b.runner.executor.execute("iptables", "-D", b.chainName, "-j", "DROP", "-m", "set", "--match-set", b.ipset4Name, "src"); ec > 2 {
-		return fmt.Errorf(`failed to delete iptables entry for set "%s": %s`, b.ipset4Name, s)
+// port is a destination port of a protocol.
+type port struct {
+	protocol string
+	number   uint16
+}
+
+func (p *port) String() string {
+	return fmt.Sprintf("%s:%d", p.protocol, p.number)
+}
+
+// protocolPort returns the port of a protocol given by its number.
+func protocolPort(protocol uint8, number uint16) (*port, error) {
+	for pr, n := range portProtocols {
+		if n == protocol {
+			return &port{protocol: pr, number: number}, nil
+		}
 	}
-	if s, ec, _ := b.runner.executor.execute("iptables", "-D", "INPUT", "-j", b.chainName); ec > 2 {
-		return fmt.Errorf(`failed to delete iptables entry for chain "%s": %s`, b.chainName, s)
+
+	return nil, fmt.Errorf("unsupported protocol %d", protocol)
+}
+
+// parsePort parses a port like "tcp:22".
+func parsePort(s string) (*port, error) {
+	pr, n, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf(`invalid port "%s"`, s)
 	}
-	if s, ec, _ := b.runner.executor.execute("iptables", "-X", b.chainName); ec > 2 {
-		return fmt.Errorf(`failed to delete iptables chain "%s": %s`, b.chainName, s)
+	if _, ok := portProtocols[pr]; !ok {
+		return nil, fmt.Errorf(`unsupported protocol "%s"`, pr)
 	}
-	if s, ec, _ := b.runner.executor.execute("ip6tables", "-D", b.chainName, "-j", "DROP", "-m", "set", "--match-set", b.ipset6Name, "src"); ec > 2 {
-		return fmt.Errorf(`failed to delete ip6tables entry for set "%s": %s`, b.ipset6Name, s)
+	pn, err := strconv.ParseUint(n, 10, 16)
+	if err != nil || pn == 0 {
+		return nil, fmt.Errorf(`invalid port "%s"`, s)
 	}
-	if s, ec, _ := b.runner.executor.execute("ip6tables", "-D", "INPUT", "-j", b.chainName); ec > 2 {
-		return fmt.Errorf(`failed to delete ip6tables entry for chain "%s": %s`, b.chainName, s)
+
+	return &port{protocol: pr, number: uint16(pn)}, nil
+}
+
+// hostNet returns the network consisting of a single IP.
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
 	}
-	if s, ec, _ := b.runner.executor.execute("ip6tables", "-X", b.chainName); ec > 2 {
-		return fmt.Errorf(`failed to delete ip6tables chain "%s": %s`, b.chainName, s)
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// isHostNet reports whether a network consists of a single IP.
+func isHostNet(n *net.IPNet) bool {
+	o, b := n.Mask.Size()
+	return o == b
+}
+
+// netElement formats a network as set element: single IPs without prefix
+// length, subnets in CIDR notation.
+func netElement(n *net.IPNet) string {
+	if isHostNet(n) {
+		return n.IP.String()
 	}
-	time.Sleep(250 * time.Millisecond) // Workaround for potential kernel lock problems
-	if s, ec, _ := b.runner.executor.execute("ipset", "destroy", b.ipset4Name); ec > 1 {
-		return fmt.Errorf(`failed to destroy ipset "%s": %s`, b.ipset4Name, s)
+
+	return n.String()
+}
+
+// portElement formats a network and a port like ipset does, "1.2.3.4,tcp:22".
+// Without a port, it equals netElement.
+func portElement(n *net.IPNet, p *port) string {
+	if p == nil {
+		return netElement(n)
 	}
-	time.Sleep(250 * time.Millisecond) // Workaround for potential kernel lock problems
-	if s, ec, _ := b.runner.executor.execute("ipset", "destroy", b.ipset6Name); ec > 1 {
-		return fmt.Errorf(`failed to destroy ipset "%s": %s`, b.ipset6Name, s)
+
+	return fmt.Sprintf("%s,%s", netElement(n), p)
+}
+
+type ipsetBackend struct {
+	runner        *Runner
+	chainName     string
+	ipset4Name    string
+	ipset6Name    string
+	ipset4NetName string
+	ipset6NetName string
+	// Pairs of IPs and ports
+	ipset4PortName string
+	ipset6PortName string
+}
+
+func (b *ipsetBackend) deleteIpsetsAndIptablesEntries() error {
+	if err := b.deleteIptablesEntries(); err != nil {
+		return err
+	}
+	for _, n := range []string{b.ipset4Name, b.ipset6Name, b.ipset4NetName, b.ipset6NetName, b.ipset4PortName, b.ipset6PortName} {
+		time.Sleep(250 * time.Millisecond) // Workaround for potential kernel lock problems
+		if s, ec, _ := b.runner.executor.execute("ipset", "destroy", n); ec > 1 {
+			return fmt.Errorf(`failed to destroy ipset "%s": %s`, n, s)
+		}
+	}
+
+	return nil
+}
+
+// iptablesMatch holds an ipset and the packet fields matched against it.
+type iptablesMatch struct {
+	ipset string
+	flags string
+}
+
+// iptablesFamily holds the command and ipsets of an address family.
+type iptablesFamily struct {
+	command string
+	ipv6    bool
+	matches []iptablesMatch
+}
+
+func (b *ipsetBackend) iptablesFamilies() []iptablesFamily {
+	return []iptablesFamily{
+		{"iptables", false, []iptablesMatch{{b.ipset4Name, "src"}, {b.ipset4NetName, "src"}, {b.ipset4PortName, "src,dst"}}},
+		{"ip6tables", true, []iptablesMatch{{b.ipset6Name, "src"}, {b.ipset6NetName, "src"}, {b.ipset6PortName, "src,dst"}}},
+	}
+}
+
+// iptablesRules returns the rules matching an ipset in the order they are to
+// be inserted.
+func (b *ipsetBackend) iptablesRules(ipv6 bool, im iptablesMatch) [][]string {
+	fw := &b.runner.configuration.Firewall
+	m := []string{"-m", "set", "--match-set", im.ipset, im.flags}
+	switch fw.verdict {
+	case "reject":
+		r := append([]string{"-j", "REJECT"}, m...)
+		if fw.rejectType != "" {
+			t := fw.reject().iptables
+			if ipv6 {
+				t = fw.reject().ip6tables
+			}
+			r = append(r, "--reject-with", t)
+		}
+		return [][]string{r}
+	case "log":
+		// Rules are inserted, the last one ends up first
+		return [][]string{
+			append([]string{"-j", "DROP"}, m...),
+			append([]string{"-j", "LOG", "--log-prefix", fw.logPrefix}, m...),
+		}
+	}
+
+	return [][]string{append([]string{"-j", "DROP"}, m...)}
+}
+
+func (b *ipsetBackend) deleteIptablesEntries() error {
+	for _, f := range b.iptablesFamilies() {
+		for _, m := range f.matches {
+			for _, r := range b.iptablesRules(f.ipv6, m) {
+				if s, ec, _ := b.runner.executor.execute(f.command, append([]string{"-D", b.chainName}, r...)...); ec > 2 {
+					return fmt.Errorf(`failed to delete %s entry for set "%s": %s`, f.command, m.ipset, s)
+				}
+			}
+		}
+		for _, h := range b.runner.configuration.Firewall.Hooks {
+			if s, ec, _ := b.runner.executor.execute(f.command, "-D", strings.ToUpper(h), "-j", b.chainName); ec > 2 {
+				return fmt.Errorf(`failed to delete %s entry for chain "%s": %s`, f.command, b.chainName, s)
+			}
+		}
+		if s, ec, _ := b.runner.executor.execute(f.command, "-X", b.chainName); ec > 2 {
+			return fmt.Errorf(`failed to delete %s chain "%s": %s`, f.command, b.chainName, s)
+		}
 	}
 
 	return nil
@@ -65,48 +222,78 @@ func (b *ipsetBackend) createIpsets() error {
 		return fmt.Errorf(`failed to create ipset "%s": %s`, b.ipset6Name, s)
 	}
 
-	return nil
+	return b.createAddedIpsets()
 }
 
-func (b *ipsetBackend) createIptablesEntries() error {
-	if s, ec, _ := b.runner.executor.execute("iptables", "-N", b.chainName); ec != 0 {
-		return fmt.Errorf(`failed to create iptables chain "%s": %s`, b.chainName, s)
-	}
-	if s, ec, _ := b.runner.executor.execute("iptables", "-I", b.chainName, "-j", "DROP", "-m", "set", "--match-set", b.ipset4Name, "src"); ec != 0 {
-		return fmt.Errorf(`failed to create iptables entry for set "%s": %s`, b.ipset4Name, s)
-	}
-	if s, ec, _ := b.runner.executor.execute("iptables", "-I", "INPUT", "-j", b.chainName); ec != 0 {
-		return fmt.Errorf(`failed to create iptables entry for chain "%s": %s`, b.chainName, s)
+// createAddedIpsets creates the ipsets holding subnets and ports unless they
+// exist. They may be missing from save files of previous versions.
+func (b *ipsetBackend) createAddedIpsets() error {
+	time.Sleep(250 * time.Millisecond) // Workaround for potential kernel lock problems
+	if s, ec, _ := b.runner.executor.execute("ipset", "-exist", "create", b.ipset4NetName, "hash:net", "timeout", "0"); ec != 0 {
+		return fmt.Errorf(`failed to create ipset "%s": %s`, b.ipset4NetName, s)
 	}
-	if s, ec, _ := b.runner.executor.execute("ip6tables", "-N", b.chainName); ec != 0 {
-		return fmt.Errorf(`failed to create ip6tables chain "%s": %s`, b.chainName, s)
+	time.Sleep(250 * time.Millisecond) // Workaround for potential kernel lock problems
+	if s, ec, _ := b.runner.executor.execute("ipset", "-exist", "create", b.ipset6NetName, "hash:net", "family", "inet6", "timeout", "0"); ec != 0 {
+		return fmt.Errorf(`failed to create ipset "%s": %s`, b.ipset6NetName, s)
 	}
-	if s, ec, _ := b.runner.executor.execute("ip6tables", "-I", b.chainName, "-j", "DROP", "-m", "set", "--match-set", b.ipset6Name, "src"); ec != 0 {
-		return fmt.Errorf(`failed to create ip6tables entry for set "%s": %s`, b.ipset6Name, s)
+	time.Sleep(250 * time.Millisecond) // Workaround for potential kernel lock problems
+	if s, ec, _ := b.runner.executor.execute("ipset", "-exist", "create", b.ipset4PortName, "hash:ip,port", "timeout", "0"); ec != 0 {
+		return fmt.Errorf(`failed to create ipset "%s": %s`, b.ipset4PortName, s)
 	}
-	if s, ec, _ := b.runner.executor.execute("ip6tables", "-I", "INPUT", "-j", b.chainName); ec != 0 {
-		return fmt.Errorf(`failed to create ip6tables entry for chain "%s": %s`, b.chainName, s)
+	time.Sleep(250 * time.Millisecond) // Workaround for potential kernel lock problems
+	if s, ec, _ := b.runner.executor.execute("ipset", "-exist", "create", b.ipset6PortName, "hash:ip,port", "family", "inet6", "timeout", "0"); ec != 0 {
+		return fmt.Errorf(`failed to create ipset "%s": %s`, b.ipset6PortName, s)
 	}
 
 	return nil
 }
 
-func (b *ipsetBackend) saveIpsets() error {
-	f, err := os.Create(b.runner.configuration.SaveFilePath)
-	if err != nil {
-		return err
+func (b *ipsetBackend) createIptablesEntries() error {
+	for _, f := range b.iptablesFamilies() {
+		if s, ec, _ := b.runner.executor.execute(f.command, "-N", b.chainName); ec != 0 {
+			return fmt.Errorf(`failed to create %s chain "%s": %s`, f.command, b.chainName, s)
+		}
+		for _, m := range f.matches {
+			for _, r := range b.iptablesRules(f.ipv6, m) {
+				if s, ec, _ := b.runner.executor.execute(f.command, append([]string{"-I", b.chainName}, r...)...); ec != 0 {
+					return fmt.Errorf(`failed to create %s entry for set "%s": %s`, f.command, m.ipset, s)
+				}
+			}
+		}
+		for _, h := range b.runner.configuration.Firewall.Hooks {
+			if s, ec, _ := b.runner.executor.execute(f.command, "-I", strings.ToUpper(h), "-j", b.chainName); ec != 0 {
+				return fmt.Errorf(`failed to create %s entry for chain "%s": %s`, f.command, b.chainName, s)
+			}
+		}
 	}
-	defer f.Close()
 
-	if _, _, err := b.runner.executor.executeWithStd(nil, f, "ipset", "save"); err != nil {
-		return err
+	return nil
+}
+
+// ipsets returns the names of all ipsets of this instance.
+func (b *ipsetBackend) ipsets() []string {
+	return []string{b.ipset4Name, b.ipset6Name, b.ipset4NetName, b.ipset6NetName, b.ipset4PortName, b.ipset6PortName}
+}
+
+// saveIpsets saves only the ipsets of this instance, so that instances using
+// different names do not restore each other's ipsets.
+func (b *ipsetBackend) saveIpsets() error {
+	buf := &bytes.Buffer{}
+	for _, n := range b.ipsets() {
+		if _, _, err := b.runner.executor.executeWithStd(nil, buf, "ipset", "save", n); err != nil {
+			return err
+		}
 	}
 
-	// Always ensure file is saved to disk. This should prevent loss of banned IPs on shutdown.
-	return f.Sync()
+	return writeFileAtomically(b.runner.configuration.SaveFilePath, buf.Bytes())
 }
 
 func (b *ipsetBackend) restoreIpsets() error {
+	// Kept for the backend having written it
+	if err := checkSaveFile(b.runner.configuration.SaveFilePath, "ipset"); err != nil {
+		return err
+	}
+
 	f, err := os.Open(b.runner.configuration.SaveFilePath)
 	if err != nil {
 		return err
@@ -119,25 +306,31 @@ func (b *ipsetBackend) restoreIpsets() error {
 		}
 	}()
 
-	if _, _, err := b.runner.executor.executeWithStd(f, nil, "ipset", "restore"); err != nil {
+	if _, _, err := b.runner.executor.executeWithStd(f, nil, "ipset", "-exist", "restore"); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (b *ipsetBackend) initialize() error {
-	b.chainName = "gerberos"
-	b.ipset4Name = "gerberos4"
-	b.ipset6Name = "gerberos6"
-
-	// Check privileges
-	if s, _, err := b.runner.executor.execute("ipset", "list"); err != nil {
-		if errors.Is(err, exec.ErrNotFound) {
-			return errors.New("ipset: command not found")
-		}
-		return fmt.Errorf("ipset: insufficient privileges: %s", s)
+func (b *ipsetBackend) initializeFirewall() error {
+	fw := &b.runner.configuration.Firewall
+	if err := fw.initialize(ipsetHooks, "drop"); err != nil {
+		return fmt.Errorf("invalid firewall configuration: %w", err)
 	}
+
+	b.chainName = fw.Name
+	b.ipset4Name = fw.Name + "4"
+	b.ipset6Name = fw.Name + "6"
+	b.ipset4NetName = fw.Name + "4net"
+	b.ipset6NetName = fw.Name + "6net"
+	b.ipset4PortName = fw.Name + "4port"
+	b.ipset6PortName = fw.Name + "6port"
+
+	return nil
+}
+
+func (b *ipsetBackend) checkIptables() error {
 	if s, _, err := b.runner.executor.execute("iptables", "-L"); err != nil {
 		if errors.Is(err, exec.ErrNotFound) {
 			return errors.New("iptables: command not found")
@@ -151,17 +344,42 @@ func (b *ipsetBackend) initialize() error {
 		return fmt.Errorf("ip6tables: insufficient privileges: %s", s)
 	}
 
+	return nil
+}
+
+func (b *ipsetBackend) initialize() error {
+	if err := b.initializeFirewall(); err != nil {
+		return err
+	}
+
+	// Check privileges
+	if s, _, err := b.runner.executor.execute("ipset", "list"); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return errors.New("ipset: command not found")
+		}
+		return fmt.Errorf("ipset: insufficient privileges: %s", s)
+	}
+	if err := b.checkIptables(); err != nil {
+		return err
+	}
+
 	// Initialize ipsets and ip(6)tables entries
 	if err := b.deleteIpsetsAndIptablesEntries(); err != nil {
 		return fmt.Errorf("failed to delete ipsets and iptables entries: %w", err)
 	}
 	if b.runner.configuration.SaveFilePath != "" {
 		if err := b.restoreIpsets(); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Warn().Str("saveFilePath", b.runner.configuration.SaveFilePath).Err(err).Msg("failed to restore ipsets")
+			}
 			if err := b.createIpsets(); err != nil {
 				return fmt.Errorf("failed to create ipsets: %w", err)
 			}
 		} else {
 			log.Info().Str("saveFilePath", b.runner.configuration.SaveFilePath).Msg("restored ipsets")
+			if err := b.createAddedIpsets(); err != nil {
+				return fmt.Errorf("failed to create ipsets: %w", err)
+			}
 		}
 	} else {
 		log.Warn().Msg("not persisting ipsets")
@@ -176,20 +394,100 @@ func (b *ipsetBackend) initialize() error {
 	return nil
 }
 
-func (b *ipsetBackend) ban(ip net.IP, ipv6 bool, d time.Duration) error {
+// ipsetFor returns the name of the ipset holding an element.
+func (b *ipsetBackend) ipsetFor(n *net.IPNet, ipv6 bool, p *port) string {
 	s := b.ipset4Name
 	if ipv6 {
 		s = b.ipset6Name
 	}
+	if !isHostNet(n) {
+		s = b.ipset4NetName
+		if ipv6 {
+			s = b.ipset6NetName
+		}
+	}
+	if p != nil {
+		s = b.ipset4PortName
+		if ipv6 {
+			s = b.ipset6PortName
+		}
+	}
+
+	return s
+}
+
+func (b *ipsetBackend) ban(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error {
+	s := b.ipsetFor(n, ipv6, p)
+	e := portElement(n, p)
 	ds := int64(d.Seconds())
-	if _, _, err := b.runner.executor.execute("ipset", "test", s, ip.String()); err != nil {
-		if _, _, err := b.runner.executor.execute("ipset", "add", s, ip.String(), "timeout", fmt.Sprint(ds)); err != nil {
+	if _, _, err := b.runner.executor.execute("ipset", "test", s, e); err != nil {
+		if _, _, err := b.runner.executor.execute("ipset", "add", s, e, "timeout", fmt.Sprint(ds)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func (b *ipsetBackend) unban(n *net.IPNet, ipv6 bool, p *port) error {
+	s := b.ipsetFor(n, ipv6, p)
+	if o, _, err := b.runner.executor.execute("ipset", "del", s, portElement(n, p)); err != nil {
+		if strings.Contains(o, "it's not added") {
+			return errNotBanned
+		}
+		return fmt.Errorf(`failed to delete element from ipset "%s": %s`, s, o)
+	}
+
+	return nil
+}
+
+func (b *ipsetBackend) list() (map[string]time.Duration, error) {
+	es := make(map[string]time.Duration)
+	for _, s := range []string{b.ipset4Name, b.ipset6Name, b.ipset4NetName, b.ipset6NetName, b.ipset4PortName, b.ipset6PortName} {
+		o, _, err := b.runner.executor.execute("ipset", "list", s)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to list ipset "%s": %s`, s, o)
+		}
+		if err := parseIpsetList(o, es); err != nil {
+			return nil, fmt.Errorf(`failed to parse ipset "%s": %w`, s, err)
+		}
+	}
+
+	return es, nil
+}
+
+// parseIpsetList parses the members listed by "ipset list" like
+// "1.2.3.4,tcp:22 timeout 3600".
+func parseIpsetList(s string, es map[string]time.Duration) error {
+	_, ms, ok := strings.Cut(s, "Members:\n")
+	if !ok {
+		return errors.New("missing members")
+	}
+
+	for _, l := range strings.Split(ms, "\n") {
+		fs := strings.Fields(l)
+		if len(fs) == 0 {
+			continue
+		}
+		var d time.Duration
+		for i := 1; i+1 < len(fs); i++ {
+			if fs[i] == "timeout" {
+				t, err := strconv.ParseInt(fs[i+1], 10, 64)
+				if err != nil {
+					return fmt.Errorf(`invalid timeout "%s"`, fs[i+1])
+				}
+				d = time.Duration(t) * time.Second
+			}
+		}
+		n, p, err := parseElement(fs[0])
+		if err != nil {
+			return err
+		}
+		es[portElement(n, p)] = d
+	}
+
+	return nil
+}
+
 func (b *ipsetBackend) finalize() error {
 	if b.runner.configuration.SaveFilePath != "" {
 		if err := b.saveIpsets(); err != nil {
@@ -203,43 +501,87 @@ func (b *ipsetBackend) finalize() error {
 }
 
 type nftBackend struct {
-	runner     *Runner
-	table4Name string
-	table6Name string
-	set4Name   string
-	set6Name   string
+	runner      *Runner
+	table4Name  string
+	table6Name  string
+	set4Name    string
+	set6Name    string
+	set4NetName string
+	set6NetName string
+	// Concatenations of IPs, protocols and ports
+	set4PortName string
+	set6PortName string
 }
 
-func (b *nftBackend) createTables() error {
-	if s, _, err := b.runner.executor.execute("nft", "add", "table", "ip", b.table4Name); err != nil {
-		return fmt.Errorf(`failed to add table "%s": %s`, b.table4Name, s)
-	}
-	if s, _, err := b.runner.executor.execute("nft", "add", "set", "ip", b.table4Name, b.set4Name, "{ type ipv4_addr; flags timeout; }"); err != nil {
-		return fmt.Errorf(`failed to add ip set "%s": %s`, b.table4Name, s)
-	}
-	if s, _, err := b.runner.executor.execute("nft", "add", "chain", "ip", b.table4Name, "input", "{ type filter hook input priority 0; policy accept; }"); err != nil {
-		return fmt.Errorf(`failed to add input chain: %s`, s)
-	}
-	if s, _, err := b.runner.executor.execute("nft", "flush", "chain", "ip", b.table4Name, "input"); err != nil {
-		return fmt.Errorf(`failed to flush input chain: %s`, s)
-	}
-	if s, _, err := b.runner.executor.execute("nft", "add", "rule", "ip", b.table4Name, "input", "ip", "saddr", "@"+b.set4Name, "reject"); err != nil {
-		return fmt.Errorf(`failed to add rule: %s`, s)
-	}
-	if s, _, err := b.runner.executor.execute("nft", "add", "table", "ip6", b.table6Name); err != nil {
-		return fmt.Errorf(`failed to create ip6 table "%s": %s`, b.table6Name, s)
-	}
-	if s, _, err := b.runner.executor.execute("nft", "add", "set", "ip6", b.table6Name, b.set6Name, "{ type ipv6_addr; flags timeout; }"); err != nil {
-		return fmt.Errorf(`failed to add ip set "%s": %s`, b.table6Name, s)
-	}
-	if s, _, err := b.runner.executor.execute("nft", "add", "chain", "ip6", b.table6Name, "input", "{ type filter hook input priority 0; policy accept; }"); err != nil {
-		return fmt.Errorf(`failed to add input chain: %s`, s)
+// nftFamily holds the names of the table and sets of an address family.
+type nftFamily struct {
+	family  string
+	table   string
+	set     string
+	netSet  string
+	portSet string
+	keyType string
+}
+
+func (b *nftBackend) families() []nftFamily {
+	return []nftFamily{
+		{"ip", b.table4Name, b.set4Name, b.set4NetName, b.set4PortName, "ipv4_addr"},
+		{"ip6", b.table6Name, b.set6Name, b.set6NetName, b.set6PortName, "ipv6_addr"},
 	}
-	if s, _, err := b.runner.executor.execute("nft", "flush", "chain", "ip6", b.table6Name, "input"); err != nil {
-		return fmt.Errorf(`failed to flush input chain: %s`, s)
+}
+
+// verdict returns the statement of rules matching a set.
+func (b *nftBackend) verdict(family string) []string {
+	fw := &b.runner.configuration.Firewall
+	switch fw.verdict {
+	case "reject":
+		if fw.rejectType == "" {
+			return []string{"reject"}
+		}
+		if family == "ip6" {
+			return []string{"reject", "with", "icmpv6", "type", fw.reject().nft6}
+		}
+		return []string{"reject", "with", "icmp", "type", fw.reject().nft}
+	case "log":
+		return []string{"log", "prefix", `"` + fw.logPrefix + `"`, "drop"}
 	}
-	if s, _, err := b.runner.executor.execute("nft", "add", "rule", "ip6", b.table6Name, "input", "ip6", "saddr", "@"+b.set6Name, "reject"); err != nil {
-		return fmt.Errorf(`failed to add rule: %s`, s)
+
+	return []string{"drop"}
+}
+
+func (b *nftBackend) createTables() error {
+	fw := &b.runner.configuration.Firewall
+	for _, f := range b.families() {
+		if s, _, err := b.runner.executor.execute("nft", "add", "table", f.family, f.table); err != nil {
+			return fmt.Errorf(`failed to add %s table "%s": %s`, f.family, f.table, s)
+		}
+		if s, _, err := b.runner.executor.execute("nft", "add", "set", f.family, f.table, f.set, fmt.Sprintf("{ type %s; flags timeout; }", f.keyType)); err != nil {
+			return fmt.Errorf(`failed to add %s set "%s": %s`, f.family, f.set, s)
+		}
+		if s, _, err := b.runner.executor.execute("nft", "add", "set", f.family, f.table, f.netSet, fmt.Sprintf("{ type %s; flags interval, timeout; }", f.keyType)); err != nil {
+			return fmt.Errorf(`failed to add %s set "%s": %s`, f.family, f.netSet, s)
+		}
+		if s, _, err := b.runner.executor.execute("nft", "add", "set", f.family, f.table, f.portSet, fmt.Sprintf("{ type %s . inet_proto . inet_service; flags timeout; }", f.keyType)); err != nil {
+			return fmt.Errorf(`failed to add %s set "%s": %s`, f.family, f.portSet, s)
+		}
+		for _, h := range fw.Hooks {
+			if s, _, err := b.runner.executor.execute("nft", "add", "chain", f.family, f.table, h, fmt.Sprintf("{ type filter hook %s priority %d; policy accept; }", h, fw.Priority)); err != nil {
+				return fmt.Errorf(`failed to add %s chain: %s`, h, s)
+			}
+			if s, _, err := b.runner.executor.execute("nft", "flush", "chain", f.family, f.table, h); err != nil {
+				return fmt.Errorf(`failed to flush %s chain: %s`, h, s)
+			}
+			for _, sn := range []string{f.set, f.netSet} {
+				args := append([]string{"add", "rule", f.family, f.table, h, f.family, "saddr", "@" + sn}, b.verdict(f.family)...)
+				if s, _, err := b.runner.executor.execute("nft", args...); err != nil {
+					return fmt.Errorf(`failed to add rule: %s`, s)
+				}
+			}
+			args := append([]string{"add", "rule", f.family, f.table, h, f.family, "saddr", ".", "meta", "l4proto", ".", "th", "dport", "@" + f.portSet}, b.verdict(f.family)...)
+			if s, _, err := b.runner.executor.execute("nft", args...); err != nil {
+				return fmt.Errorf(`failed to add rule: %s`, s)
+			}
+		}
 	}
 
 	return nil
@@ -257,35 +599,41 @@ func (b *nftBackend) deleteTables() error {
 }
 
 func (b *nftBackend) saveSets() error {
-	f, err := os.Create(b.runner.configuration.SaveFilePath)
-	if err != nil {
-		return err
+	buf := &bytes.Buffer{}
+	for _, f := range b.families() {
+		for _, sn := range []string{f.set, f.netSet, f.portSet} {
+			if _, _, err := b.runner.executor.executeWithStd(nil, buf, "nft", "list", "set", f.family, f.table, sn); err != nil {
+				return err
+			}
+		}
 	}
-	defer f.Close()
 
-	if _, _, err := b.runner.executor.executeWithStd(nil, f, "nft", "list", "set", "ip", b.table4Name, b.set4Name); err != nil {
-		return err
-	}
+	return writeFileAtomically(b.runner.configuration.SaveFilePath, buf.Bytes())
+}
 
-	if _, _, err := b.runner.executor.executeWithStd(nil, f, "nft", "list", "set", "ip6", b.table6Name, b.set6Name); err != nil {
+func (b *nftBackend) restoreSets() error {
+	if err := checkSaveFile(b.runner.configuration.SaveFilePath, "nft"); err != nil {
 		return err
 	}
 
-	// Always ensure file is saved to disk. This should prevent loss of banned IPs on shutdown.
-	return f.Sync()
-}
-
-func (b *nftBackend) restoreSets() error {
 	_, _, err := b.runner.executor.execute("nft", "-f", b.runner.configuration.SaveFilePath)
 
 	return err
 }
 
 func (b *nftBackend) initialize() error {
-	b.table4Name = "gerberos4"
-	b.table6Name = "gerberos6"
+	fw := &b.runner.configuration.Firewall
+	if err := fw.initialize(nftHooks, "reject"); err != nil {
+		return fmt.Errorf("invalid firewall configuration: %w", err)
+	}
+	b.table4Name = fw.Name + "4"
+	b.table6Name = fw.Name + "6"
 	b.set4Name = "set4"
 	b.set6Name = "set6"
+	b.set4NetName = "net4"
+	b.set6NetName = "net6"
+	b.set4PortName = "port4"
+	b.set6PortName = "port6"
 
 	// Check privileges
 	if s, _, err := b.runner.executor.execute("nft", "list", "ruleset"); err != nil {
@@ -312,26 +660,161 @@ func (b *nftBackend) initialize() error {
 	return nil
 }
 
-func (b *nftBackend) ban(ip net.IP, ipv6 bool, d time.Duration) error {
-	ds := int64(d.Seconds())
-
+// element returns the family, table, set and key of an element.
+func (b *nftBackend) element(n *net.IPNet, ipv6 bool, p *port) (string, string, string, string) {
 	t, tn, sn := "ip", b.table4Name, b.set4Name
 	if ipv6 {
 		t, tn, sn = "ip6", b.table6Name, b.set6Name
 	}
-	if s, ec, err := b.runner.executor.execute("nft", "add", "element", t, tn, sn, fmt.Sprintf("{ %s timeout %ds }", ip, ds)); err != nil {
+	if !isHostNet(n) {
+		sn = b.set4NetName
+		if ipv6 {
+			sn = b.set6NetName
+		}
+	}
+	k := netElement(n)
+	if p != nil {
+		sn = b.set4PortName
+		if ipv6 {
+			sn = b.set6PortName
+		}
+		k = fmt.Sprintf("%s . %s . %d", k, p.protocol, p.number)
+	}
+
+	return t, tn, sn, k
+}
+
+func (b *nftBackend) ban(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error {
+	ds := int64(d.Seconds())
+	t, tn, sn, k := b.element(n, ipv6, p)
+	e := fmt.Sprintf("{ %s timeout %ds }", k, ds)
+	if d == 0 {
+		// Permanent
+		e = fmt.Sprintf("{ %s }", k)
+	}
+	if s, ec, err := b.runner.executor.execute("nft", "add", "element", t, tn, sn, e); err != nil {
 		if ec == 1 {
 			// This IP is probably already in set. Ignore the error. This is to be reworked
 			// when support for nft < v1.0.0 is dropped. However, since Ubuntu 20.04 only has
 			// v0.9.3, this is needed.
 			return nil
 		}
-		return fmt.Errorf(`failed to add element to set "%s": %s`, b.set6Name, s)
+		return fmt.Errorf(`failed to add element to set "%s": %s`, sn, s)
 	}
 
 	return nil
 }
 
+func (b *nftBackend) unban(n *net.IPNet, ipv6 bool, p *port) error {
+	t, tn, sn, k := b.element(n, ipv6, p)
+	if s, _, err := b.runner.executor.execute("nft", "delete", "element", t, tn, sn, fmt.Sprintf("{ %s }", k)); err != nil {
+		if strings.Contains(s, "No such file or directory") {
+			return errNotBanned
+		}
+		return fmt.Errorf(`failed to delete element from set "%s": %s`, sn, s)
+	}
+
+	return nil
+}
+
+func (b *nftBackend) list() (map[string]time.Duration, error) {
+	es := make(map[string]time.Duration)
+	for _, f := range b.families() {
+		for _, sn := range []string{f.set, f.netSet, f.portSet} {
+			s, _, err := b.runner.executor.execute("nft", "list", "set", f.family, f.table, sn)
+			if err != nil {
+				return nil, fmt.Errorf(`failed to list set "%s": %s`, sn, s)
+			}
+			if err := parseNftList(s, es); err != nil {
+				return nil, fmt.Errorf(`failed to parse set "%s": %w`, sn, err)
+			}
+		}
+	}
+
+	return es, nil
+}
+
+// parseNftList parses the elements listed by "nft list set" like
+// "1.2.3.4 . tcp . 22 timeout 1h expires 59m58s".
+func parseNftList(s string, es map[string]time.Duration) error {
+	_, l, ok := strings.Cut(s, "elements = {")
+	if !ok {
+		// Empty
+		return nil
+	}
+	l, _, ok = strings.Cut(l, "}")
+	if !ok {
+		return errors.New("unterminated elements")
+	}
+
+	for _, e := range strings.Split(l, ",") {
+		fs := strings.Fields(e)
+		if len(fs) == 0 {
+			continue
+		}
+		ks := make([]string, 0)
+		var d time.Duration
+		for i := 0; i < len(fs); i++ {
+			switch fs[i] {
+			case "timeout":
+				i++
+			case "expires":
+				if i+1 >= len(fs) {
+					return fmt.Errorf(`missing expiration of element "%s"`, strings.TrimSpace(e))
+				}
+				i++
+				ed, err := parseDuration(fs[i])
+				if err != nil {
+					return err
+				}
+				d = ed
+			case ".":
+			default:
+				ks = append(ks, fs[i])
+			}
+		}
+
+		n, p, err := parseNftKey(ks)
+		if err != nil {
+			return err
+		}
+		es[portElement(n, p)] = d
+	}
+
+	return nil
+}
+
+// parseNftKey parses a key consisting of an IP or subnet, optionally
+// concatenated with a protocol and a port given by names or numbers.
+func parseNftKey(ks []string) (*net.IPNet, *port, error) {
+	n, _, err := parseElement(ks[0])
+	if err != nil || len(ks) == 1 {
+		return n, nil, err
+	}
+	if len(ks) != 3 {
+		return nil, nil, fmt.Errorf(`invalid element "%s"`, strings.Join(ks, " . "))
+	}
+
+	pr := ks[1]
+	if pn, err := strconv.ParseUint(pr, 10, 8); err == nil {
+		p, err := protocolPort(uint8(pn), 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		pr = p.protocol
+	}
+	pn, err := net.LookupPort(pr, ks[2])
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := parsePort(fmt.Sprintf("%s:%d", pr, pn))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return n, p, nil
+}
+
 func (b *nftBackend) finalize() error {
 	if b.runner.configuration.SaveFilePath != "" {
 		if err := b.saveSets(); err != nil {
@@ -346,6 +829,30 @@ func (b *nftBackend) finalize() error {
 	return nil
 }
 
+// noopBackend bans nothing. It is used when checking configurations and for
+// dry runs.
+type noopBackend struct{}
+
+func (b *noopBackend) initialize() error {
+	return nil
+}
+
+func (b *noopBackend) ban(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error {
+	return nil
+}
+
+func (b *noopBackend) unban(n *net.IPNet, ipv6 bool, p *port) error {
+	return errNotBanned
+}
+
+func (b *noopBackend) list() (map[string]time.Duration, error) {
+	return make(map[string]time.Duration), nil
+}
+
+func (b *noopBackend) finalize() error {
+	return nil
+}
+
 type testBackend struct {
 	runner        *Runner
 	initializeErr error
@@ -357,10 +864,18 @@ func (b *testBackend) initialize() error {
 	return b.initializeErr
 }
 
-func (b *testBackend) ban(ip net.IP, ipv6 bool, d time.Duration) error {
+func (b *testBackend) ban(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error {
+	return b.banErr
+}
+
+func (b *testBackend) unban(n *net.IPNet, ipv6 bool, p *port) error {
 	return b.banErr
 }
 
+func (b *testBackend) list() (map[string]time.Duration, error) {
+	return make(map[string]time.Duration), b.banErr
+}
+
 func (b *testBackend) finalize() error {
 	return b.finalizeErr
 }
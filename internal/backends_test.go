@@ -0,0 +1,194 @@
+package gerberos
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIpsetList(t *testing.T) {
+	es := make(map[string]time.Duration)
+	testNoError(t, parseIpsetList(`Name: gerberos4port
+Type: hash:ip,port
+Revision: 7
+Header: family inet hashsize 1024 maxelem 65536 timeout 0 bucketsize 12 initval 0x1f4a3c2b
+Size in memory: 296
+References: 1
+Number of entries: 2
+Members:
+1.2.3.4,tcp:22 timeout 3599
+1.2.3.5,udp:53 timeout 0
+`, es))
+	testNoError(t, parseIpsetList("Name: gerberos6net\nMembers:\n2001:db8::/48 timeout 60\n", es))
+	testNoError(t, parseIpsetList("Name: gerberos4\nMembers:\n", es))
+	for e, d := range map[string]time.Duration{
+		"1.2.3.4,tcp:22": 3599 * time.Second,
+		"1.2.3.5,udp:53": 0,
+		"2001:db8::/48":  time.Minute,
+	} {
+		if es[e] != d {
+			t.Errorf("expected element %s with duration %s, got %v", e, d, es)
+		}
+	}
+	if len(es) != 3 {
+		t.Errorf("expected 3 elements, got %v", es)
+	}
+
+	testError(t, parseIpsetList("Name: gerberos4\n", es))
+	testError(t, parseIpsetList("Members:\n1.2.3.4 timeout x\n", es))
+	testError(t, parseIpsetList("Members:\ninvalid\n", es))
+}
+
+func TestParseNftList(t *testing.T) {
+	es := make(map[string]time.Duration)
+	testNoError(t, parseNftList(`table ip gerberos4 {
+	set port4 {
+		type ipv4_addr . inet_proto . inet_service
+		flags timeout
+		elements = { 1.2.3.4 . tcp . 22 timeout 1h expires 59m58s120ms,
+			     1.2.3.5 . 17 . domain }
+	}
+}
+`, es))
+	testNoError(t, parseNftList("table ip6 gerberos6 {\n\tset net6 {\n\t\telements = { 2001:db8::/48 timeout 1d expires 23h59m }\n\t}\n}\n", es))
+	testNoError(t, parseNftList("table ip gerberos4 {\n\tset ip4 {\n\t\ttype ipv4_addr\n\t}\n}\n", es))
+	for e, d := range map[string]time.Duration{
+		"1.2.3.4,tcp:22": 59*time.Minute + 58*time.Second + 120*time.Millisecond,
+		"1.2.3.5,udp:53": 0,
+		"2001:db8::/48":  23*time.Hour + 59*time.Minute,
+	} {
+		if es[e] != d {
+			t.Errorf("expected element %s with duration %s, got %v", e, d, es)
+		}
+	}
+	if len(es) != 3 {
+		t.Errorf("expected 3 elements, got %v", es)
+	}
+
+	testError(t, parseNftList("elements = { 1.2.3.4", es))
+	testError(t, parseNftList("elements = { 1.2.3.4 expires }", es))
+	testError(t, parseNftList("elements = { 1.2.3.4 . tcp }", es))
+	testError(t, parseNftList("elements = { 1.2.3.4 . gre . 22 }", es))
+}
+
+func TestSaveFileFormat(t *testing.T) {
+	d := t.TempDir()
+	sf := func(c string, e string) {
+		t.Helper()
+		p := filepath.Join(d, "save")
+		testNoError(t, os.WriteFile(p, []byte(c), 0600))
+		f, err := saveFileFormat(p)
+		testNoError(t, err)
+		if f != e {
+			t.Errorf(`expected format "%s", got "%s"`, e, f)
+		}
+	}
+
+	sf("create gerberos4 hash:ip family inet timeout 0\nadd gerberos4 1.2.3.4 timeout 60\n", "ipset")
+	sf("table ip gerberos4 {\n\tset set4 {\n", "nft")
+	sf(`{"Elements":[]}`, "json")
+	sf("", "")
+	sf("garbage", "unknown")
+
+	// Written by the ipset backend, read by a netlink backend
+	p := filepath.Join(d, "save")
+	testNoError(t, os.WriteFile(p, []byte("create gerberos4 hash:ip\n"), 0600))
+	testError(t, restoreElements(p, func(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error {
+		t.Error("unexpected ban")
+		return nil
+	}))
+
+	es := map[string]time.Duration{"1.2.3.4": time.Hour, "10.0.0.0/8": 0}
+	testNoError(t, saveElements(p, es))
+	bs := make(map[string]bool)
+	testNoError(t, restoreElements(p, func(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error {
+		bs[n.String()] = true
+		return nil
+	}))
+	if len(bs) != 2 || !bs["1.2.3.4/32"] || !bs["10.0.0.0/8"] {
+		t.Errorf("unexpected bans %v", bs)
+	}
+	testError(t, checkSaveFile(p, "nft"))
+}
+
+// testIpsetExecutor stands in for ipset, keeping sets by name.
+type testIpsetExecutor struct {
+	sets     map[string]string
+	restored []string
+}
+
+func (e *testIpsetExecutor) execute(name string, args ...string) (string, int, error) {
+	return e.executeWithStd(nil, nil, name, args...)
+}
+
+func (e *testIpsetExecutor) executeWithStd(stdin io.Reader, stdout io.Writer, name string, args ...string) (string, int, error) {
+	switch {
+	case len(args) == 1 && args[0] == "save":
+		for _, s := range e.sets {
+			io.WriteString(stdout, s)
+		}
+	case len(args) == 2 && args[0] == "save":
+		io.WriteString(stdout, e.sets[args[1]])
+	case len(args) == 2 && args[0] == "-exist" && args[1] == "restore":
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return "", 1, err
+		}
+		e.restored = append(e.restored, string(b))
+	default:
+		return "", 1, errFault
+	}
+
+	return "", 0, nil
+}
+
+func TestIpsetBackendSaveRestore(t *testing.T) {
+	e := &testIpsetExecutor{sets: make(map[string]string)}
+	d := t.TempDir()
+	nb := func(name string) *ipsetBackend {
+		t.Helper()
+		rn, err := newTestRunner()
+		testNoError(t, err)
+		rn.executor = e
+		rn.configuration.Firewall.Name = name
+		rn.configuration.SaveFilePath = filepath.Join(d, name)
+		b := &ipsetBackend{runner: rn}
+		testNoError(t, b.initializeFirewall())
+		for _, n := range b.ipsets() {
+			e.sets[n] = fmt.Sprintf("create %s hash:ip\n", n)
+		}
+		return b
+	}
+
+	// Two instances side by side
+	ba, bb := nb("a"), nb("b")
+	for _, b := range []*ipsetBackend{ba, bb} {
+		testNoError(t, b.saveIpsets())
+		testNoError(t, b.restoreIpsets())
+	}
+	if len(e.restored) != 2 {
+		t.Fatalf("expected 2 restores, got %d", len(e.restored))
+	}
+	for i, b := range []*ipsetBackend{ba, bb} {
+		r := e.restored[i]
+		for _, n := range b.ipsets() {
+			if !strings.Contains(r, "create "+n+" ") {
+				t.Errorf(`expected ipset "%s" to be restored`, n)
+			}
+		}
+		o := bb
+		if b == bb {
+			o = ba
+		}
+		for _, n := range o.ipsets() {
+			if strings.Contains(r, "create "+n+" ") {
+				t.Errorf(`unexpected ipset "%s" of other instance`, n)
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package gerberos
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,10 +11,16 @@ import (
 )
 
 type Configuration struct {
-	Backend      string
-	SaveFilePath string
-	LogLevel     string
-	Rules        map[string]*rule
+	Backend              string
+	SaveFilePath         string
+	ControlSocketPath    string
+	MetricsListenAddress string
+	LogLevel             string
+	Ignore               []string
+	Firewall             firewall
+	Rules                map[string]*rule
+
+	path string
 }
 
 func (c *Configuration) ReadFile(path string) error {
@@ -22,10 +29,22 @@ func (c *Configuration) ReadFile(path string) error {
 		return fmt.Errorf("failed to open configuration file: %w", err)
 	}
 	defer cf.Close()
+	c.path = path
 
 	return c.read(cf)
 }
 
+// settings encodes all values except the rules and the ignore list, which are
+// the only values applied by reloads.
+func (c *Configuration) settings() string {
+	cc := *c
+	cc.Rules = nil
+	cc.Ignore = nil
+	b, _ := json.Marshal(cc)
+
+	return string(b)
+}
+
 func (c *Configuration) read(r io.Reader) error {
 	if _, err := toml.NewDecoder(r).Decode(&c); err != nil {
 		var terr toml.ParseError
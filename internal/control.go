@@ -0,0 +1,295 @@
+package gerberos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	controlTimeout = 10 * time.Second
+)
+
+// ControlRequest is sent to the control socket, one per connection.
+type ControlRequest struct {
+	Command   string
+	Arguments []string
+}
+
+// ControlResponse answers a ControlRequest. Only the fields relevant to the
+// command are set.
+type ControlResponse struct {
+	Error    string         `json:",omitempty"`
+	Status   *ControlStatus `json:",omitempty"`
+	Bans     []*ControlBan  `json:",omitempty"`
+	Rules    []*ControlRule `json:",omitempty"`
+	Elements []string       `json:",omitempty"`
+}
+
+type ControlStatus struct {
+	Backend string
+	Started time.Time
+	Rules   int
+	Bans    int
+}
+
+// ControlBan is a banned IP or subnet. A zero remaining duration means the ban
+// is permanent. The rule is empty for bans restored at startup or issued via
+// the control socket.
+type ControlBan struct {
+	Element   string
+	Remaining time.Duration
+	Rule      string `json:",omitempty"`
+}
+
+type ControlRule struct {
+	Name           string
+	Lines          uint64
+	Matches        uint64
+	Actions        uint64
+	ActionFailures uint64
+}
+
+// banRegistry remembers the rule which banned an element.
+type banRegistry struct {
+	mutex sync.Mutex
+	rules map[string]string
+}
+
+func (r *banRegistry) add(e string, rule string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.rules[e] = rule
+}
+
+func (r *banRegistry) remove(e string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.rules, e)
+}
+
+// retain discards all elements which are no longer banned and returns the
+// rules of the remaining ones.
+func (r *banRegistry) retain(es map[string]time.Duration) map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rs := make(map[string]string)
+	for e, rule := range r.rules {
+		if _, ok := es[e]; !ok {
+			delete(r.rules, e)
+			continue
+		}
+		rs[e] = rule
+	}
+
+	return rs
+}
+
+func newBanRegistry() *banRegistry {
+	return &banRegistry{
+		rules: make(map[string]string),
+	}
+}
+
+func (rn *Runner) initializeControl() error {
+	p := rn.configuration.ControlSocketPath
+	if p == "" {
+		return nil
+	}
+
+	// Left behind if the previous instance was killed
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove control socket: %w", err)
+	}
+	// Created inaccessible to others right away. Initialization does not run
+	// concurrently with anything creating files, so the umask can be changed.
+	um := unix.Umask(0177)
+	l, err := net.Listen("unix", p)
+	unix.Umask(um)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(p, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to restrict access to control socket: %w", err)
+	}
+	rn.control = l
+	log.Info().Str("controlSocketPath", p).Msg("listening on control socket")
+
+	return nil
+}
+
+func (rn *Runner) serveControl() {
+	for {
+		c, err := rn.control.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Warn().Err(err).Msg("failed to accept control connection")
+			continue
+		}
+		go rn.handleControl(c)
+	}
+}
+
+func (rn *Runner) handleControl(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(controlTimeout))
+
+	q := &ControlRequest{}
+	s := &ControlResponse{}
+	if err := json.NewDecoder(c).Decode(q); err != nil {
+		s.Error = fmt.Sprintf("failed to decode request: %s", err)
+	} else if err := rn.controlCommand(q, s); err != nil {
+		s.Error = err.Error()
+	}
+
+	if err := json.NewEncoder(c).Encode(s); err != nil {
+		log.Warn().Str("command", q.Command).Err(err).Msg("failed to send control response")
+	}
+}
+
+func (rn *Runner) controlCommand(q *ControlRequest, s *ControlResponse) error {
+	as := q.Arguments
+	switch q.Command {
+	case "status":
+		if len(as) > 0 {
+			return errors.New("superfluous argument(s)")
+		}
+		es, err := rn.backend.list()
+		if err != nil {
+			return fmt.Errorf("failed to list banned IPs: %w", err)
+		}
+		s.Status = &ControlStatus{
+			Backend: rn.configuration.Backend,
+			Started: rn.started,
+			Rules:   len(rn.rules()),
+			Bans:    len(es),
+		}
+	case "list":
+		if len(as) > 0 {
+			return errors.New("superfluous argument(s)")
+		}
+		es, err := rn.backend.list()
+		if err != nil {
+			return fmt.Errorf("failed to list banned IPs: %w", err)
+		}
+		rs := rn.bans.retain(es)
+		s.Bans = make([]*ControlBan, 0, len(es))
+		for e, d := range es {
+			s.Bans = append(s.Bans, &ControlBan{Element: e, Remaining: d, Rule: rs[e]})
+		}
+		slices.SortFunc(s.Bans, func(a, b *ControlBan) int {
+			return strings.Compare(a.Element, b.Element)
+		})
+	case "ban":
+		if len(as) < 1 {
+			return errors.New("missing IP argument")
+		}
+		if len(as) < 2 {
+			return errors.New("missing duration argument")
+		}
+		if len(as) > 2 {
+			return errors.New("superfluous argument(s)")
+		}
+		n, p, err := parseElement(as[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse IP argument: %w", err)
+		}
+		d, err := parseDuration(as[1])
+		if err != nil {
+			return fmt.Errorf("failed to parse duration argument: %w", err)
+		}
+		e := portElement(n, p)
+		if err := rn.backend.ban(n, n.IP.To4() == nil, d, p); err != nil {
+			if errors.Is(err, errAlreadyBanned) {
+				return fmt.Errorf(`"%s" is already banned`, e)
+			}
+			return err
+		}
+		// Not banned by any rule
+		rn.bans.remove(e)
+		s.Elements = []string{e}
+		log.Info().Str("element", e).Dur("duration", d).Msg("banned IP via control socket")
+	case "unban":
+		if len(as) < 1 {
+			return errors.New("missing IP argument")
+		}
+		if len(as) > 1 {
+			return errors.New("superfluous argument(s)")
+		}
+		ip := net.ParseIP(as[0])
+		if ip == nil {
+			return fmt.Errorf(`invalid IP argument "%s"`, as[0])
+		}
+		ks, err := rn.liftBans(ip, ip.To4() == nil)
+		s.Elements = ks
+		if err != nil {
+			return err
+		}
+		if len(ks) > 0 {
+			log.Info().IPAddr("ip", ip).Strs("elements", ks).Msg("unbanned IP via control socket")
+		}
+	case "rules":
+		if len(as) > 0 {
+			return errors.New("superfluous argument(s)")
+		}
+		rs := rn.rules()
+		s.Rules = make([]*ControlRule, 0, len(rs))
+		for n, r := range rs {
+			s.Rules = append(s.Rules, &ControlRule{
+				Name:           n,
+				Lines:          r.counters.lines.Load(),
+				Matches:        r.counters.matches.Load(),
+				Actions:        r.counters.actions.Load(),
+				ActionFailures: r.counters.actionFailures.Load(),
+			})
+		}
+		slices.SortFunc(s.Rules, func(a, b *ControlRule) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+	default:
+		return fmt.Errorf(`unknown command "%s"`, q.Command)
+	}
+
+	return nil
+}
+
+// SendControlRequest sends a request to the control socket of a running
+// instance and returns its response. Errors reported by the instance are
+// returned as such.
+func SendControlRequest(path string, q *ControlRequest) (*ControlResponse, error) {
+	c, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err := json.NewEncoder(c).Encode(q); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	s := &ControlResponse{}
+	if err := json.NewDecoder(c).Decode(s); err != nil {
+		return nil, fmt.Errorf("failed to receive response: %w", err)
+	}
+	if s.Error != "" {
+		return s, errors.New(s.Error)
+	}
+
+	return s, nil
+}
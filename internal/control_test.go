@@ -0,0 +1,91 @@
+package gerberos
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestControl(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.configuration.ControlSocketPath = filepath.Join(t.TempDir(), "control.sock")
+	b := &testPortBackend{testBackend: testBackend{runner: rn}, banned: make(map[string]bool)}
+	rn.backend = b
+	r := newTestValidRule()
+	r.runner = rn
+	rn.configuration.Rules = map[string]*rule{"test": r}
+	r.counters.lines.Add(3)
+	r.counters.matches.Add(2)
+	r.counters.actions.Add(1)
+
+	um := unix.Umask(0022)
+	testNoError(t, rn.initializeControl())
+	defer rn.control.Close()
+	if m := unix.Umask(um); m != 0022 {
+		t.Errorf("expected umask to be restored, got %o", m)
+	}
+	fi, err := os.Stat(rn.configuration.ControlSocketPath)
+	testNoError(t, err)
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected permissions %s", fi.Mode())
+	}
+	go rn.serveControl()
+	send := func(c string, as ...string) (*ControlResponse, error) {
+		t.Helper()
+		return SendControlRequest(rn.configuration.ControlSocketPath, &ControlRequest{Command: c, Arguments: as})
+	}
+
+	// Banned by a rule and manually
+	a := &banAction{rule: r, duration: time.Hour}
+	testNoError(t, a.perform(&match{ip: net.ParseIP("192.0.2.1")}))
+	s, err := send("ban", "192.0.2.0/24", "1h")
+	testNoError(t, err)
+	if len(s.Elements) != 1 || s.Elements[0] != "192.0.2.0/24" {
+		t.Errorf("unexpected elements %v", s.Elements)
+	}
+	_, err = send("ban", "192.0.2.0/24", "1h")
+	testError(t, err)
+
+	s, err = send("list")
+	testNoError(t, err)
+	if len(s.Bans) != 2 || *s.Bans[0] != (ControlBan{Element: "192.0.2.0/24"}) || *s.Bans[1] != (ControlBan{Element: "192.0.2.1", Rule: "test"}) {
+		t.Errorf("unexpected bans %v", s.Bans)
+	}
+
+	s, err = send("status")
+	testNoError(t, err)
+	if s.Status.Rules != 1 || s.Status.Bans != 2 {
+		t.Errorf("unexpected status %v", s.Status)
+	}
+
+	s, err = send("rules")
+	testNoError(t, err)
+	if len(s.Rules) != 1 || *s.Rules[0] != (ControlRule{Name: "test", Lines: 3, Matches: 2, Actions: 1}) {
+		t.Errorf("unexpected rules %v", s.Rules)
+	}
+
+	s, err = send("unban", "192.0.2.1")
+	testNoError(t, err)
+	if len(s.Elements) != 2 || len(b.banned) != 0 {
+		t.Errorf("unexpected elements %v, remaining %v", s.Elements, b.banned)
+	}
+
+	for _, as := range [][]string{
+		{"unknown"},
+		{"status", "superfluous"},
+		{"ban", "192.0.2.1"},
+		{"ban", "invalid", "1h"},
+		{"ban", "192.0.2.1", "1hour"},
+		{"unban"},
+		{"unban", "192.0.2.0/24"},
+	} {
+		if _, err := send(as[0], as[1:]...); err == nil {
+			t.Errorf("expected error for %v", as)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package gerberos
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// cursor records how far a source has been read.
+type cursor struct {
+	// File sources
+	Device uint64 `json:",omitempty"`
+	Inode  uint64 `json:",omitempty"`
+	Offset int64  `json:",omitempty"`
+
+	// Journal sources
+	Journal string `json:",omitempty"`
+
+	// Kernel message sources
+	Boot     string `json:",omitempty"`
+	Sequence uint64 `json:",omitempty"`
+
+	// Last time the source was followed, absent in files of previous versions
+	Followed time.Time `json:",omitzero"`
+}
+
+type cursorStore struct {
+	path    string
+	mutex   sync.Mutex
+	saved   time.Time
+	cursors map[string]*cursor
+	// Names of the cursors of sources followed since loading
+	followed map[string]struct{}
+}
+
+type cursorStoreFile struct {
+	Saved   time.Time
+	Cursors map[string]*cursor
+}
+
+func (s *cursorStore) load() error {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	f := cursorStoreFile{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.saved = f.Saved
+	if f.Cursors != nil {
+		s.cursors = f.Cursors
+	}
+
+	return nil
+}
+
+func (s *cursorStore) save() error {
+	s.mutex.Lock()
+	n := time.Now()
+	for f := range s.followed {
+		if c, e := s.cursors[f]; e {
+			c.Followed = n
+		}
+	}
+	b, err := json.Marshal(cursorStoreFile{
+		Saved:   n,
+		Cursors: s.cursors,
+	})
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(s.path, b)
+}
+
+// get returns the cursor stored for a name if its source was followed within
+// the given look-back. Cursors of sources no longer followed, e.g. of removed
+// rules, thus expire even though the store is saved regularly. The source is
+// considered followed from now on.
+func (s *cursorStore) get(name string, lookBack time.Duration) *cursor {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.followed[name] = struct{}{}
+	c, e := s.cursors[name]
+	if !e {
+		return nil
+	}
+	f := c.Followed
+	if f.IsZero() {
+		f = s.saved
+	}
+	if time.Since(f) > lookBack {
+		return nil
+	}
+	cc := *c
+
+	return &cc
+}
+
+func (s *cursorStore) set(name string, c *cursor) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cc := *c
+	cc.Followed = time.Now()
+	s.cursors[name] = &cc
+	s.followed[name] = struct{}{}
+}
+
+func newCursorStore(path string) *cursorStore {
+	return &cursorStore{
+		path:     path,
+		cursors:  make(map[string]*cursor),
+		followed: make(map[string]struct{}),
+	}
+}
+
+func fileIdentity(fi os.FileInfo) (uint64, uint64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+
+	return uint64(st.Dev), st.Ino
+}
+
+// writeFileAtomically writes to a temporary file in the same directory and
+// renames it, so the file is never left partially written.
+func writeFileAtomically(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
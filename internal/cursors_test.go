@@ -0,0 +1,109 @@
+package gerberos
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCursorStorePersistence(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "cursors")
+	c := &cursor{Device: 1, Inode: 2, Offset: 3}
+
+	s := newCursorStore(p)
+	if s.get("test", time.Hour) != nil {
+		t.Error("unexpected cursor")
+	}
+	s.set("test", c)
+	testNoError(t, s.save())
+
+	s = newCursorStore(p)
+	testNoError(t, s.load())
+	g := s.get("test", time.Hour)
+	if g == nil || g.Followed.IsZero() {
+		t.Fatalf("expected cursor followed recently, got %v", g)
+	}
+	g.Followed = time.Time{}
+	if !reflect.DeepEqual(g, c) {
+		t.Errorf("expected cursor %v, got %v", c, g)
+	}
+	if s.get("unknown", time.Hour) != nil {
+		t.Error("unexpected cursor")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if s.get("test", time.Millisecond) != nil {
+		t.Error("unexpected cursor exceeding look-back")
+	}
+}
+
+func TestCursorStoreNotFollowed(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "cursors")
+	s := newCursorStore(p)
+	s.set("followed", &cursor{Offset: 1})
+	s.set("removed", &cursor{Offset: 2})
+	testNoError(t, s.save())
+
+	// Only the first one is followed after a restart, the store is still
+	// saved regularly
+	s = newCursorStore(p)
+	testNoError(t, s.load())
+	s.get("followed", time.Hour)
+	time.Sleep(200 * time.Millisecond)
+	testNoError(t, s.save())
+
+	s = newCursorStore(p)
+	testNoError(t, s.load())
+	if c := s.get("followed", 100*time.Millisecond); c == nil || c.Offset != 1 {
+		t.Errorf("unexpected cursor %v", c)
+	}
+	if c := s.get("removed", 100*time.Millisecond); c != nil {
+		t.Errorf("expected cursor of source no longer followed to expire, got %v", c)
+	}
+}
+
+func TestCursorStoreLoadInvalid(t *testing.T) {
+	s := newCursorStore("test/invalid_configuration.toml")
+	testError(t, s.load())
+	s = newCursorStore("test/unknown")
+	testError(t, s.load())
+}
+
+func TestRunnerSaveCursorsRegularly(t *testing.T) {
+	d := t.TempDir()
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.saveInterval = 10 * time.Millisecond
+	rn.cursors = newCursorStore(filepath.Join(d, "gerberos.save.cursors"))
+	rn.cursors.set("test", &cursor{Offset: 1})
+	done := make(chan bool)
+	go func() {
+		rn.saveRegularly()
+		done <- true
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	rn.stop()
+	<-done
+	s := newCursorStore(rn.cursors.path)
+	testNoError(t, s.load())
+	if c := s.get("test", time.Hour); c == nil || c.Offset != 1 {
+		t.Errorf("unexpected cursor %v", c)
+	}
+}
+
+func TestWriteFileAtomically(t *testing.T) {
+	d := t.TempDir()
+	p := filepath.Join(d, "file")
+	testNoError(t, writeFileAtomically(p, []byte("a")))
+	testNoError(t, writeFileAtomically(p, []byte("b")))
+	if b, err := os.ReadFile(p); err != nil || string(b) != "b" {
+		t.Errorf(`expected "b", got "%s"`, b)
+	}
+	// No temporary files are left behind
+	if es, err := os.ReadDir(d); err != nil || len(es) != 1 {
+		t.Errorf("unexpected files %v", es)
+	}
+	testError(t, writeFileAtomically(filepath.Join(d, "missing", "file"), nil))
+}
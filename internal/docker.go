@@ -0,0 +1,296 @@
+package gerberos
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	dockerDefaultSocketPath = "/var/run/docker.sock"
+	dockerInterval          = 2 * time.Second
+)
+
+type dockerContainer struct {
+	ID     string
+	Names  []string
+	Labels map[string]string
+}
+
+type dockerContainerDetails struct {
+	Name   string
+	Config struct {
+		Tty bool
+	}
+}
+
+// dockerSource follows the logs of containers selected by name or label using
+// the Docker Engine API, which is also provided by Podman. Containers are
+// looked up periodically, so restarted and recreated containers are followed
+// again without losing lines.
+type dockerSource struct {
+	sourceRule
+	socketPath string
+	names      []string
+	labels     []string
+	interval   time.Duration
+	client     *http.Client
+	// Time up to which the logs of a container (by name) have been read
+	since   map[string]time.Time
+	scanned bool
+}
+
+func (s *dockerSource) initialize(r *rule) error {
+	s.setRule(r)
+
+	s.socketPath = dockerDefaultSocketPath
+	s.names = make([]string, 0)
+	s.labels = make([]string, 0)
+	for _, p := range r.Source[1:] {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || v == "" {
+			return fmt.Errorf(`invalid parameter "%s"`, p)
+		}
+		switch k {
+		case "name":
+			s.names = append(s.names, strings.TrimPrefix(v, "/"))
+		case "label":
+			s.labels = append(s.labels, v)
+		case "socket":
+			s.socketPath = v
+		default:
+			return fmt.Errorf(`unknown parameter "%s"`, k)
+		}
+	}
+	if len(s.names) == 0 && len(s.labels) == 0 {
+		return errors.New("missing name or label parameter")
+	}
+
+	s.interval = dockerInterval
+	s.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", s.socketPath)
+			},
+		},
+	}
+	s.since = make(map[string]time.Time)
+
+	return nil
+}
+
+// selects reports whether a container is selected. Containers need to have
+// any of the names and all of the labels.
+func (s *dockerSource) selects(c *dockerContainer) bool {
+	if len(s.names) > 0 && !slices.ContainsFunc(c.Names, func(n string) bool {
+		return slices.Contains(s.names, strings.TrimPrefix(n, "/"))
+	}) {
+		return false
+	}
+
+	for _, l := range s.labels {
+		k, v, hv := strings.Cut(l, "=")
+		cv, e := c.Labels[k]
+		if !e || hv && cv != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *dockerSource) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf(`unexpected status "%s" for "%s": %s`, res.Status, path, strings.TrimSpace(string(b)))
+	}
+
+	return res, nil
+}
+
+func (s *dockerSource) getJSON(ctx context.Context, path string, v any) error {
+	res, err := s.get(ctx, path, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (s *dockerSource) containers(ctx context.Context) ([]*dockerContainer, error) {
+	cs := make([]*dockerContainer, 0)
+	if err := s.getJSON(ctx, "/containers/json", &cs); err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(cs, func(c *dockerContainer) bool {
+		return !s.selects(c)
+	}), nil
+}
+
+// demultiplexDockerStream copies the payloads of a stream multiplexing
+// standard output and standard error.
+func demultiplexDockerStream(w io.Writer, r io.Reader) error {
+	h := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, h); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(h[4:]))); err != nil {
+			return err
+		}
+	}
+}
+
+// follow reads the logs of a container until they end, returning the time up
+// to which they have been read.
+func (s *dockerSource) follow(ctx context.Context, id string, since time.Time, c chan *line) (time.Time, error) {
+	d := dockerContainerDetails{}
+	if err := s.getJSON(ctx, "/containers/"+id+"/json", &d); err != nil {
+		return since, err
+	}
+	n := strings.TrimPrefix(d.Name, "/")
+
+	q := url.Values{}
+	q.Set("follow", "1")
+	q.Set("stdout", "1")
+	q.Set("stderr", "1")
+	q.Set("timestamps", "1")
+	if !since.IsZero() {
+		q.Set("since", fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()))
+	}
+	res, err := s.get(ctx, "/containers/"+id+"/logs", q)
+	if err != nil {
+		return since, err
+	}
+	defer res.Body.Close()
+
+	var r io.Reader = res.Body
+	if !d.Config.Tty {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(demultiplexDockerStream(pw, res.Body))
+		}()
+		defer pr.Close()
+		r = pr
+	}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		// Each line is prefixed with its timestamp
+		ts, l, _ := strings.Cut(sc.Text(), " ")
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err == nil && !t.After(since) {
+			continue
+		}
+		select {
+		case c <- &line{text: l, origin: n}:
+		case <-ctx.Done():
+			return since, nil
+		}
+		if err == nil {
+			since = t
+		}
+	}
+	if err := sc.Err(); err != nil && ctx.Err() == nil {
+		return since, err
+	}
+
+	return since, nil
+}
+
+func (s *dockerSource) lines() (chan *line, error) {
+	c := make(chan *line, 1)
+	log.Info().Str("rule", s.rule().name).Str("socketPath", s.socketPath).Strs("names", s.names).Strs("labels", s.labels).Msg("following container logs")
+
+	ctx := s.rule().sharedSource.reading
+	go func() {
+		wg := &sync.WaitGroup{}
+		mutex := &sync.Mutex{}
+		following := make(map[string]bool)
+
+		tk := time.NewTicker(s.interval)
+		defer tk.Stop()
+		for {
+			cs, err := s.containers(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Warn().Str("rule", s.rule().name).Str("socketPath", s.socketPath).Err(err).Msg("failed to list containers")
+			}
+
+			for _, ct := range cs {
+				if len(ct.Names) == 0 {
+					continue
+				}
+				n := strings.TrimPrefix(ct.Names[0], "/")
+				mutex.Lock()
+				if following[ct.ID] {
+					mutex.Unlock()
+					continue
+				}
+				following[ct.ID] = true
+				since, e := s.since[n]
+				if !e && !s.scanned {
+					// Containers running at startup are followed from now on,
+					// containers appearing later on from their start
+					since = time.Now()
+				}
+				mutex.Unlock()
+
+				log.Info().Str("rule", s.rule().name).Str("container", n).Str("id", ct.ID).Msg("following container")
+				wg.Add(1)
+				go func(id, n string, since time.Time) {
+					defer wg.Done()
+					since, err := s.follow(ctx, id, since, c)
+					if err != nil {
+						log.Warn().Str("rule", s.rule().name).Str("container", n).Err(err).Msg("failed to follow container")
+					}
+					mutex.Lock()
+					delete(following, id)
+					s.since[n] = since
+					mutex.Unlock()
+				}(ct.ID, n, since)
+			}
+			if err == nil {
+				s.scanned = true
+			}
+
+			select {
+			case <-ctx.Done():
+				wg.Wait()
+				close(c)
+				return
+			case <-tk.C:
+			}
+		}
+	}()
+
+	return c, nil
+}
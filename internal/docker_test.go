@@ -0,0 +1,163 @@
+package gerberos
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testDockerDaemon struct {
+	mutex      sync.Mutex
+	containers []string // JSON of running containers
+	logs       map[string][]string
+	tty        bool
+	since      []string
+}
+
+func (d *testDockerDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch {
+	case r.URL.Path == "/containers/json":
+		fmt.Fprintf(w, "[%s]", strings.Join(d.containers, ","))
+	case strings.HasSuffix(r.URL.Path, "/json"):
+		fmt.Fprintf(w, `{"Name":"/web","Config":{"Tty":%t}}`, d.tty)
+	case strings.HasSuffix(r.URL.Path, "/logs"):
+		d.since = append(d.since, r.URL.Query().Get("since"))
+		id := strings.Split(r.URL.Path, "/")[2]
+		b := &bytes.Buffer{}
+		for _, l := range d.logs[id] {
+			p := []byte(l + "\n")
+			if !d.tty {
+				h := make([]byte, 8)
+				h[0] = 1
+				binary.BigEndian.PutUint32(h[4:], uint32(len(p)))
+				b.Write(h)
+			}
+			b.Write(p)
+		}
+		w.Write(b.Bytes())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestDockerSource(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", p)
+	testNoError(t, err)
+	d := &testDockerDaemon{
+		containers: []string{
+			`{"Id":"a","Names":["/web"],"Labels":{"app":"nginx"}}`,
+			`{"Id":"b","Names":["/db"],"Labels":{"app":"nginx"}}`,
+			`{"Id":"c","Names":["/web2"],"Labels":{"app":"other"}}`,
+		},
+		logs: map[string][]string{
+			"a": {"2000-01-01T00:00:00Z too old", "2100-01-01T00:00:00Z first"},
+		},
+	}
+	srv := httptest.NewUnstartedServer(d)
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	r := newTestValidRule()
+	r.Source = []string{"docker", "socket=" + p, "name=web", "name=/db", "label=app=nginx", "label=app"}
+	testNoError(t, r.initialize(rn))
+	s := r.source.(*dockerSource)
+	s.interval = 10 * time.Millisecond
+	c, err := s.lines()
+	testNoError(t, err)
+
+	ex := func(text string) {
+		t.Helper()
+		select {
+		case l := <-c:
+			if l.text != text || l.origin != "web" {
+				t.Errorf(`expected line "%s" from "web", got "%s" from "%s"`, text, l.text, l.origin)
+			}
+		case <-time.After(time.Second):
+			t.Error("expected line")
+		}
+	}
+
+	ex("first")
+
+	// Recreated container using a TTY
+	d.mutex.Lock()
+	d.tty = true
+	d.containers = []string{`{"Id":"d","Names":["/web"],"Labels":{"app":"nginx"}}`}
+	d.logs["d"] = []string{"2100-01-01T00:00:00Z first", "2100-01-01T00:00:01Z second"}
+	d.mutex.Unlock()
+	ex("second")
+
+	rn.stop()
+	for range c {
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !slices.Contains(d.since, "4102444800.000000000") {
+		t.Errorf("unexpected since parameters %q", d.since)
+	}
+}
+
+func TestDockerSourceFollowStopped(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", p)
+	testNoError(t, err)
+	d := &testDockerDaemon{
+		logs: map[string][]string{
+			"a": {"2100-01-01T00:00:00Z first", "2100-01-01T00:00:01Z second"},
+		},
+	}
+	srv := httptest.NewUnstartedServer(d)
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	r := newTestValidRule()
+	r.Source = []string{"docker", "socket=" + p, "name=web"}
+	testNoError(t, r.initialize(rn))
+	s := r.source.(*dockerSource)
+
+	// Lines are never read
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan time.Time)
+	go func() {
+		since, err := s.follow(ctx, "a", time.Time{}, make(chan *line))
+		testNoError(t, err)
+		done <- since
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case since := <-done:
+		if !since.IsZero() {
+			t.Errorf("expected undelivered line not to advance, got %s", since)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected following to stop")
+	}
+}
+
+func TestDockerDemultiplexFaulty(t *testing.T) {
+	b := &bytes.Buffer{}
+	testError(t, demultiplexDockerStream(b, strings.NewReader("\x01\x00\x00\x00\x00\x00\x00\x05abc")))
+	testError(t, demultiplexDockerStream(b, strings.NewReader("\x01\x00")))
+}
@@ -0,0 +1,154 @@
+package gerberos
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// savedElement is a banned IP or subnet as saved by the netlink backends.
+type savedElement struct {
+	Element string
+	// Zero if permanent
+	Expires time.Time `json:",omitzero"`
+}
+
+type savedElementsFile struct {
+	Elements []*savedElement
+}
+
+// parseElement parses a single IP or a subnet in CIDR notation, optionally
+// followed by a port like "1.2.3.4,tcp:22".
+func parseElement(s string) (*net.IPNet, *port, error) {
+	var p *port
+	if e, ps, ok := strings.Cut(s, ","); ok {
+		pp, err := parsePort(ps)
+		if err != nil {
+			return nil, nil, err
+		}
+		s, p = e, pp
+	}
+
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, p, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		return hostNet(ip), p, nil
+	}
+
+	return nil, nil, fmt.Errorf(`invalid element "%s"`, s)
+}
+
+// saveElements saves banned IPs and subnets with their remaining durations.
+func saveElements(path string, es map[string]time.Duration) error {
+	n := time.Now()
+	f := savedElementsFile{Elements: make([]*savedElement, 0, len(es))}
+	for e, d := range es {
+		se := &savedElement{Element: e}
+		if d > 0 {
+			se.Expires = n.Add(d)
+		}
+		f.Elements = append(f.Elements, se)
+	}
+	slices.SortFunc(f.Elements, func(a, b *savedElement) int {
+		return strings.Compare(a.Element, b.Element)
+	})
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(path, b)
+}
+
+func loadElements(path string) ([]*savedElement, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := savedElementsFile{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	return f.Elements, nil
+}
+
+// saveFileFormat guesses the format of a save file from its first line:
+// "ipset" (ipset save), "nft" (nft list set) or "json" (netlink backends).
+// Empty files have no format.
+func saveFileFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return "", sc.Err()
+	}
+	l := strings.TrimSpace(sc.Text())
+	switch {
+	case strings.HasPrefix(l, "{"):
+		return "json", nil
+	case strings.HasPrefix(l, "create ") || strings.HasPrefix(l, "add "):
+		return "ipset", nil
+	case strings.HasPrefix(l, "table "):
+		return "nft", nil
+	}
+
+	return "unknown", nil
+}
+
+// checkSaveFile returns an error if the save file has been written in a
+// different format, usually by another backend.
+func checkSaveFile(path string, format string) error {
+	f, err := saveFileFormat(path)
+	if err != nil {
+		return err
+	}
+	if f != "" && f != format {
+		return fmt.Errorf(`save file "%s" is in %s format instead of %s format, probably written by another backend`, path, f, format)
+	}
+
+	return nil
+}
+
+// restoreElements bans the saved IPs and subnets which have not expired yet.
+func restoreElements(path string, ban func(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error) error {
+	if err := checkSaveFile(path, "json"); err != nil {
+		return err
+	}
+	ses, err := loadElements(path)
+	if err != nil {
+		return err
+	}
+
+	for _, se := range ses {
+		n, p, err := parseElement(se.Element)
+		if err != nil {
+			return err
+		}
+		var d time.Duration
+		if !se.Expires.IsZero() {
+			d = time.Until(se.Expires)
+			if d < time.Second {
+				continue
+			}
+		}
+		if err := ban(n, n.IP.To4() == nil, d, p); err != nil && !errors.Is(err, errAlreadyBanned) {
+			return fmt.Errorf(`failed to restore element "%s": %w`, se.Element, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package gerberos
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	firewallDefaultName = "gerberos"
+	firewallDefaultHook = "input"
+	// Longest name for which all ipset and iptables chain names stay valid
+	firewallMaxNameLength = 26
+	// Longest prefix accepted by iptables
+	firewallMaxLogPrefixLength = 29
+)
+
+var (
+	firewallNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	// Hooks supported by the ipset and nft backends, respectively
+	ipsetHooks = []string{"input", "forward", "docker-user"}
+	nftHooks   = []string{"input", "forward", "prerouting"}
+
+	// Hooks known, but not supported by any backend, with the reasons
+	firewallUnsupportedHooks = map[string]string{
+		// Chains of the netdev family cannot refer to the sets of the ip and
+		// ip6 tables
+		"ingress": "netdev chains are bound to devices and cannot use the sets of gerberos, use prerouting with a priority of -300 instead",
+	}
+)
+
+// firewallRejectType names an ICMP type for IPv4 and IPv6 in the notations of
+// iptables and nft.
+type firewallRejectType struct {
+	iptables, ip6tables string
+	nft, nft6           string
+	code, code6         uint8
+}
+
+var firewallRejectTypes = map[string]*firewallRejectType{
+	"port-unreachable": {"icmp-port-unreachable", "icmp6-port-unreachable", "port-unreachable", "port-unreachable", 3, 4},
+	"host-unreachable": {"icmp-host-unreachable", "icmp6-addr-unreachable", "host-unreachable", "addr-unreachable", 1, 3},
+	"admin-prohibited": {"icmp-admin-prohibited", "icmp6-adm-prohibited", "admin-prohibited", "admin-prohibited", 13, 1},
+}
+
+// firewall configures the objects managed by the ipset and nft backends.
+type firewall struct {
+	Name     string
+	Hooks    []string
+	Priority int32
+	Verdict  []string
+
+	verdict    string
+	rejectType string
+	logPrefix  string
+}
+
+// initialize validates the configuration and fills in defaults. The default
+// verdict differs between backends.
+func (f *firewall) initialize(hooks []string, verdict string) error {
+	if f.Name == "" {
+		f.Name = firewallDefaultName
+	}
+	if !firewallNameRegexp.MatchString(f.Name) || len(f.Name) > firewallMaxNameLength {
+		return fmt.Errorf(`invalid name "%s": must consist of at most %d letters, digits, "_" or "-"`, f.Name, firewallMaxNameLength)
+	}
+
+	if len(f.Hooks) == 0 {
+		f.Hooks = []string{firewallDefaultHook}
+	}
+	for i, h := range f.Hooks {
+		if r, ok := firewallUnsupportedHooks[h]; ok {
+			return fmt.Errorf(`hook "%s" is not supported: %s`, h, r)
+		}
+		if !slices.Contains(hooks, h) {
+			return fmt.Errorf(`unsupported hook "%s": choice of %s`, h, strings.Join(hooks, ", "))
+		}
+		if slices.Contains(f.Hooks[:i], h) {
+			return fmt.Errorf(`duplicate hook "%s"`, h)
+		}
+	}
+
+	if len(f.Verdict) == 0 {
+		f.Verdict = []string{verdict}
+	}
+	f.verdict = f.Verdict[0]
+	switch f.verdict {
+	case "drop":
+		if len(f.Verdict) > 1 {
+			return errors.New("superfluous verdict parameter(s)")
+		}
+	case "reject":
+		if len(f.Verdict) > 2 {
+			return errors.New("superfluous verdict parameter(s)")
+		}
+		if len(f.Verdict) == 2 {
+			f.rejectType = f.Verdict[1]
+			if _, ok := firewallRejectTypes[f.rejectType]; !ok {
+				return fmt.Errorf(`unknown reject type "%s"`, f.rejectType)
+			}
+		}
+		if slices.Contains(f.Hooks, "prerouting") {
+			return errors.New("reject verdict must not be used with the prerouting hook")
+		}
+	case "log":
+		if len(f.Verdict) > 2 {
+			return errors.New("superfluous verdict parameter(s)")
+		}
+		f.logPrefix = f.Name + ": "
+		if len(f.Verdict) == 2 {
+			f.logPrefix = f.Verdict[1]
+		}
+		if len(f.logPrefix) > firewallMaxLogPrefixLength || strings.ContainsAny(f.logPrefix, "\"\n") {
+			return fmt.Errorf(`invalid log prefix "%s": must consist of at most %d characters excluding quotes and line breaks`, f.logPrefix, firewallMaxLogPrefixLength)
+		}
+	default:
+		return fmt.Errorf(`unknown verdict "%s"`, f.verdict)
+	}
+
+	return nil
+}
+
+// reject returns the reject type, defaulting to port unreachable.
+func (f *firewall) reject() *firewallRejectType {
+	if t, ok := firewallRejectTypes[f.rejectType]; ok {
+		return t
+	}
+
+	return firewallRejectTypes["port-unreachable"]
+}
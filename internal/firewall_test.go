@@ -0,0 +1,47 @@
+package gerberos
+
+import (
+	"testing"
+)
+
+func TestFirewallInitialize(t *testing.T) {
+	f := &firewall{}
+	testNoError(t, f.initialize(nftHooks, "reject"))
+	if f.Name != "gerberos" || len(f.Hooks) != 1 || f.Hooks[0] != "input" || f.verdict != "reject" || f.rejectType != "" {
+		t.Errorf("unexpected defaults: %+v", f)
+	}
+	if f.reject().code != 3 || f.reject().code6 != 4 {
+		t.Errorf("expected port unreachable by default, got %+v", f.reject())
+	}
+
+	f = &firewall{Name: "test", Hooks: []string{"forward", "docker-user"}, Verdict: []string{"log"}}
+	testNoError(t, f.initialize(ipsetHooks, "drop"))
+	if f.logPrefix != "test: " {
+		t.Errorf(`expected log prefix "test: ", got "%s"`, f.logPrefix)
+	}
+
+	f = &firewall{Verdict: []string{"reject", "admin-prohibited"}}
+	testNoError(t, f.initialize(ipsetHooks, "drop"))
+	if f.reject().ip6tables != "icmp6-adm-prohibited" {
+		t.Errorf("unexpected reject type: %+v", f.reject())
+	}
+
+	fi := func(f *firewall, hooks []string) {
+		t.Helper()
+		testError(t, f.initialize(hooks, "drop"))
+	}
+	fi(&firewall{Name: "in valid"}, nftHooks)
+	fi(&firewall{Name: "abcdefghijklmnopqrstuvwxyz0"}, nftHooks)
+	fi(&firewall{Hooks: []string{"docker-user"}}, nftHooks)
+	fi(&firewall{Hooks: []string{"prerouting"}}, ipsetHooks)
+	fi(&firewall{Hooks: []string{"input", "input"}}, nftHooks)
+	fi(&firewall{Hooks: []string{"ingress"}}, nftHooks)
+	fi(&firewall{Hooks: []string{"prerouting"}, Verdict: []string{"reject"}}, nftHooks)
+	fi(&firewall{Verdict: []string{"unknown"}}, nftHooks)
+	fi(&firewall{Verdict: []string{"drop", "x"}}, nftHooks)
+	fi(&firewall{Verdict: []string{"reject", "unknown"}}, nftHooks)
+	fi(&firewall{Verdict: []string{"reject", "host-unreachable", "x"}}, nftHooks)
+	fi(&firewall{Verdict: []string{"log", "a", "b"}}, nftHooks)
+	fi(&firewall{Verdict: []string{"log", "abcdefghijklmnopqrstuvwxyz0123"}}, nftHooks)
+	fi(&firewall{Verdict: []string{"log", `"`}}, nftHooks)
+}
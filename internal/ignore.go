@@ -0,0 +1,177 @@
+package gerberos
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const ignoreFilePrefix = "file:"
+
+// parseIgnoreEntry parses an IP or a CIDR.
+func parseIgnoreEntry(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf(`invalid CIDR "%s"`, s)
+		}
+		return n, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf(`invalid IP "%s"`, s)
+	}
+
+	return hostNet(ip), nil
+}
+
+// ignoreFile holds the entries of a file listing one IP or CIDR per line.
+// Empty lines and comments starting with "#" are skipped. The file is
+// reloaded whenever its modification time or size changes, which is checked
+// on every lookup.
+type ignoreFile struct {
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	nets    []*net.IPNet
+	// Last error, logged once
+	err string
+}
+
+func (f *ignoreFile) load() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return nil
+	}
+
+	fh, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	ns := make([]*net.IPNet, 0)
+	sc := bufio.NewScanner(fh)
+	for i := 1; sc.Scan(); i++ {
+		l, _, _ := strings.Cut(sc.Text(), "#")
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		n, err := parseIgnoreEntry(l)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i, err)
+		}
+		ns = append(ns, n)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	f.nets = ns
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+
+	return nil
+}
+
+// any reports whether any entry satisfies the predicate.
+func (f *ignoreFile) any(p func(n *net.IPNet) bool) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.load(); err != nil {
+		// Previous entries are kept
+		if err.Error() != f.err {
+			log.Warn().Str("path", f.path).Err(err).Msg("failed to reload ignore file")
+			f.err = err.Error()
+		}
+	} else {
+		f.err = ""
+	}
+
+	for _, n := range f.nets {
+		if p(n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ignoreList holds IPs and CIDRs which are never acted upon.
+type ignoreList struct {
+	nets  []*net.IPNet
+	files []*ignoreFile
+}
+
+func (l *ignoreList) any(p func(n *net.IPNet) bool) bool {
+	if l == nil {
+		return false
+	}
+
+	for _, n := range l.nets {
+		if p(n) {
+			return true
+		}
+	}
+
+	for _, f := range l.files {
+		if f.any(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *ignoreList) contains(ip net.IP) bool {
+	return l.any(func(n *net.IPNet) bool {
+		return n.Contains(ip)
+	})
+}
+
+// overlaps reports whether any entry overlaps with a network.
+func (l *ignoreList) overlaps(o *net.IPNet) bool {
+	return l.any(func(n *net.IPNet) bool {
+		return n.Contains(o.IP) || o.Contains(n.IP)
+	})
+}
+
+// newIgnoreList parses IPs, CIDRs and files prefixed by "file:".
+func newIgnoreList(es []string) (*ignoreList, error) {
+	l := &ignoreList{
+		nets:  make([]*net.IPNet, 0),
+		files: make([]*ignoreFile, 0),
+	}
+
+	for _, e := range es {
+		if p, ok := strings.CutPrefix(e, ignoreFilePrefix); ok {
+			f := &ignoreFile{path: p}
+			if err := f.load(); err != nil {
+				return nil, fmt.Errorf(`failed to load file "%s": %w`, p, err)
+			}
+			l.files = append(l.files, f)
+			continue
+		}
+
+		n, err := parseIgnoreEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		l.nets = append(l.nets, n)
+	}
+
+	return l, nil
+}
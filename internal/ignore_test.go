@@ -0,0 +1,87 @@
+package gerberos
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIgnoreList(t *testing.T) {
+	l, err := newIgnoreList([]string{"127.0.0.1", "10.0.0.0/8", "::1", "2001:db8::/32"})
+	testNoError(t, err)
+
+	ti := func(h string, e bool) {
+		t.Helper()
+		if l.contains(net.ParseIP(h)) != e {
+			t.Errorf(`unexpected result for "%s"`, h)
+		}
+	}
+
+	ti("127.0.0.1", true)
+	ti("127.0.0.2", false)
+	ti("10.1.2.3", true)
+	ti("11.1.2.3", false)
+	ti("::1", true)
+	ti("::2", false)
+	ti("2001:db8::1", true)
+	ti("2001:db9::1", false)
+	ti("::ffff:10.1.2.3", true)
+
+	to := func(c string, e bool) {
+		t.Helper()
+		_, n, err := net.ParseCIDR(c)
+		testNoError(t, err)
+		if l.overlaps(n) != e {
+			t.Errorf(`unexpected overlap result for "%s"`, c)
+		}
+	}
+
+	to("127.0.0.0/24", true)
+	to("10.1.0.0/16", true)
+	to("0.0.0.0/0", true)
+	to("192.168.0.0/16", false)
+	to("2001:db8:1::/48", true)
+	to("2001:db9::/64", false)
+
+	var nl *ignoreList
+	if nl.contains(net.ParseIP("127.0.0.1")) {
+		t.Error("expected nil list to be empty")
+	}
+
+	for _, e := range []string{"", "1.2.3", "1.2.3.4/33", "::1/129", "file:test/unknown"} {
+		_, err := newIgnoreList([]string{e})
+		testError(t, err)
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "ignore")
+	testNoError(t, os.WriteFile(p, []byte("# Office\n192.0.2.0/24 # VPN\n\n  2001:db8::1\n"), 0o600))
+
+	l, err := newIgnoreList([]string{"file:" + p})
+	testNoError(t, err)
+
+	if !l.contains(net.ParseIP("192.0.2.10")) || !l.contains(net.ParseIP("2001:db8::1")) {
+		t.Error("expected entries of file to be ignored")
+	}
+
+	// Reloaded once changed
+	testNoError(t, os.WriteFile(p, []byte("198.51.100.1\n"), 0o600))
+	testNoError(t, os.Chtimes(p, time.Now(), time.Now().Add(time.Minute)))
+	if l.contains(net.ParseIP("192.0.2.10")) || !l.contains(net.ParseIP("198.51.100.1")) {
+		t.Error("expected file to be reloaded")
+	}
+
+	// Previous entries are kept if reloading fails
+	testNoError(t, os.WriteFile(p, []byte("invalid\n"), 0o600))
+	testNoError(t, os.Chtimes(p, time.Now(), time.Now().Add(2*time.Minute)))
+	if !l.contains(net.ParseIP("198.51.100.1")) {
+		t.Error("expected previous entries to be kept")
+	}
+
+	testNoError(t, os.WriteFile(p, []byte("invalid\n"), 0o600))
+	_, err = newIgnoreList([]string{"file:" + p})
+	testError(t, err)
+}
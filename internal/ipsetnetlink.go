@@ -0,0 +1,396 @@
+package gerberos
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// See include/uapi/linux/netfilter/ipset/ip_set.h
+const (
+	// Oldest protocol version supported by current kernels
+	ipsetProtocol = 6
+
+	ipsetCmdCreate  = 2
+	ipsetCmdDestroy = 3
+	ipsetCmdList    = 7
+	ipsetCmdAdd     = 9
+	ipsetCmdDel     = 10
+
+	ipsetAttrProtocol = 1
+	ipsetAttrSetName  = 2
+	ipsetAttrTypeName = 3
+	ipsetAttrRevision = 4
+	ipsetAttrFamily   = 5
+	ipsetAttrData     = 7
+	ipsetAttrADT      = 8
+
+	ipsetAttrIP      = 1
+	ipsetAttrCIDR    = 3
+	ipsetAttrPort    = 4
+	ipsetAttrTimeout = 6
+	ipsetAttrProto   = 7
+
+	ipsetAttrIPAddrIPv4 = 1
+	ipsetAttrIPAddrIPv6 = 2
+
+	// Also reported when deleting missing elements
+	ipsetErrExist = 4103
+)
+
+// ipsetErrors describes the errors specific to ipset. Other errors are
+// regular errnos.
+var ipsetErrors = map[syscall.Errno]string{
+	4096: "ipset: private error",
+	4097: "ipset: protocol error",
+	4098: "ipset: set type not supported",
+	4099: "ipset: maximum number of sets reached",
+	4100: "ipset: set is in use",
+	4102: "ipset: set type mismatch",
+	4103: "ipset: element already exists",
+	4104: "ipset: invalid CIDR",
+	4106: "ipset: invalid family",
+	4107: "ipset: timeout not supported by set",
+	4108: "ipset: set is referenced",
+}
+
+func ipsetError(err error) error {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if s, ok := ipsetErrors[errno]; ok {
+			return errors.New(s)
+		}
+	}
+
+	return err
+}
+
+// ipsetNetlinkBackend manages ipsets through netlink instead of the ipset
+// binary. The ip(6)tables entries are still managed by running iptables and
+// ip6tables.
+type ipsetNetlinkBackend struct {
+	ipsetBackend
+	mutex sync.Mutex
+	conn  *netlinkConn
+}
+
+func (b *ipsetNetlinkBackend) message(cmd uint16, family uint8, name string, as ...[]byte) *netlinkMessage {
+	return &netlinkMessage{
+		typ: unix.NFNL_SUBSYS_IPSET<<8 | cmd,
+		// Creating and adding fails for existing sets and elements
+		flags:  unix.NLM_F_EXCL,
+		family: family,
+		data: netlinkConcat(append([][]byte{
+			netlinkAttr(ipsetAttrProtocol, []byte{ipsetProtocol}),
+			netlinkAttrString(ipsetAttrSetName, name),
+		}, as...)...),
+	}
+}
+
+type ipsetNetlinkSet struct {
+	name   string
+	family uint8
+	typ    string
+}
+
+func (b *ipsetNetlinkBackend) sets() []ipsetNetlinkSet {
+	return []ipsetNetlinkSet{
+		{b.ipset4Name, unix.NFPROTO_IPV4, "hash:ip"},
+		{b.ipset6Name, unix.NFPROTO_IPV6, "hash:ip"},
+		{b.ipset4NetName, unix.NFPROTO_IPV4, "hash:net"},
+		{b.ipset6NetName, unix.NFPROTO_IPV6, "hash:net"},
+		{b.ipset4PortName, unix.NFPROTO_IPV4, "hash:ip,port"},
+		{b.ipset6PortName, unix.NFPROTO_IPV6, "hash:ip,port"},
+	}
+}
+
+func (b *ipsetNetlinkBackend) destroyIpsets() error {
+	for _, s := range b.sets() {
+		err := b.conn.execute([]*netlinkMessage{b.message(ipsetCmdDestroy, s.family, s.name)}, false)
+		if err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf(`failed to destroy ipset "%s": %w`, s.name, ipsetError(err))
+		}
+	}
+
+	return nil
+}
+
+func (b *ipsetNetlinkBackend) createIpsets() error {
+	for _, s := range b.sets() {
+		err := b.conn.execute([]*netlinkMessage{b.message(ipsetCmdCreate, s.family, s.name,
+			netlinkAttrString(ipsetAttrTypeName, s.typ),
+			netlinkAttr(ipsetAttrRevision, []byte{0}),
+			netlinkAttr(ipsetAttrFamily, []byte{s.family}),
+			netlinkAttrNested(ipsetAttrData,
+				// Enables timeouts, elements are permanent by default
+				netlinkAttrU32(ipsetAttrTimeout|unix.NLA_F_NET_BYTEORDER, 0),
+			),
+		)}, false)
+		if err != nil {
+			return fmt.Errorf(`failed to create ipset "%s": %w`, s.name, ipsetError(err))
+		}
+	}
+
+	return nil
+}
+
+func (b *ipsetNetlinkBackend) initialize() error {
+	if err := b.initializeFirewall(); err != nil {
+		return err
+	}
+
+	if err := b.checkIptables(); err != nil {
+		return err
+	}
+
+	c, err := newNetlinkConn()
+	if err != nil {
+		return err
+	}
+	c.name, c.observe = "ipset", b.runner.observeDuration
+	b.conn = c
+
+	// Initialize ipsets and ip(6)tables entries
+	if err := b.deleteIptablesEntries(); err != nil {
+		b.conn.close()
+		return fmt.Errorf("failed to delete ip(6)tables entries: %w", err)
+	}
+	if err := b.destroyIpsets(); err != nil {
+		b.conn.close()
+		if errors.Is(err, unix.EPERM) {
+			return fmt.Errorf("ipset: insufficient privileges: %w", err)
+		}
+		return fmt.Errorf("failed to delete ipsets: %w", err)
+	}
+	if err := b.createIpsets(); err != nil {
+		b.conn.close()
+		return fmt.Errorf("failed to create ipsets: %w", err)
+	}
+	if b.runner.configuration.SaveFilePath != "" {
+		if err := restoreElements(b.runner.configuration.SaveFilePath, b.ban); err != nil {
+			log.Warn().Str("saveFilePath", b.runner.configuration.SaveFilePath).Err(err).Msg("failed to restore ipsets")
+		} else {
+			log.Info().Str("saveFilePath", b.runner.configuration.SaveFilePath).Msg("restored ipsets")
+		}
+	} else {
+		log.Warn().Msg("not persisting ipsets")
+	}
+	if err := b.createIptablesEntries(); err != nil {
+		b.conn.close()
+		return fmt.Errorf("failed to create ip(6)tables entries: %w", err)
+	}
+
+	return nil
+}
+
+// element returns the set, family and data attributes of an element.
+func (b *ipsetNetlinkBackend) element(n *net.IPNet, ipv6 bool, p *port) (string, uint8, [][]byte) {
+	s := b.ipset4Name
+	family := uint8(unix.NFPROTO_IPV4)
+	ip := netlinkAttr(ipsetAttrIPAddrIPv4|unix.NLA_F_NET_BYTEORDER, n.IP.To4())
+	if ipv6 {
+		s = b.ipset6Name
+		family = unix.NFPROTO_IPV6
+		ip = netlinkAttr(ipsetAttrIPAddrIPv6|unix.NLA_F_NET_BYTEORDER, n.IP.To16())
+	}
+	as := [][]byte{
+		netlinkAttrNested(ipsetAttrIP, ip),
+	}
+	if !isHostNet(n) {
+		s = b.ipset4NetName
+		if ipv6 {
+			s = b.ipset6NetName
+		}
+		o, _ := n.Mask.Size()
+		as = append(as, netlinkAttr(ipsetAttrCIDR, []byte{uint8(o)}))
+	}
+	if p != nil {
+		s = b.ipset4PortName
+		if ipv6 {
+			s = b.ipset6PortName
+		}
+		as = append(as,
+			netlinkAttr(ipsetAttrPort|unix.NLA_F_NET_BYTEORDER, binary.BigEndian.AppendUint16(nil, p.number)),
+			netlinkAttr(ipsetAttrProto, []byte{portProtocols[p.protocol]}),
+		)
+	}
+
+	return s, family, as
+}
+
+func (b *ipsetNetlinkBackend) ban(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, family, as := b.element(n, ipv6, p)
+	// Zero is permanent
+	as = append(as, netlinkAttrU32(ipsetAttrTimeout|unix.NLA_F_NET_BYTEORDER, uint32(min(int64(d.Seconds()), math.MaxUint32))))
+
+	// Adding fails if the element is present. This makes testing and adding a
+	// single atomic operation.
+	err := b.conn.execute([]*netlinkMessage{b.message(ipsetCmdAdd, family, s, netlinkAttrNested(ipsetAttrData, as...))}, false)
+	if errors.Is(err, syscall.Errno(ipsetErrExist)) {
+		return errAlreadyBanned
+	}
+
+	return ipsetError(err)
+}
+
+func (b *ipsetNetlinkBackend) unban(n *net.IPNet, ipv6 bool, p *port) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, family, as := b.element(n, ipv6, p)
+	err := b.conn.execute([]*netlinkMessage{b.message(ipsetCmdDel, family, s, netlinkAttrNested(ipsetAttrData, as...))}, false)
+	if errors.Is(err, syscall.Errno(ipsetErrExist)) {
+		return errNotBanned
+	}
+
+	return ipsetError(err)
+}
+
+func (b *ipsetNetlinkBackend) list() (map[string]time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.elements()
+}
+
+// elements returns all banned IPs and subnets along with their remaining
+// durations (zero if permanent).
+func (b *ipsetNetlinkBackend) elements() (map[string]time.Duration, error) {
+	es := make(map[string]time.Duration)
+	for _, s := range b.sets() {
+		ps, err := b.conn.dump(b.message(ipsetCmdList, s.family, s.name))
+		if err != nil {
+			return nil, fmt.Errorf(`failed to list ipset "%s": %w`, s.name, ipsetError(err))
+		}
+		if err := parseIpsetElements(ps, es); err != nil {
+			return nil, fmt.Errorf(`failed to parse ipset "%s": %w`, s.name, err)
+		}
+	}
+
+	return es, nil
+}
+
+func parseIpsetElements(ps [][]byte, es map[string]time.Duration) error {
+	for _, p := range ps {
+		as, err := parseNetlinkAttributes(p)
+		if err != nil {
+			return err
+		}
+		for _, a := range as {
+			if a.typ != ipsetAttrADT {
+				continue
+			}
+			ds, err := parseNetlinkAttributes(a.data)
+			if err != nil {
+				return err
+			}
+			for _, d := range ds {
+				n, p, t, err := parseIpsetElement(d.data)
+				if err != nil {
+					return err
+				}
+				es[portElement(n, p)] = t
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseIpsetElement(b []byte) (*net.IPNet, *port, time.Duration, error) {
+	as, err := parseNetlinkAttributes(b)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var ip net.IP
+	var t time.Duration
+	var pn uint16
+	var pr uint8
+	o := -1
+	for _, a := range as {
+		switch a.typ {
+		case ipsetAttrIP:
+			is, err := parseNetlinkAttributes(a.data)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			for _, i := range is {
+				if i.typ == ipsetAttrIPAddrIPv4 || i.typ == ipsetAttrIPAddrIPv6 {
+					ip = net.IP(i.data)
+				}
+			}
+		case ipsetAttrCIDR:
+			if len(a.data) == 1 {
+				o = int(a.data[0])
+			}
+		case ipsetAttrPort:
+			if len(a.data) == 2 {
+				pn = binary.BigEndian.Uint16(a.data)
+			}
+		case ipsetAttrProto:
+			if len(a.data) == 1 {
+				pr = a.data[0]
+			}
+		case ipsetAttrTimeout:
+			if len(a.data) == 4 {
+				t = time.Duration(binary.BigEndian.Uint32(a.data)) * time.Second
+			}
+		}
+	}
+	if ip == nil {
+		return nil, nil, 0, errors.New("missing IP")
+	}
+
+	var p *port
+	if pn != 0 {
+		pp, err := protocolPort(pr, pn)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		p = pp
+	}
+
+	n := hostNet(ip)
+	if o >= 0 {
+		_, bs := n.Mask.Size()
+		n.Mask = net.CIDRMask(o, bs)
+	}
+
+	return n, p, t, nil
+}
+
+func (b *ipsetNetlinkBackend) finalize() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	defer b.conn.close()
+
+	if b.runner.configuration.SaveFilePath != "" {
+		es, err := b.elements()
+		if err == nil {
+			err = saveElements(b.runner.configuration.SaveFilePath, es)
+		}
+		if err != nil {
+			return fmt.Errorf(`failed to save ipsets to "%s": %w`, b.runner.configuration.SaveFilePath, err)
+		}
+	}
+	if err := b.deleteIptablesEntries(); err != nil {
+		return fmt.Errorf("failed to delete ip(6)tables entries: %w", err)
+	}
+	if err := b.destroyIpsets(); err != nil {
+		return fmt.Errorf("failed to delete ipsets: %w", err)
+	}
+
+	return nil
+}
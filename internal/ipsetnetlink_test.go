@@ -0,0 +1,82 @@
+package gerberos
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIpsetNetlinkBackend(t *testing.T) {
+	if !testInNetworkNamespace(t) {
+		return
+	}
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	b := &ipsetNetlinkBackend{ipsetBackend: ipsetBackend{runner: rn}}
+	testNoError(t, b.initializeFirewall())
+	b.conn, err = newNetlinkConn()
+	testNoError(t, err)
+	defer b.conn.close()
+
+	// ip(6)tables are not available, only the ipsets are managed
+	if err := b.destroyIpsets(); err != nil {
+		t.Skipf("ipset not available: %s", err)
+	}
+	testNoError(t, b.createIpsets())
+	testError(t, b.createIpsets())
+
+	_, n4, _ := net.ParseCIDR("10.1.0.0/16")
+	_, n6, _ := net.ParseCIDR("2001:db8::/48")
+	testNoError(t, b.ban(hostNet(net.ParseIP("1.2.3.4")), false, time.Hour, nil))
+	testNoError(t, b.ban(hostNet(net.ParseIP("::1")), true, 0, nil))
+	testNoError(t, b.ban(n4, false, time.Hour, nil))
+	testNoError(t, b.ban(n6, true, 0, nil))
+	testNoError(t, b.ban(hostNet(net.ParseIP("1.2.3.4")), false, time.Hour, &port{"tcp", 22}))
+	testNoError(t, b.ban(hostNet(net.ParseIP("::1")), true, 0, &port{"udp", 53}))
+	if err := b.ban(hostNet(net.ParseIP("1.2.3.4")), false, time.Hour, &port{"tcp", 22}); !errors.Is(err, errAlreadyBanned) {
+		t.Errorf("expected errAlreadyBanned, got %v", err)
+	}
+	if err := b.ban(hostNet(net.ParseIP("1.2.3.4")), false, time.Hour, nil); !errors.Is(err, errAlreadyBanned) {
+		t.Errorf("expected errAlreadyBanned, got %v", err)
+	}
+	if err := b.ban(n4, false, time.Hour, nil); !errors.Is(err, errAlreadyBanned) {
+		t.Errorf("expected errAlreadyBanned, got %v", err)
+	}
+
+	es, err := b.elements()
+	testNoError(t, err)
+	for e, expires := range map[string]bool{
+		"1.2.3.4":        true,
+		"::1":            false,
+		"10.1.0.0/16":    true,
+		"2001:db8::/48":  false,
+		"1.2.3.4,tcp:22": true,
+		"::1,udp:53":     false,
+	} {
+		d, ok := es[e]
+		if !ok {
+			t.Errorf("expected element %s, got %v", e, es)
+		} else if expires != (d > 0) {
+			t.Errorf("unexpected duration of element %s: %s", e, d)
+		}
+	}
+	if len(es) != 6 {
+		t.Errorf("expected 6 elements, got %v", es)
+	}
+
+	// Lifted bans
+	testNoError(t, b.unban(n4, false, nil))
+	testNoError(t, b.unban(hostNet(net.ParseIP("::1")), true, &port{"udp", 53}))
+	if err := b.unban(n4, false, nil); !errors.Is(err, errNotBanned) {
+		t.Errorf("expected errNotBanned, got %v", err)
+	}
+	es, err = b.list()
+	testNoError(t, err)
+	if _, ok := es["10.1.0.0/16"]; ok || len(es) != 4 {
+		t.Errorf("expected 4 elements, got %v", es)
+	}
+
+	testNoError(t, b.destroyIpsets())
+}
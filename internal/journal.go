@@ -0,0 +1,238 @@
+package gerberos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// journalEntry is a journal entry as exported by "journalctl -o json" with
+// all values decoded to strings.
+type journalEntry map[string]string
+
+func decodeJournalValue(v json.RawMessage) (string, bool) {
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		return s, true
+	}
+
+	// Binary values are exported as arrays of bytes
+	var bs []int
+	if err := json.Unmarshal(v, &bs); err == nil {
+		b := make([]byte, len(bs))
+		for i, c := range bs {
+			b[i] = byte(c)
+		}
+		return string(b), true
+	}
+
+	// Fields with multiple values are exported as arrays of values
+	var vs []json.RawMessage
+	if err := json.Unmarshal(v, &vs); err == nil && len(vs) > 0 {
+		return decodeJournalValue(vs[0])
+	}
+
+	return "", false
+}
+
+func parseJournalEntry(l string) (journalEntry, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(l), &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode journal entry: %w", err)
+	}
+
+	e := make(journalEntry, len(raw))
+	for k, v := range raw {
+		if s, ok := decodeJournalValue(v); ok {
+			e[k] = s
+		}
+	}
+
+	return e, nil
+}
+
+func (e journalEntry) time() (time.Time, error) {
+	us, err := strconv.ParseInt(e["__REALTIME_TIMESTAMP"], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse realtime timestamp: %w", err)
+	}
+
+	return time.UnixMicro(us), nil
+}
+
+// short formats the entry like "journalctl -o short" does.
+func (e journalEntry) short() (string, error) {
+	t, err := e.time()
+	if err != nil {
+		return "", err
+	}
+
+	id, pid := e["SYSLOG_IDENTIFIER"], e["SYSLOG_PID"]
+	if id == "" {
+		id = e["_COMM"]
+	}
+	if pid == "" {
+		pid = e["_PID"]
+	}
+	if e["_TRANSPORT"] == "kernel" {
+		id, pid = "kernel", ""
+	}
+	if pid != "" {
+		id = fmt.Sprintf("%s[%s]", id, pid)
+	}
+
+	return fmt.Sprintf("%s %s %s: %s", t.Format("Jan 02 15:04:05"), e["_HOSTNAME"], id, e["MESSAGE"]), nil
+}
+
+// journalFollower reads journal entries as JSON using journalctl and keeps
+// track of the cursor in order not to miss entries when journalctl is
+// restarted and, if the rule catches up, after restarts of gerberos.
+type journalFollower struct {
+	// Shared with the source
+	*sourceRule
+	line        func(e journalEntry) (string, error)
+	mutex       sync.Mutex
+	cursor      string
+	initialized time.Time
+}
+
+// args returns the arguments to pass to journalctl additionally to those
+// selecting the journal entries.
+func (j *journalFollower) args() []string {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	a := []string{"-f", "-o", "json"}
+	switch {
+	case j.cursor != "":
+		return append(a, "--after-cursor", j.cursor)
+	case j.rule().catchUp > 0:
+		return append(a, "--since", fmt.Sprintf("@%d", j.initialized.Add(-j.rule().catchUp).Unix()))
+	default:
+		return append(a, "-n", "0")
+	}
+}
+
+func (j *journalFollower) processLine(l string, c chan *line) {
+	e, err := parseJournalEntry(l)
+	if err != nil {
+		log.Debug().Str("rule", j.rule().name).Err(err).Msg("failed to process journal entry")
+		return
+	}
+
+	if s, err := j.line(e); err == nil {
+		c <- &line{text: s}
+	} else if !errors.Is(err, errJournalEntryFiltered) {
+		log.Debug().Str("rule", j.rule().name).Err(err).Msg("failed to process journal entry")
+	}
+
+	if cr := e["__CURSOR"]; cr != "" {
+		j.mutex.Lock()
+		j.cursor = cr
+		j.mutex.Unlock()
+		if j.rule().catchUp > 0 {
+			j.rule().runner.cursors.set(j.rule().sourceKey(), &cursor{Journal: cr})
+		}
+	}
+}
+
+func (j *journalFollower) lines(args ...string) (chan *line, error) {
+	return j.rule().processScannerFunc(j.processLine, "journalctl", append(args, j.args()...)...)
+}
+
+func newJournalFollower(sr *sourceRule, line func(e journalEntry) (string, error)) *journalFollower {
+	r := sr.rule()
+	j := &journalFollower{
+		sourceRule:  sr,
+		line:        line,
+		initialized: time.Now(),
+	}
+	if r.catchUp > 0 {
+		if c := r.runner.cursors.get(r.sourceKey(), r.catchUp); c != nil {
+			j.cursor = c.Journal
+		}
+	}
+
+	return j
+}
+
+var errJournalEntryFiltered = errors.New("journal entry has been filtered")
+
+type journalFieldRegexp struct {
+	field  string
+	regexp *regexp.Regexp
+}
+
+// journalSource reads structured journal entries. Only their messages are
+// matched.
+type journalSource struct {
+	sourceRule
+	args    []string
+	regexps []journalFieldRegexp
+	journal *journalFollower
+}
+
+func (s *journalSource) initialize(r *rule) error {
+	s.setRule(r)
+
+	s.args = make([]string, 0)
+	s.regexps = make([]journalFieldRegexp, 0)
+	for _, p := range r.Source[1:] {
+		i := strings.IndexAny(p, "=~")
+		if i < 1 || i == len(p)-1 {
+			return fmt.Errorf(`invalid filter parameter "%s"`, p)
+		}
+		k, v := p[:i], p[i+1:]
+
+		if p[i] == '~' {
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return fmt.Errorf(`failed to compile regexp of filter parameter "%s": %w`, p, err)
+			}
+			s.regexps = append(s.regexps, journalFieldRegexp{field: k, regexp: re})
+			continue
+		}
+
+		switch k {
+		case "unit":
+			s.args = append(s.args, "-u", v)
+		case "priority":
+			sv, err := parseSyslogSeverity(v)
+			if err != nil {
+				return err
+			}
+			// Aliases like "warn" are unknown to journalctl
+			s.args = append(s.args, "-p", strconv.Itoa(sv))
+		default:
+			if strings.ToUpper(k) != k {
+				return fmt.Errorf(`invalid field name "%s"`, k)
+			}
+			s.args = append(s.args, p)
+		}
+	}
+
+	s.journal = newJournalFollower(&s.sourceRule, s.message)
+
+	return nil
+}
+
+func (s *journalSource) message(e journalEntry) (string, error) {
+	for _, fr := range s.regexps {
+		if !fr.regexp.MatchString(e[fr.field]) {
+			return "", errJournalEntryFiltered
+		}
+	}
+
+	return e["MESSAGE"], nil
+}
+
+func (s *journalSource) lines() (chan *line, error) {
+	return s.journal.lines(s.args...)
+}
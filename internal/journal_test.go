@@ -0,0 +1,84 @@
+package gerberos
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournalEntryParse(t *testing.T) {
+	e, err := parseJournalEntry(`{"MESSAGE":[104,105],"_HOSTNAME":"host","SYSLOG_IDENTIFIER":["sshd","other"],"_PID":"12","__REALTIME_TIMESTAMP":"1700000000000000","__CURSOR":"c"}`)
+	testNoError(t, err)
+	if e["MESSAGE"] != "hi" {
+		t.Errorf(`expected binary message "hi", got "%s"`, e["MESSAGE"])
+	}
+	if e["SYSLOG_IDENTIFIER"] != "sshd" {
+		t.Errorf(`expected first value "sshd", got "%s"`, e["SYSLOG_IDENTIFIER"])
+	}
+
+	s, err := e.short()
+	testNoError(t, err)
+	ts := time.Unix(1700000000, 0).Format("Jan 02 15:04:05")
+	if es := ts + " host sshd[12]: hi"; s != es {
+		t.Errorf(`expected "%s", got "%s"`, es, s)
+	}
+
+	e["_TRANSPORT"] = "kernel"
+	s, err = e.short()
+	testNoError(t, err)
+	if !strings.HasSuffix(s, " host kernel: hi") {
+		t.Errorf(`unexpected kernel entry "%s"`, s)
+	}
+
+	_, err = parseJournalEntry("not JSON")
+	testError(t, err)
+	_, err = journalEntry{}.short()
+	testError(t, err)
+}
+
+func TestJournalFollowerArgs(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.cursors = newCursorStore("")
+	r := newTestValidRule()
+	r.Source = []string{"systemd", "service"}
+	r.CatchUp = []string{"1h"}
+	testNoError(t, r.initialize(rn))
+
+	j := r.source.(*systemdSource).journal
+	if a := j.args(); a[len(a)-2] != "--since" {
+		t.Errorf("unexpected arguments %q", a)
+	}
+	j.processLine(`{"MESSAGE":"m","__REALTIME_TIMESTAMP":"0","__CURSOR":"c"}`, make(chan *line, 1))
+	if a := j.args(); a[len(a)-2] != "--after-cursor" || a[len(a)-1] != "c" {
+		t.Errorf("unexpected arguments %q", a)
+	}
+	if c := rn.cursors.cursors[r.sourceKey()]; c == nil || c.Journal != "c" {
+		t.Error("expected cursor to be stored")
+	}
+}
+
+func TestJournalSource(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	r := newTestValidRule()
+	r.Aggregate = nil
+	r.Regexp = []string{"^from %ip%$"}
+	r.Source = []string{"journal", "unit=ssh.service", "unit=other.service", "priority=warn", "SYSLOG_IDENTIFIER=sshd", "_COMM~^sshd?$"}
+	testNoError(t, r.initialize(rn))
+
+	s := r.source.(*journalSource)
+	if a := strings.Join(append(s.args, s.journal.args()...), " "); a != "-u ssh.service -u other.service -p 4 SYSLOG_IDENTIFIER=sshd -f -o json -n 0" {
+		t.Errorf("unexpected arguments %q", a)
+	}
+
+	c := make(chan *line, 2)
+	s.journal.processLine(`{"MESSAGE":"from 1.1.1.1","_COMM":"ssh","__CURSOR":"a"}`, c)
+	s.journal.processLine(`{"MESSAGE":"from 2.2.2.2","_COMM":"other","__CURSOR":"b"}`, c)
+	if len(c) != 1 || (<-c).text != "from 1.1.1.1" {
+		t.Error("expected exactly one line")
+	}
+	if a := s.journal.args(); a[len(a)-1] != "b" {
+		t.Errorf("unexpected arguments %q", a)
+	}
+}
@@ -0,0 +1,177 @@
+package gerberos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// jsonCondition is evaluated on the value of a field of a JSON line. Values
+// are compared by their textual representation: strings without quotes,
+// numbers as written and booleans as "true" and "false". Conditions on
+// missing fields, objects and arrays only hold if negated.
+type jsonCondition struct {
+	path    []string
+	negated bool
+	value   string
+	regexp  *regexp.Regexp
+}
+
+func (c *jsonCondition) holds(v any) bool {
+	s, e := jsonText(jsonField(v, c.path))
+	if !e {
+		return c.negated
+	}
+
+	if c.regexp != nil {
+		return c.regexp.MatchString(s) != c.negated
+	}
+
+	return (s == c.value) != c.negated
+}
+
+// parseJSONCondition parses a condition formatted as "<path>=<value>",
+// "<path>!=<value>", "<path>~<regexp>" or "<path>!~<regexp>".
+func parseJSONCondition(s string) (*jsonCondition, error) {
+	i := strings.IndexAny(s, "=~")
+	if i < 1 {
+		return nil, fmt.Errorf(`invalid condition "%s"`, s)
+	}
+
+	c := &jsonCondition{}
+	p := s[:i]
+	if strings.HasSuffix(p, "!") {
+		p, c.negated = p[:len(p)-1], true
+	}
+	if p == "" {
+		return nil, fmt.Errorf(`invalid condition "%s"`, s)
+	}
+	c.path = parseJSONPath(p)
+
+	if s[i] == '~' {
+		re, err := regexp.Compile(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf(`invalid condition "%s": %w`, s, err)
+		}
+		c.regexp = re
+	} else {
+		c.value = s[i+1:]
+	}
+
+	return c, nil
+}
+
+// parseJSONPath splits a path like "request.headers.X-Real-Ip.0" into its
+// segments. Numeric segments also index arrays.
+func parseJSONPath(s string) []string {
+	return strings.Split(s, ".")
+}
+
+func jsonField(v any, path []string) any {
+	for _, p := range path {
+		switch t := v.(type) {
+		case map[string]any:
+			v = t[p]
+		case []any:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(t) {
+				return nil
+			}
+			v = t[i]
+		default:
+			return nil
+		}
+	}
+
+	return v
+}
+
+// jsonText returns the textual representation of a scalar value and whether
+// the value exists and is a scalar.
+func jsonText(v any) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case json.Number:
+		return t.String(), true
+	case bool:
+		return strconv.FormatBool(t), true
+	}
+
+	return "", false
+}
+
+// jsonRule holds the options of rules matching JSON lines.
+type jsonRule struct {
+	ipPath     []string
+	conditions []*jsonCondition
+}
+
+func (r *rule) initializeJSON() error {
+	if r.JSON == nil {
+		return nil
+	}
+
+	if len(r.JSON) < 1 || r.JSON[0] == "" {
+		return errors.New("missing IP field parameter")
+	}
+
+	if r.Aggregate != nil {
+		return errors.New("aggregate option must not be used with the json option")
+	}
+
+	j := &jsonRule{
+		ipPath:     parseJSONPath(r.JSON[0]),
+		conditions: make([]*jsonCondition, 0),
+	}
+	for _, s := range r.JSON[1:] {
+		c, err := parseJSONCondition(s)
+		if err != nil {
+			return err
+		}
+		j.conditions = append(j.conditions, c)
+	}
+	r.json = j
+
+	return nil
+}
+
+func (r *rule) matchJSON(line string) (*match, error) {
+	d := json.NewDecoder(strings.NewReader(line))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf(`failed to parse line "%s" as JSON: %w`, line, err)
+	}
+
+	for _, c := range r.json.conditions {
+		if !c.holds(v) {
+			return nil, fmt.Errorf(`line "%s" does not meet all conditions`, line)
+		}
+	}
+
+	h, e := jsonText(jsonField(v, r.json.ipPath))
+	if !e {
+		return nil, fmt.Errorf(`line "%s" lacks IP field`, line)
+	}
+	// Addresses may include a port
+	if sh, _, err := net.SplitHostPort(h); err == nil {
+		h = sh
+	}
+	h = strings.Trim(h, "[]")
+	ip := net.ParseIP(h)
+	if ip == nil {
+		return nil, fmt.Errorf(`failed to parse IP "%s"`, h)
+	}
+
+	return &match{
+		line: line,
+		time: r.lineTime(line),
+		ip:   ip,
+		ipv6: ip.To4() == nil,
+	}, nil
+}
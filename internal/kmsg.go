@@ -0,0 +1,229 @@
+package gerberos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const kmsgDefaultPath = "/dev/kmsg"
+
+type kmsgRecord struct {
+	priority  int
+	sequence  uint64
+	timestamp time.Duration // Since boot
+	message   string
+}
+
+func (r *kmsgRecord) facility() int {
+	return r.priority / 8
+}
+
+// unescapeKmsg reverts the escaping of non-printable characters as "\xHH".
+func unescapeKmsg(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// parseKmsgRecord parses a record formatted as
+// "<priority>,<sequence>,<timestamp>,<flags>[,...];<message>". Continuation
+// lines holding key/value pairs have to be removed beforehand.
+func parseKmsgRecord(s string) (*kmsgRecord, error) {
+	h, m, ok := strings.Cut(s, ";")
+	if !ok {
+		return nil, errors.New("missing message")
+	}
+
+	fs := strings.Split(h, ",")
+	if len(fs) < 4 {
+		return nil, errors.New("incomplete header")
+	}
+	p, err := strconv.Atoi(fs[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse priority: %w", err)
+	}
+	sq, err := strconv.ParseUint(fs[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sequence number: %w", err)
+	}
+	ts, err := strconv.ParseInt(fs[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timestamp: %w", err)
+	}
+
+	return &kmsgRecord{
+		priority:  p,
+		sequence:  sq,
+		timestamp: time.Duration(ts) * time.Microsecond,
+		message:   unescapeKmsg(m),
+	}, nil
+}
+
+func kmsgBootID() string {
+	b, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// kmsgSource reads kernel messages from /dev/kmsg (or any other path using
+// the same record format). Regular files are read from their start and
+// followed like pipes.
+type kmsgSource struct {
+	sourceRule
+	path     string
+	bootID   string
+	sequence uint64
+	// Whether sequence refers to a record that has been read already
+	sequenced bool
+}
+
+func (s *kmsgSource) initialize(r *rule) error {
+	s.setRule(r)
+
+	s.path = kmsgDefaultPath
+	if len(r.Source) > 1 {
+		s.path = r.Source[1]
+	}
+
+	if len(r.Source) > 2 {
+		return errors.New("superfluous parameter(s)")
+	}
+
+	s.bootID = kmsgBootID()
+	if r.catchUp > 0 {
+		if c := r.runner.cursors.get(r.sourceKey(), r.catchUp); c != nil && c.Boot != "" && c.Boot == s.bootID {
+			s.sequence, s.sequenced = c.Sequence, true
+		}
+	}
+
+	return nil
+}
+
+func (s *kmsgSource) processRecord(b string, c chan *line) {
+	rc, err := parseKmsgRecord(b)
+	if err != nil {
+		log.Debug().Str("rule", s.rule().name).Err(err).Msg("failed to parse kernel message")
+		return
+	}
+
+	if s.sequenced && rc.sequence <= s.sequence {
+		return
+	}
+	s.sequence, s.sequenced = rc.sequence, true
+	if s.rule().catchUp > 0 {
+		s.rule().runner.cursors.set(s.rule().sourceKey(), &cursor{Boot: s.bootID, Sequence: rc.sequence})
+	}
+
+	// Only messages of the kernel itself, like journalctl -k
+	if rc.facility() == 0 {
+		c <- &line{text: rc.message}
+	}
+}
+
+func (s *kmsgSource) read(ctx context.Context, f *os.File, c chan *line) error {
+	b := make([]byte, 16*1024)
+	var p []byte
+	for {
+		n, err := f.Read(b)
+		switch {
+		case errors.Is(err, syscall.EPIPE):
+			// Records have been overwritten before they could be read. Reading
+			// continues with the next available record.
+			log.Warn().Str("rule", s.rule().name).Str("path", s.path).Msg("kernel messages have been overwritten before they could be read")
+			continue
+		case errors.Is(err, io.EOF):
+			// Regular files
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(tailerInterval):
+			}
+			continue
+		case err != nil:
+			return err
+		}
+
+		p = append(p, b[:n]...)
+		for {
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				break
+			}
+			// Continuation lines start with a space
+			if i > 0 && p[0] != ' ' {
+				s.processRecord(string(p[:i]), c)
+			}
+			p = p[i+1:]
+		}
+	}
+}
+
+func (s *kmsgSource) lines() (chan *line, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Mode()&os.ModeCharDevice != 0 && !s.sequenced {
+		// Skip all records present before
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	log.Info().Str("rule", s.rule().name).Str("path", s.path).Msg("reading kernel messages")
+
+	ctx := s.rule().sharedSource.reading
+	c := make(chan *line, 1)
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		f.Close()
+	}()
+	go func() {
+		if err := s.read(ctx, f, c); err != nil && !errors.Is(err, os.ErrClosed) {
+			log.Warn().Str("rule", s.rule().name).Str("path", s.path).Err(err).Msg("failed to read kernel messages")
+		}
+		// Closed before the channel, so that the device is released right away
+		f.Close()
+		close(done)
+		close(c)
+	}()
+
+	return c, nil
+}
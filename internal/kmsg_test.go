@@ -0,0 +1,73 @@
+package gerberos
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKmsgParse(t *testing.T) {
+	r, err := parseKmsgRecord(`4,1532,4270370412,-,caller=T1;[UFW BLOCK] IN=eth0 SRC=1.2.3.4 \x5cx\x0a`)
+	testNoError(t, err)
+	if r.priority != 4 || r.facility() != 0 || r.sequence != 1532 || r.timestamp != 4270370412*time.Microsecond {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if r.message != "[UFW BLOCK] IN=eth0 SRC=1.2.3.4 \\x\n" {
+		t.Errorf(`unexpected message "%s"`, r.message)
+	}
+
+	if unescapeKmsg(`\xzz \x4`) != `\xzz \x4` {
+		t.Error("expected invalid escape sequences to be kept")
+	}
+
+	for _, s := range []string{"no message", "1,2,3;incomplete header", "a,2,3,-;", "1,b,3,-;", "1,2,c,-;"} {
+		_, err := parseKmsgRecord(s)
+		testError(t, err)
+	}
+}
+
+func TestKmsgSource(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "kmsg")
+	testTailerAppend(t, p, "6,1,10,-;first\n SUBSYSTEM=net\n 14,2,20,-;from user space\n")
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	r := newTestValidRule()
+	r.Source = []string{"kmsg", p}
+	testNoError(t, r.initialize(rn))
+	s := r.source.(*kmsgSource)
+
+	ex := func(c chan *line, text string) {
+		t.Helper()
+		select {
+		case l := <-c:
+			if l.text != text {
+				t.Errorf(`expected line "%s", got "%s"`, text, l.text)
+			}
+		case <-time.After(time.Second):
+			t.Error("expected line")
+		}
+	}
+
+	c, err := s.lines()
+	testNoError(t, err)
+	ex(c, "first")
+	testTailerAppend(t, p, "6,3,30,-;second\n")
+	ex(c, "second")
+	rn.stop()
+	for range c {
+	}
+
+	// Records already read are skipped when reading is resumed
+	rn, err = newTestRunner()
+	testNoError(t, err)
+	s.rule().runner = rn
+	s.rule().sharedSource = newSharedSource(rn.stopped, s)
+	testTailerAppend(t, p, "6,4,40,-;third\n")
+	c, err = s.lines()
+	testNoError(t, err)
+	ex(c, "third")
+	rn.stop()
+	for range c {
+	}
+}
@@ -11,12 +11,32 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+var errIncompleteAggregate = errors.New("incomplete aggregate")
+
 type match struct {
 	time   time.Time
 	line   string
+	origin string
 	ip     net.IP
 	ipv6   bool
 	regexp *regexp.Regexp
+	// Named subexpressions of the regexps matched, including "ip"
+	captures map[string]string
+}
+
+// variables returns the values available to action templates: the captures
+// along with "ip", "origin", "line" and "rule", which take precedence.
+func (m *match) variables(r *rule) map[string]string {
+	vs := make(map[string]string, len(m.captures)+4)
+	for k, v := range m.captures {
+		vs[k] = v
+	}
+	vs["ip"] = m.ip.String()
+	vs["origin"] = m.origin
+	vs["line"] = m.line
+	vs["rule"] = r.name
+
+	return vs
 }
 
 func (r *rule) matchSimple(line string) (*match, error) {
@@ -40,11 +60,12 @@ func (r *rule) matchSimple(line string) (*match, error) {
 		}
 
 		return &match{
-			line:   line,
-			time:   time.Now(),
-			ip:     net.ParseIP(h),
-			ipv6:   ph.To4() == nil,
-			regexp: re,
+			line:     line,
+			time:     r.matchTime(re, m, r.lineTime(line)),
+			ip:       net.ParseIP(h),
+			ipv6:     ph.To4() == nil,
+			regexp:   re,
+			captures: sm,
 		}, nil
 	}
 
@@ -68,17 +89,33 @@ func (r *rule) matchAggregate(line string) (*match, error) {
 		}
 		id := sm["id"]
 
+		t := r.lineTime(line)
 		a.registryMutex.Lock()
-		if ip, e := a.registry[id]; e {
+		if e, f := a.registry[id]; f {
 			delete(a.registry, id)
 			a.registryMutex.Unlock()
+			if t.Sub(e.time) > a.interval {
+				// Only happens when replaying lines
+				continue
+			}
+			// Completing lines without timestamps take the one of the first line
+			mt := t
+			if r.timestamp != nil {
+				mt = r.matchTime(re, m, e.matched)
+			}
+
+			// Captures of the completing line take precedence
+			for k, v := range sm {
+				e.captures[k] = v
+			}
 
 			return &match{
-				line:   line,
-				time:   time.Now(),
-				ip:     ip,
-				ipv6:   ip.To4() == nil,
-				regexp: re,
+				line:     line,
+				time:     mt,
+				ip:       e.ip,
+				ipv6:     e.ip.To4() == nil,
+				regexp:   re,
+				captures: e.captures,
 			}, nil
 		}
 		a.registryMutex.Unlock()
@@ -109,27 +146,46 @@ func (r *rule) matchAggregate(line string) (*match, error) {
 		}
 
 		a.registryMutex.Lock()
-		a.registry[id] = ip
+		t := r.lineTime(line)
+		a.registry[id] = &aggregateEntry{ip: ip, time: t, matched: r.matchTime(re, m, t), captures: sm}
 		log.Debug().Str("rule", r.name).Str("id", id).IPAddr("ip", ip).Msg("added ID to registry")
 		a.registryMutex.Unlock()
 
+		// Replayed lines are checked against the interval on completion
+		if r.replay != nil {
+			return nil, errIncompleteAggregate
+		}
 		go func(id string) {
 			time.Sleep(a.interval)
 			a.registryMutex.Lock()
-			if ip, e := a.registry[id]; e {
+			if e, f := a.registry[id]; f {
 				delete(a.registry, id)
-				log.Debug().Str("rule", r.name).Str("id", id).IPAddr("ip", ip).Msg("removed ID from registry")
+				log.Debug().Str("rule", r.name).Str("id", id).IPAddr("ip", e.ip).Msg("removed ID from registry")
 			}
 			a.registryMutex.Unlock()
 		}(id)
 
-		return nil, errors.New("incomplete aggregate")
+		return nil, errIncompleteAggregate
 	}
 
 	return nil, fmt.Errorf(`line "%s" does not match any regexp`, line)
 }
 
+// lineTime returns the time of the line. This is the current time unless the
+// rule is replayed.
+func (r *rule) lineTime(line string) time.Time {
+	if r.replay != nil {
+		return r.replay.lineTime(line)
+	}
+
+	return time.Now()
+}
+
 func (r *rule) match(line string) (*match, error) {
+	if r.json != nil {
+		return r.matchJSON(line)
+	}
+
 	if r.aggregate != nil {
 		return r.matchAggregate(line)
 	}
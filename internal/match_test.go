@@ -122,3 +122,79 @@ func TestMatchesAggregateInvalid(t *testing.T) {
 	_, err = r.matchAggregate("123.123.123.123")
 	testError(t, err)
 }
+
+func TestMatchesJSON(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+
+	mj := func(s string, j []string, e bool, l string, h string) {
+		r := newTestValidRule()
+		r.Regexp = nil
+		r.Aggregate = nil
+		r.JSON = j
+		if err := r.initialize(rn); err != nil {
+			t.Errorf("%s: failed to initialize rule: %s", s, err)
+			return
+		}
+
+		m, err := r.match(l)
+		if e != (err == nil) {
+			t.Errorf("%s: unexpected result", s)
+			return
+		}
+		if e && m.ip.String() != h {
+			t.Errorf(`%s: expected IP "%s", got "%s"`, s, h, m.ip)
+		}
+	}
+
+	l := `{"level":"info","status":401,"secure":false,"request":{"remote_ip":"1.2.3.4","uri":"/login","headers":{"X-Real-Ip":["::1"]}}}`
+	mj("valid 1", []string{"request.remote_ip"}, true, l, "1.2.3.4")
+	mj("valid 2", []string{"request.remote_ip", "status=401", "level!=debug", "request.uri~^/log", "secure=false"}, true, l, "1.2.3.4")
+	mj("valid 3", []string{"request.headers.X-Real-Ip.0"}, true, l, "::1")
+	mj("valid 4", []string{"request.remote_ip", "missing!=x", "request!~x"}, true, l, "1.2.3.4")
+	mj("valid 5", []string{"ClientAddr"}, true, `{"ClientAddr":"[::1]:4711"}`, "::1")
+	mj("valid 6", []string{"ClientAddr"}, true, ` {"ClientAddr":"1.2.3.4:4711"} `, "1.2.3.4")
+
+	mj("invalid 1", []string{"request.remote_ip", "status=200"}, false, l, "")
+	mj("invalid 2", []string{"request.remote_ip", "level!=info"}, false, l, "")
+	mj("invalid 3", []string{"request.remote_ip", "request.uri!~^/log"}, false, l, "")
+	mj("invalid 4", []string{"request.remote_ip", "missing=x"}, false, l, "")
+	mj("invalid 5", []string{"request.headers.X-Real-Ip.1"}, false, l, "")
+	mj("invalid 6", []string{"request"}, false, l, "")
+	mj("invalid 7", []string{"level"}, false, l, "")
+	mj("invalid 8", []string{"ip"}, false, `not JSON`, "")
+	mj("invalid 9", []string{"ip"}, false, `{"ip":"1.2.3.4"`, "")
+}
+
+func TestMatchCaptures(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+
+	r := newTestValidRule()
+	r.Aggregate = nil
+	r.Regexp = []string{`Invalid user (?P<user>\S+) from %ip%`}
+	r.Action = []string{"log", "extended", "message={{.user}} from {{.ip}} ({{.rule}}){{.missing}}"}
+	testNoError(t, r.initialize(rn))
+	m, err := r.match("Invalid user admin from 192.0.2.1")
+	testNoError(t, err)
+	if m.captures["user"] != "admin" || m.captures["ip"] != "192.0.2.1" {
+		t.Errorf("unexpected captures %v", m.captures)
+	}
+	if s := r.message(r.action.(*logAction).message, m); s != "admin from 192.0.2.1 (test)" {
+		t.Errorf(`unexpected message "%s"`, s)
+	}
+	testNoError(t, r.action.perform(m))
+
+	// Captures of both lines of aggregates
+	r = newTestValidRule()
+	r.Regexp = []string{`from %ip% id %id%`}
+	r.Aggregate = []string{"1s", `user (?P<user>\S+) failed, id %id%`}
+	testNoError(t, r.initialize(rn))
+	_, err = r.match("from 192.0.2.1 id x")
+	testError(t, err)
+	m, err = r.match("user root failed, id x")
+	testNoError(t, err)
+	if m.captures["user"] != "root" || m.captures["ip"] != "192.0.2.1" || m.captures["id"] != "x" {
+		t.Errorf("unexpected captures %v", m.captures)
+	}
+}
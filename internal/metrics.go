@@ -0,0 +1,212 @@
+package gerberos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Upper bounds in seconds of the buckets of command durations
+var metricsCommandBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var metricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// histogram counts observations per bucket like a Prometheus histogram.
+// Counts are not cumulative until written.
+type histogram struct {
+	mutex  sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if i, _ := slices.BinarySearch(metricsCommandBuckets, v); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]uint64, len(metricsCommandBuckets)),
+	}
+}
+
+// timedExecutor records the durations of commands per name, including those
+// of netlink requests of the netlink backends.
+type timedExecutor struct {
+	executor  executor
+	mutex     sync.Mutex
+	durations map[string]*histogram
+}
+
+func (e *timedExecutor) execute(name string, args ...string) (string, int, error) {
+	return e.executeWithStd(nil, nil, name, args...)
+}
+
+func (e *timedExecutor) executeWithStd(stdin io.Reader, stdout io.Writer, name string, args ...string) (string, int, error) {
+	t := time.Now()
+	s, ec, err := e.executor.executeWithStd(stdin, stdout, name, args...)
+	e.observe(name, time.Since(t))
+
+	return s, ec, err
+}
+
+func (e *timedExecutor) observe(name string, d time.Duration) {
+	e.mutex.Lock()
+	h, ok := e.durations[name]
+	if !ok {
+		h = newHistogram()
+		e.durations[name] = h
+	}
+	e.mutex.Unlock()
+	h.observe(d.Seconds())
+}
+
+// observeDuration records the duration of a request not made through the
+// executor once metrics are enabled.
+func (rn *Runner) observeDuration(name string, d time.Duration) {
+	if rn.timedExecutor != nil {
+		rn.timedExecutor.observe(name, d)
+	}
+}
+
+func newTimedExecutor(e executor) *timedExecutor {
+	return &timedExecutor{
+		executor:  e,
+		durations: make(map[string]*histogram),
+	}
+}
+
+func (rn *Runner) initializeMetrics() error {
+	a := rn.configuration.MetricsListenAddress
+	if a == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", a)
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics address: %w", err)
+	}
+	m := http.NewServeMux()
+	m.HandleFunc("/metrics", rn.handleMetrics)
+	rn.metrics = &http.Server{Handler: m, ReadHeaderTimeout: 10 * time.Second}
+	rn.metricsListener = l
+	rn.timedExecutor = newTimedExecutor(rn.executor)
+	rn.executor = rn.timedExecutor
+	log.Info().Str("metricsListenAddress", l.Addr().String()).Msg("serving metrics")
+
+	return nil
+}
+
+func (rn *Runner) serveMetrics() {
+	if err := rn.metrics.Serve(rn.metricsListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Warn().Err(err).Msg("failed to serve metrics")
+	}
+}
+
+func (rn *Runner) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	b := &bytes.Buffer{}
+	rn.writeMetrics(b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// writeMetrics writes all metrics in the Prometheus text format.
+func (rn *Runner) writeMetrics(w io.Writer) {
+	rs := rn.rules()
+	ns := make([]string, 0, len(rs))
+	for n := range rs {
+		ns = append(ns, n)
+	}
+	slices.Sort(ns)
+	for _, c := range []struct {
+		name    string
+		help    string
+		counter func(c *ruleCounters) *atomic.Uint64
+	}{
+		{"gerberos_rule_lines_total", "Lines scanned.", func(c *ruleCounters) *atomic.Uint64 { return &c.lines }},
+		{"gerberos_rule_matches_total", "Lines matched.", func(c *ruleCounters) *atomic.Uint64 { return &c.matches }},
+		{"gerberos_rule_match_failures_total", "Lines not matched.", func(c *ruleCounters) *atomic.Uint64 { return &c.matchFailures }},
+		{"gerberos_rule_occurrences_total", "Matches completing the occurrences.", func(c *ruleCounters) *atomic.Uint64 { return &c.occurrences }},
+		{"gerberos_rule_actions_total", "Actions performed.", func(c *ruleCounters) *atomic.Uint64 { return &c.actions }},
+		{"gerberos_rule_action_failures_total", "Actions failed.", func(c *ruleCounters) *atomic.Uint64 { return &c.actionFailures }},
+		{"gerberos_rule_worker_respawns_total", "Workers respawned.", func(c *ruleCounters) *atomic.Uint64 { return &c.respawns }},
+		{"gerberos_rule_dropped_lines_total", "Lines dropped while the worker was too slow.", func(c *ruleCounters) *atomic.Uint64 { return &c.droppedLines }},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, n := range ns {
+			fmt.Fprintf(w, "%s{rule=\"%s\"} %d\n", c.name, metricsLabelReplacer.Replace(n), c.counter(&rs[n].counters).Load())
+		}
+	}
+
+	if rn.timedExecutor != nil {
+		rn.writeCommandMetrics(w)
+	}
+
+	es, err := rn.backend.list()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to list banned IPs for metrics")
+		return
+	}
+	c4, c6 := 0, 0
+	for e := range es {
+		n, _, err := parseElement(e)
+		if err != nil {
+			continue
+		}
+		if n.IP.To4() == nil {
+			c6++
+		} else {
+			c4++
+		}
+	}
+	fmt.Fprintf(w, "# HELP gerberos_bans Banned IPs and subnets.\n# TYPE gerberos_bans gauge\n")
+	fmt.Fprintf(w, "gerberos_bans{family=\"ipv4\"} %d\n", c4)
+	fmt.Fprintf(w, "gerberos_bans{family=\"ipv6\"} %d\n", c6)
+}
+
+func (rn *Runner) writeCommandMetrics(w io.Writer) {
+	e := rn.timedExecutor
+	e.mutex.Lock()
+	ns := make([]string, 0, len(e.durations))
+	for n := range e.durations {
+		ns = append(ns, n)
+	}
+	e.mutex.Unlock()
+	slices.Sort(ns)
+
+	fmt.Fprintf(w, "# HELP gerberos_command_duration_seconds Durations of commands run by the backend.\n# TYPE gerberos_command_duration_seconds histogram\n")
+	for _, n := range ns {
+		e.mutex.Lock()
+		h := e.durations[n]
+		e.mutex.Unlock()
+
+		h.mutex.Lock()
+		l := metricsLabelReplacer.Replace(n)
+		c := uint64(0)
+		for i, b := range metricsCommandBuckets {
+			c += h.counts[i]
+			fmt.Fprintf(w, "gerberos_command_duration_seconds_bucket{command=\"%s\",le=\"%g\"} %d\n", l, b, c)
+		}
+		fmt.Fprintf(w, "gerberos_command_duration_seconds_bucket{command=\"%s\",le=\"+Inf\"} %d\n", l, h.count)
+		fmt.Fprintf(w, "gerberos_command_duration_seconds_sum{command=\"%s\"} %g\n", l, h.sum)
+		fmt.Fprintf(w, "gerberos_command_duration_seconds_count{command=\"%s\"} %d\n", l, h.count)
+		h.mutex.Unlock()
+	}
+}
@@ -0,0 +1,67 @@
+package gerberos
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.configuration.MetricsListenAddress = "127.0.0.1:0"
+	b := &testPortBackend{testBackend: testBackend{runner: rn}, banned: map[string]bool{
+		"192.0.2.1":          true,
+		"192.0.2.0/24":       true,
+		"2001:db8::1,tcp:22": true,
+	}}
+	rn.backend = b
+	r := newTestValidRule()
+	rn.configuration.Rules = map[string]*rule{`te"st`: r}
+	r.counters.lines.Add(3)
+	r.counters.matchFailures.Add(1)
+	r.counters.respawns.Add(2)
+
+	testNoError(t, rn.initializeMetrics())
+	defer rn.metrics.Close()
+	go rn.serveMetrics()
+	_, _, err = rn.executor.execute("true")
+	testNoError(t, err)
+	// Netlink requests of the netlink backends
+	c := &netlinkConn{name: "nft", observe: rn.observeDuration}
+	c.timed("netlink", time.Now())
+
+	res, err := http.Get("http://" + rn.metricsListener.Addr().String() + "/metrics")
+	testNoError(t, err)
+	defer res.Body.Close()
+	bs, err := io.ReadAll(res.Body)
+	testNoError(t, err)
+	for _, l := range []string{
+		`gerberos_rule_lines_total{rule="te\"st"} 3`,
+		`gerberos_rule_matches_total{rule="te\"st"} 0`,
+		`gerberos_rule_match_failures_total{rule="te\"st"} 1`,
+		`gerberos_rule_worker_respawns_total{rule="te\"st"} 2`,
+		`gerberos_command_duration_seconds_bucket{command="true",le="+Inf"} 1`,
+		`gerberos_command_duration_seconds_count{command="true"} 1`,
+		`gerberos_command_duration_seconds_count{command="nft-netlink"} 1`,
+		`gerberos_bans{family="ipv4"} 2`,
+		`gerberos_bans{family="ipv6"} 1`,
+	} {
+		if !strings.Contains(string(bs), l+"\n") {
+			t.Errorf("expected line %s in:\n%s", l, bs)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	h.observe(0.001)
+	h.observe(0.005)
+	h.observe(0.3)
+	h.observe(60)
+	if h.counts[0] != 2 || h.counts[6] != 1 || h.count != 4 {
+		t.Errorf("unexpected counts %v of %d", h.counts, h.count)
+	}
+}
@@ -0,0 +1,108 @@
+package gerberos
+
+import (
+	"cmp"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const multilineMaxLines = 1000
+
+// multiline assembles records spanning multiple lines before they are
+// matched. Either the first line of each record or all subsequent lines are
+// recognized by a regexp. A record is complete once the next one starts or no
+// further line has been read within the timeout.
+type multiline struct {
+	timeout time.Duration
+	// Whether the regexp matches the first lines of records instead of the
+	// continuation lines
+	start  bool
+	regexp *regexp.Regexp
+}
+
+type multilineRecord struct {
+	number   uint64
+	lines    []string
+	deadline time.Time
+}
+
+func newMultiline(timeout time.Duration, start bool, re *regexp.Regexp) *multiline {
+	return &multiline{
+		timeout: timeout,
+		start:   start,
+		regexp:  re,
+	}
+}
+
+func (ml *multiline) continues(l string) bool {
+	return ml.regexp.MatchString(l) != ml.start
+}
+
+// assemble joins the lines of each record with line feeds. Lines of different
+// origins are never joined.
+func (ml *multiline) assemble(in chan *line) chan *line {
+	out := make(chan *line, 1)
+
+	go func() {
+		rs := make(map[string]*multilineRecord)
+		n := uint64(0)
+		flush := func(o string) {
+			if r, e := rs[o]; e {
+				out <- &line{text: strings.Join(r.lines, "\n"), origin: o}
+				delete(rs, o)
+			}
+		}
+
+		t := time.NewTimer(ml.timeout)
+		defer t.Stop()
+		for {
+			select {
+			case l, ok := <-in:
+				if !ok {
+					// Remaining records are flushed in the order they started
+					ks := slices.SortedFunc(maps.Keys(rs), func(a, b string) int {
+						return cmp.Compare(rs[a].number, rs[b].number)
+					})
+					for _, o := range ks {
+						flush(o)
+					}
+					close(out)
+					return
+				}
+
+				r, e := rs[l.origin]
+				if !e || !ml.continues(l.text) || len(r.lines) >= multilineMaxLines {
+					flush(l.origin)
+					n++
+					r = &multilineRecord{number: n}
+					rs[l.origin] = r
+				}
+				r.lines = append(r.lines, l.text)
+				r.deadline = time.Now().Add(ml.timeout)
+			case <-t.C:
+				now := time.Now()
+				for o, r := range rs {
+					if !now.Before(r.deadline) {
+						flush(o)
+					}
+				}
+			}
+
+			// Wake up with the next deadline
+			var d time.Time
+			for _, r := range rs {
+				if d.IsZero() || r.deadline.Before(d) {
+					d = r.deadline
+				}
+			}
+			if !d.IsZero() {
+				t.Reset(time.Until(d))
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,88 @@
+package gerberos
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func testMultiline(t *testing.T, ml *multiline, ls []*line, ex []*line) {
+	t.Helper()
+
+	in := make(chan *line)
+	out := ml.assemble(in)
+	go func() {
+		for _, l := range ls {
+			in <- l
+		}
+		close(in)
+	}()
+
+	i := 0
+	for l := range out {
+		if i >= len(ex) {
+			t.Errorf(`unexpected record "%s"`, l.text)
+			continue
+		}
+		if *l != *ex[i] {
+			t.Errorf(`expected record "%s" from "%s", got "%s" from "%s"`, ex[i].text, ex[i].origin, l.text, l.origin)
+		}
+		i++
+	}
+	if i < len(ex) {
+		t.Errorf("expected %d records, got %d", len(ex), i)
+	}
+}
+
+func TestMultilineStart(t *testing.T) {
+	ml := newMultiline(time.Hour, true, regexp.MustCompile(`^\S`))
+	testMultiline(t, ml, []*line{
+		{text: "ERROR login failed"},
+		{text: "  client 1.2.3.4"},
+		{text: "INFO ok"},
+		{text: "  a"},
+		{text: "  b"},
+	}, []*line{
+		{text: "ERROR login failed\n  client 1.2.3.4"},
+		{text: "INFO ok\n  a\n  b"},
+	})
+}
+
+func TestMultilineContinuation(t *testing.T) {
+	ml := newMultiline(time.Hour, false, regexp.MustCompile(`^\s+at `))
+	testMultiline(t, ml, []*line{
+		{text: "  at orphan"},
+		{text: "Exception from 1.2.3.4", origin: "a"},
+		{text: "first", origin: "b"},
+		{text: "  at A.b()", origin: "a"},
+		{text: "  at C.d()", origin: "b"},
+		{text: "second", origin: "a"},
+	}, []*line{
+		{text: "Exception from 1.2.3.4\n  at A.b()", origin: "a"},
+		{text: "  at orphan"},
+		{text: "first\n  at C.d()", origin: "b"},
+		{text: "second", origin: "a"},
+	})
+}
+
+func TestMultilineTimeout(t *testing.T) {
+	ml := newMultiline(10*time.Millisecond, true, regexp.MustCompile(`^\S`))
+	in := make(chan *line)
+	out := ml.assemble(in)
+	in <- &line{text: "a"}
+	in <- &line{text: " b"}
+
+	select {
+	case l := <-out:
+		if l.text != "a\n b" {
+			t.Errorf(`unexpected record "%s"`, l.text)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected record to be flushed")
+	}
+
+	close(in)
+	if _, ok := <-out; ok {
+		t.Error("expected no further record")
+	}
+}
@@ -0,0 +1,268 @@
+package gerberos
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	netlinkBufferSize = 1 << 16
+	netlinkTimeout    = 5 * time.Second
+	// Length of the netfilter header following the netlink header
+	netlinkNfgenmsgLen = 4
+)
+
+// netlinkAttribute is a decoded netlink attribute. Flags like NLA_F_NESTED are
+// removed from its type.
+type netlinkAttribute struct {
+	typ  uint16
+	data []byte
+}
+
+func netlinkAttr(t uint16, data []byte) []byte {
+	l := unix.NLA_HDRLEN + len(data)
+	b := make([]byte, netlinkAlign(l))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(b[2:4], t)
+	copy(b[unix.NLA_HDRLEN:], data)
+
+	return b
+}
+
+func netlinkAttrNested(t uint16, as ...[]byte) []byte {
+	return netlinkAttr(t|unix.NLA_F_NESTED, netlinkConcat(as...))
+}
+
+func netlinkAttrString(t uint16, s string) []byte {
+	return netlinkAttr(t, append([]byte(s), 0))
+}
+
+// netlinkAttrU32 encodes a value in network byte order like most netfilter
+// attributes.
+func netlinkAttrU32(t uint16, v uint32) []byte {
+	return netlinkAttr(t, binary.BigEndian.AppendUint32(nil, v))
+}
+
+func netlinkAttrU64(t uint16, v uint64) []byte {
+	return netlinkAttr(t, binary.BigEndian.AppendUint64(nil, v))
+}
+
+func netlinkConcat(bs ...[]byte) []byte {
+	r := make([]byte, 0)
+	for _, b := range bs {
+		r = append(r, b...)
+	}
+
+	return r
+}
+
+func netlinkAlign(l int) int {
+	return (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
+
+func parseNetlinkAttributes(b []byte) ([]netlinkAttribute, error) {
+	as := make([]netlinkAttribute, 0)
+	for len(b) >= unix.NLA_HDRLEN {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		t := binary.NativeEndian.Uint16(b[2:4])
+		if l < unix.NLA_HDRLEN || l > len(b) {
+			return nil, errors.New("invalid attribute length")
+		}
+		as = append(as, netlinkAttribute{
+			typ:  t &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER),
+			data: b[unix.NLA_HDRLEN:l],
+		})
+		b = b[min(netlinkAlign(l), len(b)):]
+	}
+
+	return as, nil
+}
+
+// netlinkMessage is a netfilter netlink message.
+type netlinkMessage struct {
+	typ    uint16
+	flags  uint16
+	family uint8
+	resID  uint16
+	data   []byte
+}
+
+func (m *netlinkMessage) marshal(seq uint32) []byte {
+	l := unix.NLMSG_HDRLEN + netlinkNfgenmsgLen + len(m.data)
+	b := make([]byte, unix.NLMSG_HDRLEN, l)
+	binary.NativeEndian.PutUint32(b[0:4], uint32(l))
+	binary.NativeEndian.PutUint16(b[4:6], m.typ)
+	binary.NativeEndian.PutUint16(b[6:8], m.flags)
+	binary.NativeEndian.PutUint32(b[8:12], seq)
+	b = append(b, m.family, unix.NFNETLINK_V0)
+	b = binary.BigEndian.AppendUint16(b, m.resID)
+
+	return append(b, m.data...)
+}
+
+// netlinkConn is a minimal client for the netfilter netlink subsystems.
+type netlinkConn struct {
+	fd  int
+	seq uint32
+	// If set, called with the name and duration of each request
+	observe func(name string, d time.Duration)
+	// Prefix of the names passed to observe
+	name string
+}
+
+func (c *netlinkConn) timed(name string, t time.Time) {
+	if c.observe != nil {
+		c.observe(c.name+"-"+name, time.Since(t))
+	}
+}
+
+// execute sends messages, requesting an acknowledgement for each of them. If
+// batch is set, the messages are applied in a single nf_tables transaction.
+// The first error reported is returned.
+func (c *netlinkConn) execute(ms []*netlinkMessage, batch bool) error {
+	defer c.timed("netlink", time.Now())
+
+	b := make([]byte, 0)
+	pending := make(map[uint32]bool)
+	first := c.seq + 1
+	if batch {
+		c.seq++
+		b = append(b, (&netlinkMessage{typ: unix.NFNL_MSG_BATCH_BEGIN, flags: unix.NLM_F_REQUEST, resID: unix.NFNL_SUBSYS_NFTABLES}).marshal(c.seq)...)
+	}
+	for _, m := range ms {
+		c.seq++
+		mm := *m
+		mm.flags |= unix.NLM_F_REQUEST | unix.NLM_F_ACK
+		b = append(b, mm.marshal(c.seq)...)
+		pending[c.seq] = true
+	}
+	if batch {
+		c.seq++
+		b = append(b, (&netlinkMessage{typ: unix.NFNL_MSG_BATCH_END, flags: unix.NLM_F_REQUEST, resID: unix.NFNL_SUBSYS_NFTABLES}).marshal(c.seq)...)
+	}
+
+	if err := unix.Sendto(c.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	var ferr error
+	for len(pending) > 0 {
+		rms, err := c.receive()
+		if err != nil {
+			return err
+		}
+		for _, rm := range rms {
+			if rm.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(rm.Data) < 4 {
+				return errors.New("truncated netlink error message")
+			}
+			errno := -int32(binary.NativeEndian.Uint32(rm.Data[0:4]))
+			if rm.Header.Seq < first {
+				// Stale
+				continue
+			}
+			if !pending[rm.Header.Seq] {
+				if errno != 0 {
+					// Errors concerning the batch itself
+					return syscall.Errno(errno)
+				}
+				continue
+			}
+			delete(pending, rm.Header.Seq)
+			if errno != 0 && ferr == nil {
+				ferr = syscall.Errno(errno)
+			}
+		}
+	}
+
+	return ferr
+}
+
+// dump sends a dump request and returns the payloads of all messages received
+// in reply, excluding their netfilter headers.
+func (c *netlinkConn) dump(m *netlinkMessage) ([][]byte, error) {
+	defer c.timed("netlink-dump", time.Now())
+
+	c.seq++
+	mm := *m
+	mm.flags |= unix.NLM_F_REQUEST | unix.NLM_F_DUMP
+	if err := unix.Sendto(c.fd, mm.marshal(c.seq), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	ps := make([][]byte, 0)
+	for {
+		rms, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		for _, rm := range rms {
+			if rm.Header.Seq != c.seq {
+				continue
+			}
+			switch rm.Header.Type {
+			case unix.NLMSG_DONE:
+				return ps, nil
+			case unix.NLMSG_ERROR:
+				if len(rm.Data) < 4 {
+					return nil, errors.New("truncated netlink error message")
+				}
+				if errno := -int32(binary.NativeEndian.Uint32(rm.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+				return ps, nil
+			}
+			if len(rm.Data) < netlinkNfgenmsgLen {
+				return nil, errors.New("truncated netfilter message")
+			}
+			ps = append(ps, rm.Data[netlinkNfgenmsgLen:])
+			if rm.Header.Flags&unix.NLM_F_MULTI == 0 {
+				return ps, nil
+			}
+		}
+	}
+}
+
+func (c *netlinkConn) receive() ([]syscall.NetlinkMessage, error) {
+	b := make([]byte, netlinkBufferSize)
+	n, _, err := unix.Recvfrom(c.fd, b, 0)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) {
+			return nil, errors.New("timed out waiting for netlink reply")
+		}
+		return nil, err
+	}
+
+	return syscall.ParseNetlinkMessage(b[:n])
+}
+
+func (c *netlinkConn) close() error {
+	return unix.Close(c.fd)
+}
+
+func newNetlinkConn() (*netlinkConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+
+	tv := unix.NsecToTimeval(netlinkTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+
+	return &netlinkConn{fd: fd}, nil
+}
@@ -0,0 +1,43 @@
+package gerberos
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNetlinkAttributes(t *testing.T) {
+	b := netlinkConcat(
+		netlinkAttrString(1, "abc"),
+		netlinkAttrNested(2, netlinkAttrU32(3, 7), netlinkAttrU64(4, 8)),
+	)
+	if len(b)%4 != 0 {
+		t.Errorf("expected aligned attributes, got length %d", len(b))
+	}
+
+	as, err := parseNetlinkAttributes(b)
+	testNoError(t, err)
+	if len(as) != 2 {
+		t.Fatalf("expected 2 attributes, got %d", len(as))
+	}
+	if as[0].typ != 1 || !bytes.Equal(as[0].data, []byte("abc\x00")) {
+		t.Errorf("unexpected attribute: %v", as[0])
+	}
+	if as[1].typ != 2 {
+		t.Errorf("expected nested flag to be removed, got type %d", as[1].typ)
+	}
+
+	ns, err := parseNetlinkAttributes(as[1].data)
+	testNoError(t, err)
+	if len(ns) != 2 {
+		t.Fatalf("expected 2 nested attributes, got %d", len(ns))
+	}
+	if !bytes.Equal(ns[0].data, []byte{0, 0, 0, 7}) {
+		t.Errorf("expected big-endian value, got %v", ns[0].data)
+	}
+	if !bytes.Equal(ns[1].data, []byte{0, 0, 0, 0, 0, 0, 0, 8}) {
+		t.Errorf("expected big-endian value, got %v", ns[1].data)
+	}
+
+	_, err = parseNetlinkAttributes([]byte{16, 0, 1, 0, 0})
+	testError(t, err)
+}
@@ -0,0 +1,554 @@
+package gerberos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nftables data types
+	nftTypeIPv4Addr    = 7
+	nftTypeIPv6Addr    = 8
+	nftTypeInetProto   = 12
+	nftTypeInetService = 13
+	// Bits per type within the type of concatenations
+	nftTypeBits = 6
+	// Protocols and ports each take a 32-bit register within keys
+	nftPortKeyLen = 8
+
+	nftVerdictDrop   = 0
+	nftVerdictAccept = 1
+)
+
+var nftNetlinkHooks = map[string]uint32{
+	"input":      unix.NF_INET_LOCAL_IN,
+	"forward":    unix.NF_INET_FORWARD,
+	"prerouting": unix.NF_INET_PRE_ROUTING,
+}
+
+// nftNetlinkFamily describes the table of an address family.
+type nftNetlinkFamily struct {
+	family      uint8
+	table       string
+	hostSet     string
+	netSet      string
+	portSet     string
+	keyType     uint32
+	addrLen     int
+	saddrOffset uint32
+	ipv6        bool
+}
+
+// nftNetlinkBackend manages nftables through netlink instead of the nft
+// binary. Tables, sets, chains and rules are created in a single transaction.
+type nftNetlinkBackend struct {
+	runner   *Runner
+	mutex    sync.Mutex
+	conn     *netlinkConn
+	families []*nftNetlinkFamily
+	setID    uint32
+}
+
+func (b *nftNetlinkBackend) family(ipv6 bool) *nftNetlinkFamily {
+	if ipv6 {
+		return b.families[1]
+	}
+
+	return b.families[0]
+}
+
+func nftNetlinkExpr(n string, as ...[]byte) []byte {
+	return netlinkAttrNested(unix.NFTA_LIST_ELEM,
+		netlinkAttrString(unix.NFTA_EXPR_NAME, n),
+		netlinkAttrNested(unix.NFTA_EXPR_DATA, as...),
+	)
+}
+
+// verdict returns the expressions following the lookup of rules.
+func (b *nftNetlinkBackend) verdict(f *nftNetlinkFamily) [][]byte {
+	fw := &b.runner.configuration.Firewall
+	drop := nftNetlinkExpr("immediate",
+		netlinkAttrU32(unix.NFTA_IMMEDIATE_DREG, unix.NFT_REG_VERDICT),
+		netlinkAttrNested(unix.NFTA_IMMEDIATE_DATA,
+			netlinkAttrNested(unix.NFTA_DATA_VERDICT,
+				netlinkAttrU32(unix.NFTA_VERDICT_CODE, nftVerdictDrop),
+			),
+		),
+	)
+	switch fw.verdict {
+	case "reject":
+		c := fw.reject().code
+		if f.ipv6 {
+			c = fw.reject().code6
+		}
+		return [][]byte{nftNetlinkExpr("reject",
+			netlinkAttrU32(unix.NFTA_REJECT_TYPE, unix.NFT_REJECT_ICMP_UNREACH),
+			netlinkAttr(unix.NFTA_REJECT_ICMP_CODE, []byte{c}),
+		)}
+	case "log":
+		return [][]byte{
+			nftNetlinkExpr("log", netlinkAttrString(unix.NFTA_LOG_PREFIX, fw.logPrefix)),
+			drop,
+		}
+	}
+
+	return [][]byte{drop}
+}
+
+func (b *nftNetlinkBackend) tableMessages(f *nftNetlinkFamily) []*netlinkMessage {
+	msg := func(t uint16, flags uint16, as ...[]byte) *netlinkMessage {
+		return &netlinkMessage{
+			typ:    unix.NFNL_SUBSYS_NFTABLES<<8 | t,
+			flags:  flags,
+			family: f.family,
+			data:   netlinkConcat(as...),
+		}
+	}
+	tn := netlinkAttrString(unix.NFTA_TABLE_NAME, f.table)
+
+	ms := []*netlinkMessage{
+		// Adding the table before deleting it makes sure it exists. This way,
+		// tables are recreated without elements left over.
+		msg(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, tn),
+		msg(unix.NFT_MSG_DELTABLE, 0, tn),
+		msg(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, tn),
+	}
+
+	ids := make(map[string]uint32)
+	for _, s := range []string{f.hostSet, f.netSet, f.portSet} {
+		fl := uint32(unix.NFT_SET_TIMEOUT)
+		kt, kl := f.keyType, f.addrLen
+		switch s {
+		case f.netSet:
+			fl |= unix.NFT_SET_INTERVAL
+		case f.portSet:
+			// Concatenation of address, protocol and port
+			kt = (kt<<nftTypeBits|nftTypeInetProto)<<nftTypeBits | nftTypeInetService
+			kl += nftPortKeyLen
+		}
+		b.setID++
+		ids[s] = b.setID
+		ms = append(ms, msg(unix.NFT_MSG_NEWSET, unix.NLM_F_CREATE,
+			netlinkAttrString(unix.NFTA_SET_TABLE, f.table),
+			netlinkAttrString(unix.NFTA_SET_NAME, s),
+			netlinkAttrU32(unix.NFTA_SET_FLAGS, fl),
+			netlinkAttrU32(unix.NFTA_SET_KEY_TYPE, kt),
+			netlinkAttrU32(unix.NFTA_SET_KEY_LEN, uint32(kl)),
+			netlinkAttrU32(unix.NFTA_SET_ID, b.setID),
+		))
+	}
+
+	fw := &b.runner.configuration.Firewall
+	for _, h := range fw.Hooks {
+		ms = append(ms, msg(unix.NFT_MSG_NEWCHAIN, unix.NLM_F_CREATE,
+			netlinkAttrString(unix.NFTA_CHAIN_TABLE, f.table),
+			netlinkAttrString(unix.NFTA_CHAIN_NAME, h),
+			netlinkAttrNested(unix.NFTA_CHAIN_HOOK,
+				netlinkAttrU32(unix.NFTA_HOOK_HOOKNUM, nftNetlinkHooks[h]),
+				netlinkAttrU32(unix.NFTA_HOOK_PRIORITY, uint32(fw.Priority)),
+			),
+			netlinkAttrString(unix.NFTA_CHAIN_TYPE, "filter"),
+			netlinkAttrU32(unix.NFTA_CHAIN_POLICY, nftVerdictAccept),
+		))
+
+		for _, s := range []string{f.hostSet, f.netSet} {
+			es := [][]byte{
+				// Source address
+				nftNetlinkExpr("payload",
+					netlinkAttrU32(unix.NFTA_PAYLOAD_DREG, unix.NFT_REG_1),
+					netlinkAttrU32(unix.NFTA_PAYLOAD_BASE, unix.NFT_PAYLOAD_NETWORK_HEADER),
+					netlinkAttrU32(unix.NFTA_PAYLOAD_OFFSET, f.saddrOffset),
+					netlinkAttrU32(unix.NFTA_PAYLOAD_LEN, uint32(f.addrLen)),
+				),
+				nftNetlinkExpr("lookup",
+					netlinkAttrString(unix.NFTA_LOOKUP_SET, s),
+					netlinkAttrU32(unix.NFTA_LOOKUP_SET_ID, ids[s]),
+					netlinkAttrU32(unix.NFTA_LOOKUP_SREG, unix.NFT_REG_1),
+				),
+			}
+			ms = append(ms, msg(unix.NFT_MSG_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_APPEND,
+				netlinkAttrString(unix.NFTA_RULE_TABLE, f.table),
+				netlinkAttrString(unix.NFTA_RULE_CHAIN, h),
+				netlinkAttrNested(unix.NFTA_RULE_EXPRESSIONS, append(es, b.verdict(f)...)...),
+			))
+		}
+
+		// Keys of concatenations are assembled in consecutive 32-bit registers
+		r := uint32(unix.NFT_REG32_00)
+		es := [][]byte{
+			nftNetlinkExpr("payload",
+				netlinkAttrU32(unix.NFTA_PAYLOAD_DREG, r),
+				netlinkAttrU32(unix.NFTA_PAYLOAD_BASE, unix.NFT_PAYLOAD_NETWORK_HEADER),
+				netlinkAttrU32(unix.NFTA_PAYLOAD_OFFSET, f.saddrOffset),
+				netlinkAttrU32(unix.NFTA_PAYLOAD_LEN, uint32(f.addrLen)),
+			),
+			nftNetlinkExpr("meta",
+				netlinkAttrU32(unix.NFTA_META_DREG, r+uint32(f.addrLen/4)),
+				netlinkAttrU32(unix.NFTA_META_KEY, unix.NFT_META_L4PROTO),
+			),
+			// Destination port
+			nftNetlinkExpr("payload",
+				netlinkAttrU32(unix.NFTA_PAYLOAD_DREG, r+uint32(f.addrLen/4)+1),
+				netlinkAttrU32(unix.NFTA_PAYLOAD_BASE, unix.NFT_PAYLOAD_TRANSPORT_HEADER),
+				netlinkAttrU32(unix.NFTA_PAYLOAD_OFFSET, 2),
+				netlinkAttrU32(unix.NFTA_PAYLOAD_LEN, 2),
+			),
+			nftNetlinkExpr("lookup",
+				netlinkAttrString(unix.NFTA_LOOKUP_SET, f.portSet),
+				netlinkAttrU32(unix.NFTA_LOOKUP_SET_ID, ids[f.portSet]),
+				netlinkAttrU32(unix.NFTA_LOOKUP_SREG, r),
+			),
+		}
+		ms = append(ms, msg(unix.NFT_MSG_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_APPEND,
+			netlinkAttrString(unix.NFTA_RULE_TABLE, f.table),
+			netlinkAttrString(unix.NFTA_RULE_CHAIN, h),
+			netlinkAttrNested(unix.NFTA_RULE_EXPRESSIONS, append(es, b.verdict(f)...)...),
+		))
+	}
+
+	return ms
+}
+
+// elementMessage returns the message adding (or deleting) an element. Subnets
+// are added as intervals.
+func (b *nftNetlinkBackend) elementMessage(typ uint16, flags uint16, f *nftNetlinkFamily, n *net.IPNet, d time.Duration, p *port) *netlinkMessage {
+	s := f.hostSet
+	start := n.IP.To16()
+	if f.addrLen == net.IPv4len {
+		start = n.IP.To4()
+	}
+	if p != nil {
+		s = f.portSet
+		start = append(slices.Clone(start), portProtocols[p.protocol], 0, 0, 0, byte(p.number>>8), byte(p.number), 0, 0)
+	}
+	es := make([][]byte, 0)
+
+	e := [][]byte{netlinkAttrNested(unix.NFTA_SET_ELEM_KEY, netlinkAttr(unix.NFTA_DATA_VALUE, start))}
+	if d > 0 {
+		e = append(e, netlinkAttrU64(unix.NFTA_SET_ELEM_TIMEOUT, uint64(d.Milliseconds())))
+	}
+	es = append(es, netlinkAttrNested(unix.NFTA_LIST_ELEM, e...))
+
+	if p == nil && !isHostNet(n) {
+		s = f.netSet
+		// The end of an interval is the first address following it. It is
+		// omitted if the interval ends with the last address.
+		if end, ok := nextNet(n); ok {
+			es = append(es, netlinkAttrNested(unix.NFTA_LIST_ELEM,
+				netlinkAttrNested(unix.NFTA_SET_ELEM_KEY, netlinkAttr(unix.NFTA_DATA_VALUE, end)),
+				netlinkAttrU32(unix.NFTA_SET_ELEM_FLAGS, unix.NFT_SET_ELEM_INTERVAL_END),
+			))
+		}
+	}
+
+	return &netlinkMessage{
+		typ:    unix.NFNL_SUBSYS_NFTABLES<<8 | typ,
+		flags:  flags,
+		family: f.family,
+		data: netlinkConcat(
+			netlinkAttrString(unix.NFTA_SET_ELEM_LIST_TABLE, f.table),
+			netlinkAttrString(unix.NFTA_SET_ELEM_LIST_SET, s),
+			netlinkAttrNested(unix.NFTA_SET_ELEM_LIST_ELEMENTS, es...),
+		),
+	}
+}
+
+// nextNet returns the first address following a network and whether there is
+// one.
+func nextNet(n *net.IPNet) ([]byte, bool) {
+	ip := n.IP.To4()
+	if ip == nil {
+		ip = n.IP.To16()
+	}
+	e := make([]byte, len(ip))
+	for i := range ip {
+		e[i] = ip[i] | ^n.Mask[i]
+	}
+	for i := len(e) - 1; i >= 0; i-- {
+		e[i]++
+		if e[i] != 0 {
+			return e, true
+		}
+	}
+
+	return nil, false
+}
+
+func (b *nftNetlinkBackend) initialize() error {
+	fw := &b.runner.configuration.Firewall
+	if err := fw.initialize(nftHooks, "reject"); err != nil {
+		return fmt.Errorf("invalid firewall configuration: %w", err)
+	}
+
+	b.families = []*nftNetlinkFamily{
+		{
+			family:      unix.NFPROTO_IPV4,
+			table:       fw.Name + "4",
+			hostSet:     "set4",
+			netSet:      "net4",
+			portSet:     "port4",
+			keyType:     nftTypeIPv4Addr,
+			addrLen:     net.IPv4len,
+			saddrOffset: 12,
+		},
+		{
+			family:      unix.NFPROTO_IPV6,
+			table:       fw.Name + "6",
+			hostSet:     "set6",
+			netSet:      "net6",
+			portSet:     "port6",
+			keyType:     nftTypeIPv6Addr,
+			addrLen:     net.IPv6len,
+			saddrOffset: 8,
+			ipv6:        true,
+		},
+	}
+
+	c, err := newNetlinkConn()
+	if err != nil {
+		return err
+	}
+	c.name, c.observe = "nft", b.runner.observeDuration
+	b.conn = c
+
+	ms := make([]*netlinkMessage, 0)
+	for _, f := range b.families {
+		ms = append(ms, b.tableMessages(f)...)
+	}
+	if err := b.conn.execute(ms, true); err != nil {
+		b.conn.close()
+		if errors.Is(err, unix.EPERM) {
+			return fmt.Errorf("nftables: insufficient privileges: %w", err)
+		}
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	if b.runner.configuration.SaveFilePath != "" {
+		if err := restoreElements(b.runner.configuration.SaveFilePath, b.ban); err != nil {
+			log.Warn().Str("saveFilePath", b.runner.configuration.SaveFilePath).Err(err).Msg("failed to restore sets")
+		} else {
+			log.Info().Str("saveFilePath", b.runner.configuration.SaveFilePath).Msg("restored sets")
+		}
+	} else {
+		log.Warn().Msg("not persisting sets")
+	}
+
+	return nil
+}
+
+func (b *nftNetlinkBackend) ban(n *net.IPNet, ipv6 bool, d time.Duration, p *port) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.conn.execute([]*netlinkMessage{
+		b.elementMessage(unix.NFT_MSG_NEWSETELEM, unix.NLM_F_CREATE|unix.NLM_F_EXCL, b.family(ipv6), n, d, p),
+	}, true)
+	if errors.Is(err, unix.EEXIST) {
+		return errAlreadyBanned
+	}
+
+	return err
+}
+
+func (b *nftNetlinkBackend) unban(n *net.IPNet, ipv6 bool, p *port) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.conn.execute([]*netlinkMessage{
+		b.elementMessage(unix.NFT_MSG_DELSETELEM, 0, b.family(ipv6), n, 0, p),
+	}, true)
+	if errors.Is(err, unix.ENOENT) {
+		return errNotBanned
+	}
+
+	return err
+}
+
+func (b *nftNetlinkBackend) list() (map[string]time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.elements()
+}
+
+// elements returns all banned IPs and subnets along with their remaining
+// durations (zero if permanent).
+func (b *nftNetlinkBackend) elements() (map[string]time.Duration, error) {
+	es := make(map[string]time.Duration)
+	for _, f := range b.families {
+		for _, s := range []string{f.hostSet, f.netSet, f.portSet} {
+			ps, err := b.conn.dump(&netlinkMessage{
+				typ:    unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_GETSETELEM,
+				family: f.family,
+				data: netlinkConcat(
+					netlinkAttrString(unix.NFTA_SET_ELEM_LIST_TABLE, f.table),
+					netlinkAttrString(unix.NFTA_SET_ELEM_LIST_SET, s),
+				),
+			})
+			if err != nil {
+				return nil, fmt.Errorf(`failed to list elements of set "%s": %w`, s, err)
+			}
+			if err := parseNftElements(ps, f.addrLen, es); err != nil {
+				return nil, fmt.Errorf(`failed to parse elements of set "%s": %w`, s, err)
+			}
+		}
+	}
+
+	return es, nil
+}
+
+type nftElement struct {
+	key     []byte
+	end     bool
+	expires time.Duration
+}
+
+// parseNftElements parses dumped set elements. Intervals are converted back
+// into subnets.
+func parseNftElements(ps [][]byte, addrLen int, es map[string]time.Duration) error {
+	nes := make([]*nftElement, 0)
+	for _, p := range ps {
+		as, err := parseNetlinkAttributes(p)
+		if err != nil {
+			return err
+		}
+		for _, a := range as {
+			if a.typ != unix.NFTA_SET_ELEM_LIST_ELEMENTS {
+				continue
+			}
+			ls, err := parseNetlinkAttributes(a.data)
+			if err != nil {
+				return err
+			}
+			for _, l := range ls {
+				e, err := parseNftElement(l.data)
+				if err != nil {
+					return err
+				}
+				switch len(e.key) {
+				case addrLen:
+					nes = append(nes, e)
+				case addrLen + nftPortKeyLen:
+					k := e.key[addrLen:]
+					p, err := protocolPort(k[0], uint16(k[4])<<8|uint16(k[5]))
+					if err != nil {
+						return err
+					}
+					es[portElement(hostNet(net.IP(e.key[:addrLen])), p)] = e.expires
+				}
+			}
+		}
+	}
+
+	ends := make([][]byte, 0)
+	for _, e := range nes {
+		if e.end {
+			ends = append(ends, e.key)
+		}
+	}
+	slices.SortFunc(ends, bytes.Compare)
+
+	for _, e := range nes {
+		if e.end {
+			continue
+		}
+		n := &net.IPNet{IP: net.IP(e.key), Mask: net.CIDRMask(addrLen*8, addrLen*8)}
+		if len(ends) > 0 {
+			// Size of the interval up to the next end
+			sz := new(big.Int).Lsh(big.NewInt(1), uint(addrLen*8))
+			i, _ := slices.BinarySearchFunc(ends, e.key, bytes.Compare)
+			if i < len(ends) && bytes.Equal(ends[i], e.key) {
+				i++
+			}
+			if i < len(ends) {
+				sz.SetBytes(ends[i])
+			}
+			sz.Sub(sz, new(big.Int).SetBytes(e.key))
+			n.Mask = net.CIDRMask(addrLen*8-sz.BitLen()+1, addrLen*8)
+		}
+		es[netElement(n)] = e.expires
+	}
+
+	return nil
+}
+
+func parseNftElement(b []byte) (*nftElement, error) {
+	as, err := parseNetlinkAttributes(b)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &nftElement{}
+	for _, a := range as {
+		switch a.typ {
+		case unix.NFTA_SET_ELEM_KEY:
+			ks, err := parseNetlinkAttributes(a.data)
+			if err != nil {
+				return nil, err
+			}
+			for _, k := range ks {
+				if k.typ == unix.NFTA_DATA_VALUE {
+					e.key = k.data
+				}
+			}
+		case unix.NFTA_SET_ELEM_FLAGS:
+			if len(a.data) == 4 {
+				e.end = binary.BigEndian.Uint32(a.data)&unix.NFT_SET_ELEM_INTERVAL_END != 0
+			}
+		case unix.NFTA_SET_ELEM_EXPIRATION:
+			if len(a.data) == 8 {
+				e.expires = time.Duration(binary.BigEndian.Uint64(a.data)) * time.Millisecond
+			}
+		}
+	}
+	if e.key == nil {
+		return nil, errors.New("missing key")
+	}
+
+	return e, nil
+}
+
+func (b *nftNetlinkBackend) save() error {
+	es, err := b.elements()
+	if err != nil {
+		return err
+	}
+
+	return saveElements(b.runner.configuration.SaveFilePath, es)
+}
+
+func (b *nftNetlinkBackend) finalize() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	defer b.conn.close()
+
+	if b.runner.configuration.SaveFilePath != "" {
+		if err := b.save(); err != nil {
+			return fmt.Errorf(`failed to save sets to "%s": %w`, b.runner.configuration.SaveFilePath, err)
+		}
+	}
+
+	ms := make([]*netlinkMessage, 0)
+	for _, f := range b.families {
+		ms = append(ms, &netlinkMessage{
+			typ:    unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_DELTABLE,
+			family: f.family,
+			data:   netlinkAttrString(unix.NFTA_TABLE_NAME, f.table),
+		})
+	}
+	if err := b.conn.execute(ms, true); err != nil {
+		return fmt.Errorf("failed to delete tables: %w", err)
+	}
+
+	return nil
+}
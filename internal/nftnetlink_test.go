@@ -0,0 +1,188 @@
+package gerberos
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNextNet(t *testing.T) {
+	for _, c := range []struct {
+		cidr string
+		next string
+	}{
+		{"10.0.0.0/24", "10.0.1.0"},
+		{"10.0.255.0/24", "10.1.0.0"},
+		{"2001:db8::/64", "2001:db8:0:1::"},
+		{"255.255.255.0/24", ""},
+	} {
+		_, n, _ := net.ParseCIDR(c.cidr)
+		e, ok := nextNet(n)
+		if c.next == "" {
+			if ok {
+				t.Errorf("%s: expected no next address, got %s", c.cidr, net.IP(e))
+			}
+			continue
+		}
+		if !ok || !net.IP(e).Equal(net.ParseIP(c.next)) {
+			t.Errorf("%s: expected %s, got %s", c.cidr, c.next, net.IP(e))
+		}
+	}
+}
+
+func TestParseElement(t *testing.T) {
+	for _, s := range []string{"1.2.3.4", "10.0.0.0/8", "::1", "2001:db8::/32", "1.2.3.4,tcp:22", "::1,udp:53"} {
+		n, p, err := parseElement(s)
+		testNoError(t, err)
+		if n != nil && portElement(n, p) != s {
+			t.Errorf("expected %s, got %s", s, portElement(n, p))
+		}
+	}
+	for _, s := range []string{"invalid", "1.2.3.4,tcp", "1.2.3.4,icmp:1", "1.2.3.4,tcp:0", "1.2.3.4,tcp:65536", "invalid,tcp:22"} {
+		_, _, err := parseElement(s)
+		testError(t, err)
+	}
+}
+
+func TestNftNetlinkBackend(t *testing.T) {
+	if !testInNetworkNamespace(t) {
+		return
+	}
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.configuration.SaveFilePath = filepath.Join(t.TempDir(), "save")
+	b := &nftNetlinkBackend{runner: rn}
+	if err := b.initialize(); err != nil {
+		t.Skipf("nftables not available: %s", err)
+	}
+
+	_, n4, _ := net.ParseCIDR("10.1.0.0/16")
+	_, n6, _ := net.ParseCIDR("2001:db8::/48")
+	testNoError(t, b.ban(hostNet(net.ParseIP("1.2.3.4")), false, time.Hour, nil))
+	testNoError(t, b.ban(hostNet(net.ParseIP("::1")), true, 0, nil))
+	testNoError(t, b.ban(n4, false, time.Hour, nil))
+	testNoError(t, b.ban(n6, true, 0, nil))
+	testNoError(t, b.ban(hostNet(net.ParseIP("1.2.3.4")), false, time.Hour, &port{"tcp", 22}))
+	testNoError(t, b.ban(hostNet(net.ParseIP("::1")), true, 0, &port{"udp", 53}))
+	if err := b.ban(hostNet(net.ParseIP("1.2.3.4")), false, time.Hour, &port{"tcp", 22}); !errors.Is(err, errAlreadyBanned) {
+		t.Errorf("expected errAlreadyBanned, got %v", err)
+	}
+	if err := b.ban(hostNet(net.ParseIP("1.2.3.4")), false, time.Hour, nil); !errors.Is(err, errAlreadyBanned) {
+		t.Errorf("expected errAlreadyBanned, got %v", err)
+	}
+
+	exp := map[string]bool{
+		"1.2.3.4":        true,
+		"::1":            false,
+		"10.1.0.0/16":    true,
+		"2001:db8::/48":  false,
+		"1.2.3.4,tcp:22": true,
+		"::1,udp:53":     false,
+	}
+	check := func() {
+		t.Helper()
+		es, err := b.elements()
+		testNoError(t, err)
+		if len(es) != len(exp) {
+			t.Errorf("expected %d elements, got %v", len(exp), es)
+		}
+		for e, expires := range exp {
+			d, ok := es[e]
+			if !ok {
+				t.Errorf("expected element %s", e)
+			} else if expires != (d > 0) {
+				t.Errorf("unexpected duration of element %s: %s", e, d)
+			}
+		}
+	}
+	check()
+	testNoError(t, b.finalize())
+
+	// Restored from save file
+	b = &nftNetlinkBackend{runner: rn}
+	testNoError(t, b.initialize())
+	check()
+
+	// Lifted bans
+	testNoError(t, b.unban(n4, false, nil))
+	testNoError(t, b.unban(hostNet(net.ParseIP("::1")), true, &port{"udp", 53}))
+	if err := b.unban(n4, false, nil); !errors.Is(err, errNotBanned) {
+		t.Errorf("expected errNotBanned, got %v", err)
+	}
+	delete(exp, "10.1.0.0/16")
+	delete(exp, "::1,udp:53")
+	es, err := b.list()
+	testNoError(t, err)
+	if len(es) != len(exp) {
+		t.Errorf("expected %d elements, got %v", len(exp), es)
+	}
+	testNoError(t, b.finalize())
+}
+
+func TestNftNetlinkBackendFirewall(t *testing.T) {
+	if !testInNetworkNamespace(t) {
+		return
+	}
+
+	for _, fw := range []firewall{
+		{Name: "a", Hooks: []string{"input", "forward"}, Priority: -10, Verdict: []string{"reject", "host-unreachable"}},
+		{Name: "b", Hooks: []string{"prerouting"}, Priority: -300, Verdict: []string{"log"}},
+		{Name: "c", Verdict: []string{"drop"}},
+	} {
+		rn, err := newTestRunner()
+		testNoError(t, err)
+		rn.configuration.Firewall = fw
+		b := &nftNetlinkBackend{runner: rn}
+		if err := b.initialize(); err != nil {
+			t.Errorf("failed to initialize backend with firewall %s: %s", fw.Name, err)
+			continue
+		}
+		testNoError(t, b.ban(hostNet(net.ParseIP("1.2.3.4")), false, time.Hour, nil))
+		testNoError(t, b.finalize())
+	}
+}
+
+func TestNftNetlinkBackendBlocks(t *testing.T) {
+	if !testInNetworkNamespace(t) {
+		return
+	}
+	if o, err := exec.Command("ip", "link", "set", "lo", "up").CombinedOutput(); err != nil {
+		t.Skipf("failed to set up loopback interface: %s", o)
+	}
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	b := &nftNetlinkBackend{runner: rn}
+	testNoError(t, b.initialize())
+	defer func() {
+		testNoError(t, b.finalize())
+	}()
+
+	dial := func(a string) error {
+		c, err := net.DialTimeout("tcp", a, 500*time.Millisecond)
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	for _, a := range []string{"127.0.0.1:8080", "127.0.0.1:8081", "127.0.0.2:8080"} {
+		l, err := net.Listen("tcp", a)
+		testNoError(t, err)
+		defer l.Close()
+		testNoError(t, dial(a))
+	}
+
+	testNoError(t, b.ban(hostNet(net.ParseIP("127.0.0.1")), false, time.Hour, &port{"tcp", 8080}))
+	testError(t, dial("127.0.0.1:8080"))
+	testNoError(t, dial("127.0.0.1:8081"))
+
+	// Connections to 127.0.0.2 originate from 127.0.0.1 as well
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	testNoError(t, b.ban(n, false, time.Hour, nil))
+	testError(t, dial("127.0.0.2:8080"))
+	testError(t, dial("127.0.0.1:8081"))
+}
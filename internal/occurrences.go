@@ -2,6 +2,7 @@ package gerberos
 
 import (
 	"net"
+	"slices"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -13,9 +14,10 @@ type occurrences struct {
 	count    int
 }
 
-func (o *occurrences) add(ip net.IP) bool {
+// add records an occurrence of the IP at the given time and reports whether
+// the count has been reached within the interval.
+func (o *occurrences) add(ip net.IP, t time.Time) bool {
 	ips := ip.String()
-	t := time.Now()
 
 	log.Debug().IPAddr("ip", ip).Int("length", len(o.registry[ips])).Msg("updating occurrences")
 
@@ -24,7 +26,10 @@ func (o *occurrences) add(ip net.IP) bool {
 		return false
 	}
 
-	o.registry[ips] = append(o.registry[ips], t)
+	// Kept in order, lines may arrive out of order or be backdated
+	ts := o.registry[ips]
+	i, _ := slices.BinarySearchFunc(ts, t, time.Time.Compare)
+	o.registry[ips] = slices.Insert(ts, i, t)
 	if len(o.registry[ips]) > o.count {
 		o.registry[ips] = o.registry[ips][1:]
 	}
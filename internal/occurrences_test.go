@@ -11,27 +11,49 @@ func TestOccurrencesFlaky(t *testing.T) {
 
 	o := newTestOccurrences()
 	for i := 0; i < 9; i++ {
-		if o.add(h) {
+		if o.add(h, time.Now()) {
 			t.Error("unexpected result")
 		}
 	}
-	if !o.add(h) {
+	if !o.add(h, time.Now()) {
 		t.Error("unexpected result")
 	}
 
 	o = newTestOccurrences()
 	for i := 0; i < 5; i++ {
-		if o.add(h) {
+		if o.add(h, time.Now()) {
 			t.Error("unexpected result")
 		}
 	}
 	time.Sleep(100 * time.Millisecond)
 	for i := 0; i < 9; i++ {
-		if o.add(h) {
+		if o.add(h, time.Now()) {
 			t.Error("unexpected result")
 		}
 	}
-	if !o.add(h) {
+	if !o.add(h, time.Now()) {
 		t.Error("unexpected result")
 	}
 }
+
+func TestOccurrencesOutOfOrder(t *testing.T) {
+	h := net.ParseIP("192.0.2.1")
+	n := time.Now()
+
+	o := newOccurrences(time.Minute, 3)
+	for _, d := range []time.Duration{10 * time.Minute, 20 * time.Minute, 0} {
+		if o.add(h, n.Add(d)) {
+			t.Errorf("unexpected result for occurrence at +%s", d)
+		}
+	}
+
+	o = newOccurrences(time.Minute, 3)
+	for _, d := range []time.Duration{30 * time.Second, time.Minute} {
+		if o.add(h, n.Add(d)) {
+			t.Errorf("unexpected result for occurrence at +%s", d)
+		}
+	}
+	if !o.add(h, n) {
+		t.Error("expected backdated occurrence within interval to count")
+	}
+}
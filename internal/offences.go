@@ -0,0 +1,143 @@
+package gerberos
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// offence records a ban of an IP.
+type offence struct {
+	Rule string
+	Time time.Time
+}
+
+// offenceStore keeps the history of bans per IP or subnet. Offences older than the
+// retention are discarded.
+type offenceStore struct {
+	path      string
+	mutex     sync.Mutex
+	retention time.Duration
+	offences  map[string][]*offence
+}
+
+type offenceStoreFile struct {
+	Offences map[string][]*offence
+}
+
+func (s *offenceStore) load() error {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	f := offenceStoreFile{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if f.Offences != nil {
+		s.offences = f.Offences
+	}
+
+	return nil
+}
+
+func (s *offenceStore) save() error {
+	s.mutex.Lock()
+	s.prune()
+	b, err := json.Marshal(offenceStoreFile{
+		Offences: s.offences,
+	})
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(s.path, b)
+}
+
+// prune discards expired offences. The mutex must be held.
+func (s *offenceStore) prune() {
+	for ip := range s.offences {
+		s.pruneIP(ip)
+	}
+}
+
+func (s *offenceStore) pruneIP(ip string) {
+	t := time.Now().Add(-s.retention)
+	ofs := s.offences[ip]
+	i := 0
+	for i < len(ofs) && ofs[i].Time.Before(t) {
+		i++
+	}
+	if i == len(ofs) {
+		delete(s.offences, ip)
+	} else {
+		s.offences[ip] = ofs[i:]
+	}
+}
+
+// retain makes sure offences are kept for at least the given duration.
+func (s *offenceStore) retain(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.retention = max(s.retention, d)
+}
+
+// count returns the number of offences of an IP within the window.
+func (s *offenceStore) count(ip string, window time.Duration) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	t := time.Now().Add(-window)
+	c := 0
+	for _, o := range s.offences[ip] {
+		if !o.Time.Before(t) {
+			c++
+		}
+	}
+
+	return c
+}
+
+// distinct returns the number of distinct IPs within a network having
+// offences within the window, including the given IP.
+func (s *offenceStore) distinct(n *net.IPNet, window time.Duration, ip string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	t := time.Now().Add(-window)
+	c := 1
+	for k, ofs := range s.offences {
+		if k == ip || len(ofs) == 0 || ofs[len(ofs)-1].Time.Before(t) {
+			continue
+		}
+		// Keys of subnets are not parsed
+		if i := net.ParseIP(k); i != nil && n.Contains(i) {
+			c++
+		}
+	}
+
+	return c
+}
+
+func (s *offenceStore) add(ip string, o *offence) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.offences[ip] = append(s.offences[ip], o)
+	s.pruneIP(ip)
+}
+
+func newOffenceStore(path string) *offenceStore {
+	return &offenceStore{
+		path:     path,
+		offences: make(map[string][]*offence),
+	}
+}
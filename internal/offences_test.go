@@ -0,0 +1,82 @@
+package gerberos
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOffenceStore(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "offences")
+
+	s := newOffenceStore(p)
+	s.retain(time.Hour)
+	s.retain(time.Minute)
+	if s.retention != time.Hour {
+		t.Errorf("expected retention of 1h, got %s", s.retention)
+	}
+
+	s.add("1.2.3.4", &offence{Rule: "a", Time: time.Now().Add(-2 * time.Hour)})
+	s.add("1.2.3.4", &offence{Rule: "a", Time: time.Now().Add(-30 * time.Minute)})
+	s.add("1.2.3.4", &offence{Rule: "b", Time: time.Now()})
+	s.add("::1", &offence{Rule: "a", Time: time.Now()})
+	if c := s.count("1.2.3.4", time.Hour); c != 2 {
+		t.Errorf("expected 2 offences, got %d", c)
+	}
+	if c := s.count("1.2.3.4", time.Minute); c != 1 {
+		t.Errorf("expected 1 offence, got %d", c)
+	}
+	if c := s.count("5.6.7.8", time.Hour); c != 0 {
+		t.Errorf("expected no offence, got %d", c)
+	}
+	testNoError(t, s.save())
+
+	s = newOffenceStore(p)
+	testNoError(t, s.load())
+	if c := s.count("1.2.3.4", time.Hour); c != 2 {
+		t.Errorf("expected 2 offences after loading, got %d", c)
+	}
+	if c := s.count("::1", time.Hour); c != 1 {
+		t.Errorf("expected 1 offence after loading, got %d", c)
+	}
+
+	// Expired offences are discarded
+	s.retention = time.Minute
+	s.mutex.Lock()
+	s.prune()
+	s.mutex.Unlock()
+	if len(s.offences["1.2.3.4"]) != 1 {
+		t.Errorf("expected expired offences to be discarded, got %d", len(s.offences["1.2.3.4"]))
+	}
+}
+
+func TestOffenceStoreLoadInvalid(t *testing.T) {
+	s := newOffenceStore("test/invalid_configuration.toml")
+	testError(t, s.load())
+	s = newOffenceStore("test/unknown")
+	testError(t, s.load())
+}
+
+func TestRunnerSaveOffencesRegularly(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.saveInterval = 10 * time.Millisecond
+	rn.offences = newOffenceStore(filepath.Join(t.TempDir(), "gerberos.save.offences"))
+	rn.offences.retain(time.Hour)
+	rn.offences.add("1.2.3.4", &offence{Rule: "a", Time: time.Now()})
+	done := make(chan bool)
+	go func() {
+		rn.saveRegularly()
+		done <- true
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	rn.stop()
+	<-done
+	s := newOffenceStore(rn.offences.path)
+	s.retain(time.Hour)
+	testNoError(t, s.load())
+	if c := s.count("1.2.3.4", time.Hour); c != 1 {
+		t.Errorf("expected 1 offence, got %d", c)
+	}
+}
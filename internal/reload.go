@@ -0,0 +1,136 @@
+package gerberos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// definition encodes the options of the rule.
+func (r *rule) definition() string {
+	b, _ := json.Marshal(r)
+
+	return string(b)
+}
+
+// rules returns the current rules.
+func (rn *Runner) rules() map[string]*rule {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+
+	rs := make(map[string]*rule, len(rn.configuration.Rules))
+	for n, r := range rn.configuration.Rules {
+		rs[n] = r
+	}
+
+	return rs
+}
+
+// reloadSourceTimeout is how long a reload waits for stopped sources to
+// release their resources before spawning new workers.
+const reloadSourceTimeout = 10 * time.Second
+
+// reload reads the configuration file again and applies its rules. Rules
+// with unchanged options keep running along with their sources and
+// occurrences. Workers of removed and changed rules are stopped, those of new
+// and changed rules are spawned once the sources no longer used are stopped.
+// Sources are kept as long as any rule uses them. The ignore list is replaced
+// as well. Nothing is changed unless the ignore list and all rules are valid.
+// The backend and all other values are kept as they are.
+func (rn *Runner) reload(requeue bool) error {
+	if rn.configuration.path == "" {
+		return errors.New("configuration has not been read from a file")
+	}
+
+	c := &Configuration{}
+	if err := c.ReadFile(rn.configuration.path); err != nil {
+		return err
+	}
+	if c.settings() != rn.settings {
+		log.Warn().Msg("changes of values other than rules and the ignore list require a restart")
+	}
+	il, err := newIgnoreList(c.Ignore)
+	if err != nil {
+		return fmt.Errorf("failed to initialize ignore list: %w", err)
+	}
+
+	ors := rn.rules()
+	rs := make(map[string]*rule)
+	for n, r := range c.Rules {
+		if o, ok := ors[n]; ok && o.definition() == r.definition() {
+			rs[n] = o
+		}
+	}
+
+	// New rules share the current sources with identical definitions
+	kss := rn.sources
+	rn.sources = make(map[string]*sharedSource, len(kss))
+	for k, s := range kss {
+		rn.sources[k] = s
+	}
+	ns := make([]*rule, 0)
+	for n, r := range c.Rules {
+		if _, ok := rs[n]; ok {
+			continue
+		}
+		r.name = n
+		if err := r.initialize(rn); err != nil {
+			r.stop()
+			for _, nr := range ns {
+				nr.stop()
+			}
+			for k, s := range rn.sources {
+				if kss[k] != s {
+					s.stop()
+				}
+			}
+			rn.sources = kss
+			return fmt.Errorf(`failed to initialize rule "%s": %s`, n, err)
+		}
+		ns = append(ns, r)
+		rs[n] = r
+	}
+
+	ss := make(map[string]*sharedSource)
+	for _, r := range rs {
+		ss[r.sourceKey()] = r.sharedSource
+	}
+	rn.sources = ss
+
+	rn.mutex.Lock()
+	rn.configuration.Rules = rs
+	rn.configuration.Ignore = c.Ignore
+	rn.mutex.Unlock()
+	rn.ignore.Store(il)
+
+	stopped := 0
+	// Sources not used by any rule anymore, along with a rule having used them
+	uss := make(map[*sharedSource]string)
+	for n, o := range ors {
+		if rs[n] != o {
+			o.stop()
+			stopped++
+			if ss[o.sourceKey()] != o.sharedSource {
+				uss[o.sharedSource] = n
+			}
+		}
+	}
+	for s := range uss {
+		s.stop()
+	}
+	// New sources may reuse addresses of the stopped ones
+	for s, n := range uss {
+		if !s.wait(reloadSourceTimeout) {
+			log.Warn().Str("rule", n).Msg("timed out waiting for source to stop")
+		}
+	}
+	for _, r := range ns {
+		rn.spawnWorker(r, requeue)
+	}
+	log.Info().Int("kept", len(rs)-len(ns)).Int("stopped", stopped).Int("spawned", len(ns)).Msg("reloaded configuration")
+
+	return nil
+}
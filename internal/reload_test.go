@@ -0,0 +1,195 @@
+package gerberos
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunnerReload(t *testing.T) {
+	d := t.TempDir()
+	cp, a, b := filepath.Join(d, "gerberos.toml"), filepath.Join(d, "a.log"), filepath.Join(d, "b.log")
+	write := func(rules string) {
+		t.Helper()
+		testNoError(t, os.WriteFile(cp, []byte(fmt.Sprintf("backend = \"test\"\n[rules]\n%s", rules)), 0600))
+	}
+	rule := func(name, path, regexp string) string {
+		return fmt.Sprintf("[rules.%s]\nsource = [\"file\", %q]\nregexp = [%q]\naction = [\"log\", \"simple\"]\n", name, path, regexp)
+	}
+	write(rule("a", a, "a %ip%") + rule("b", b, "b %ip%"))
+	testTailerAppend(t, a, "")
+	testTailerAppend(t, b, "")
+
+	c := &Configuration{}
+	testNoError(t, c.ReadFile(cp))
+	rn := NewRunner(c)
+	testNoError(t, rn.Initialize())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		rn.Run(false)
+		wg.Done()
+	}()
+	defer func() {
+		rn.stop()
+		wg.Wait()
+	}()
+	// Workers are spawned
+	time.Sleep(2 * tailerInterval)
+	rs := rn.rules()
+	ra, rb := rs["a"], rs["b"]
+
+	// Invalid rules change nothing
+	write(rule("a", a, "a %ip%") + rule("b", b, "b"))
+	testError(t, rn.reload(false))
+	if rs := rn.rules(); len(rs) != 2 || rs["a"] != ra || rs["b"] != rb || rb.stopped.Err() != nil {
+		t.Errorf("expected rules to be kept, got %v", rs)
+	}
+
+	// a is kept, b is changed and c is added using the same file as b
+	write(rule("a", a, "a %ip%") + rule("b", b, "b: %ip%") + rule("c", b, "c %ip%"))
+	testNoError(t, rn.reload(false))
+	rs = rn.rules()
+	if len(rs) != 3 || rs["a"] != ra || rs["b"] == rb || rs["c"] == nil {
+		t.Errorf("unexpected rules %v", rs)
+	}
+	if ra.stopped.Err() != nil || rb.stopped.Err() == nil {
+		t.Error("expected only the changed rule to be stopped")
+	}
+	if rs["b"].sharedSource != rb.sharedSource || rs["c"].sharedSource != rb.sharedSource || rb.sharedSource.stopped.Err() != nil {
+		t.Error("expected the new rules to share the source of the changed rule")
+	}
+
+	time.Sleep(2 * tailerInterval)
+	testTailerAppend(t, a, "a 192.0.2.1\n")
+	testTailerAppend(t, b, "b: 192.0.2.2\nc 192.0.2.3\n")
+	time.Sleep(4 * tailerInterval)
+	for n, m := range map[string]uint64{"a": 1, "b": 1, "c": 1} {
+		if c := rs[n].counters.matches.Load(); c != m {
+			t.Errorf("expected %d matches of rule %s, got %d", m, n, c)
+		}
+	}
+	if c := rb.counters.lines.Load(); c != 0 {
+		t.Errorf("expected stopped rule to read no lines, got %d", c)
+	}
+
+	// Removed
+	write(rule("a", a, "a %ip%"))
+	testNoError(t, rn.reload(false))
+	if rs := rn.rules(); len(rs) != 1 || rs["b"] != nil {
+		t.Errorf("unexpected rules %v", rs)
+	}
+	if rs["b"].sharedSource.stopped.Err() == nil {
+		t.Error("expected unused source to be stopped")
+	}
+}
+
+func TestRunnerReloadSyslog(t *testing.T) {
+	tr := func(address, network, dialAddress string) {
+		t.Helper()
+		d := t.TempDir()
+		cp := filepath.Join(d, "gerberos.toml")
+		write := func(regexp string, filters ...string) {
+			t.Helper()
+			s := fmt.Sprintf("%q, %q", "syslog", address)
+			for _, f := range filters {
+				s += fmt.Sprintf(", %q", f)
+			}
+			r := fmt.Sprintf("[rules.a]\nsource = [%s]\nregexp = [%q]\naction = [\"log\", \"simple\"]\n", s, regexp)
+			testNoError(t, os.WriteFile(cp, []byte(fmt.Sprintf("backend = \"test\"\n[rules]\n%s", r)), 0600))
+		}
+		write("a %ip%")
+
+		c := &Configuration{}
+		testNoError(t, c.ReadFile(cp))
+		rn := NewRunner(c)
+		testNoError(t, rn.Initialize())
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			rn.Run(true)
+			wg.Done()
+		}()
+		defer func() {
+			rn.stop()
+			wg.Wait()
+		}()
+		time.Sleep(100 * time.Millisecond)
+		ra := rn.rules()["a"]
+
+		// The source is kept
+		write("a: %ip%")
+		testNoError(t, rn.reload(true))
+		if rb := rn.rules()["a"]; rb == ra || rb.sharedSource != ra.sharedSource || ra.sharedSource.stopped.Err() != nil {
+			t.Error("expected the changed rule to keep its source")
+		}
+
+		// The source is replaced, listening on the same address
+		write("a: %ip%", "severity=info")
+		testNoError(t, rn.reload(true))
+		r := rn.rules()["a"]
+		if r.sharedSource == ra.sharedSource || ra.sharedSource.stopped.Err() == nil {
+			t.Error("expected the source to be replaced")
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		conn, err := net.Dial(network, dialAddress)
+		testNoError(t, err)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		m := "<38>Oct  1 22:14:15 host sshd[1]: a: 192.0.2.1"
+		if network == "unix" {
+			m = fmt.Sprintf("%d %s", len(m), m)
+		}
+		_, err = conn.Write([]byte(m))
+		testNoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+		if c := r.counters.matches.Load(); c != 1 {
+			t.Errorf("expected 1 match, got %d", c)
+		}
+	}
+
+	p := filepath.Join(t.TempDir(), "syslog.sock")
+	tr("udp://127.0.0.1:55141", "udp", "127.0.0.1:55141")
+	tr("unix://"+p, "unix", p)
+}
+
+func TestRunnerReloadIgnore(t *testing.T) {
+	d := t.TempDir()
+	cp, p := filepath.Join(d, "gerberos.toml"), filepath.Join(d, "a.log")
+	write := func(ignore string) {
+		t.Helper()
+		testNoError(t, os.WriteFile(cp, []byte(fmt.Sprintf("backend = \"test\"\nignore = [%q]\n[rules.a]\nsource = [\"file\", %q]\nregexp = [\"a %%ip%%\"]\naction = [\"log\", \"simple\"]\n", ignore, p)), 0600))
+	}
+	write("192.0.2.0/24")
+	testTailerAppend(t, p, "")
+
+	c := &Configuration{}
+	testNoError(t, c.ReadFile(cp))
+	rn := NewRunner(c)
+	testNoError(t, rn.Initialize())
+	defer rn.stop()
+	ic := func(ip string, e bool) {
+		t.Helper()
+		if rn.ignore.Load().contains(net.ParseIP(ip)) != e {
+			t.Errorf("unexpected ignore result for %s", ip)
+		}
+	}
+	ic("192.0.2.1", true)
+
+	write("198.51.100.0/24")
+	testNoError(t, rn.reload(false))
+	ic("192.0.2.1", false)
+	ic("198.51.100.1", true)
+
+	// Invalid lists change nothing
+	write("198.51.100.0/33")
+	testError(t, rn.reload(false))
+	ic("198.51.100.1", true)
+}
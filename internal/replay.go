@@ -0,0 +1,201 @@
+package gerberos
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// replayTimestamps are searched for in order in replayed lines of rules not
+// using the timestamp option.
+var replayTimestamps = []*timestamp{
+	{layout: timestampPresets["rfc3339"].layout, preset: timestampPresets["rfc3339"]},
+	{layout: timestampPresets["clf"].layout, preset: timestampPresets["clf"]},
+	{layout: timestampPresets["syslog"].layout, preset: timestampPresets["syslog"]},
+}
+
+var replaySuspiciousRegexp = regexp.MustCompile(ipRegexpText)
+
+// replay provides the times of replayed lines. Lines without a timestamp
+// take the time of the previous line, the zero time if there is none.
+type replay struct {
+	now  time.Time
+	last time.Time
+}
+
+func (rp *replay) lineTime(l string) time.Time {
+	for _, ts := range replayTimestamps {
+		s := ts.preset.regexp.FindString(l)
+		if s == "" {
+			continue
+		}
+		t, err := ts.parse(s, rp.now)
+		if err != nil {
+			continue
+		}
+		rp.last = t
+		break
+	}
+
+	return rp.last
+}
+
+// ReplayResult describes what a rule would have done with the lines of a log
+// file.
+type ReplayResult struct {
+	Lines   int
+	Matched []string
+	Ignored int
+	// Lines matched, but not counted as occurrences for lack of a timestamp
+	Untimed int
+	// Lines not matched, but containing an IP
+	Suspicious []string
+	Bans       []*ReplayBan
+}
+
+type ReplayBan struct {
+	IP      string
+	Matches int
+	// Number of times the action would have been performed
+	Bans int
+}
+
+// Replay feeds the lines of a plain or gzip-compressed log file through the
+// rule with the given name. Occurrences are counted using the timestamps
+// captured by the rule or otherwise found in the lines. No action is
+// performed and the firewall is not touched.
+func (rn *Runner) Replay(name string, path string) (*ReplayResult, error) {
+	r, ok := rn.configuration.Rules[name]
+	if !ok {
+		return nil, fmt.Errorf(`unknown rule "%s"`, name)
+	}
+
+	rn.backend = &noopBackend{}
+	if rn.configuration.SaveFilePath != "" {
+		// Not loaded, only required by the catch-up option
+		rn.cursors = newCursorStore("")
+	}
+	il, err := newIgnoreList(rn.configuration.Ignore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize ignore list: %w", err)
+	}
+	rn.ignore.Store(il)
+	r.name = name
+	if err := r.initialize(rn); err != nil {
+		return nil, fmt.Errorf(`failed to initialize rule "%s": %s`, name, err)
+	}
+	defer r.stop()
+	r.replay = &replay{now: time.Now()}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rd io.Reader = bufio.NewReader(f)
+	if h, _ := rd.(*bufio.Reader).Peek(2); bytes.Equal(h, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(rd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip header: %w", err)
+		}
+		defer gr.Close()
+		rd = gr
+	}
+
+	ls := make(chan *line, 1)
+	var serr error
+	go func() {
+		sc := bufio.NewScanner(rd)
+		for sc.Scan() {
+			ls <- &line{text: sc.Text()}
+		}
+		serr = sc.Err()
+		close(ls)
+	}()
+	c := ls
+	if r.multiline != nil {
+		c = r.multiline.assemble(ls)
+	}
+
+	rr := &ReplayResult{
+		Matched:    make([]string, 0),
+		Suspicious: make([]string, 0),
+		Bans:       make([]*ReplayBan, 0),
+	}
+	bs := make(map[string]*ReplayBan)
+	for l := range c {
+		rr.Lines++
+		m, err := r.match(l.text)
+		if errors.Is(err, errIncompleteAggregate) {
+			continue
+		}
+		if err != nil {
+			if replaySuspicious(l.text) {
+				rr.Suspicious = append(rr.Suspicious, l.text)
+			}
+			continue
+		}
+		rr.Matched = append(rr.Matched, l.text)
+
+		if r.ignores(m.ip) {
+			rr.Ignored++
+			continue
+		}
+
+		k := m.ip.String()
+		b, ok := bs[k]
+		if !ok {
+			b = &ReplayBan{IP: k}
+			bs[k] = b
+		}
+		b.Matches++
+		if r.occurrences != nil && m.time.IsZero() {
+			rr.Untimed++
+			continue
+		}
+		if r.occurrences == nil || r.occurrences.add(m.ip, m.time) {
+			b.Bans++
+		}
+	}
+	if serr != nil {
+		return nil, fmt.Errorf("failed to read lines: %w", serr)
+	}
+
+	for _, b := range bs {
+		if b.Bans > 0 {
+			rr.Bans = append(rr.Bans, b)
+		}
+	}
+	slices.SortFunc(rr.Bans, func(a, b *ReplayBan) int {
+		if a.Bans != b.Bans {
+			return b.Bans - a.Bans
+		}
+		if a.Matches != b.Matches {
+			return b.Matches - a.Matches
+		}
+		return strings.Compare(a.IP, b.IP)
+	})
+
+	return rr, nil
+}
+
+// replaySuspicious reports whether the line contains an IP other than the
+// unspecified one.
+func replaySuspicious(l string) bool {
+	for _, s := range replaySuspiciousRegexp.FindAllString(l, -1) {
+		if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil && !ip.IsUnspecified() {
+			return true
+		}
+	}
+
+	return false
+}
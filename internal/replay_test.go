@@ -0,0 +1,160 @@
+package gerberos
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayLineTime(t *testing.T) {
+	rp := &replay{now: time.Date(2026, 1, 10, 0, 0, 0, 0, time.Local)}
+	lt := func(l string, e time.Time) {
+		t.Helper()
+		if lt := rp.lineTime(l); !lt.Equal(e) {
+			t.Errorf(`expected time of "%s" to be %s, got %s`, l, e, lt)
+		}
+	}
+
+	lt("2025-12-31T23:59:59Z sshd: x", time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC))
+	lt("2025-12-31T23:59:59.5+01:00 sshd: x", time.Date(2025, 12, 31, 22, 59, 59, 5e8, time.UTC))
+	lt("2024-01-01 12:00:00+00:00 sshd: x", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	lt(`192.0.2.1 - - [09/Jan/2026:10:00:00 +0000] "GET / HTTP/1.1" 404`, time.Date(2026, 1, 9, 10, 0, 0, 0, time.UTC))
+	lt("Jan  9 10:00:00 host sshd[1]: x", time.Date(2026, 1, 9, 10, 0, 0, 0, time.Local))
+	// In the future, thus of the previous year
+	lt("Dec 31 10:00:00 host sshd[1]: x", time.Date(2025, 12, 31, 10, 0, 0, 0, time.Local))
+	// Taken from the previous line
+	lt("continued", time.Date(2025, 12, 31, 10, 0, 0, 0, time.Local))
+}
+
+func TestReplay(t *testing.T) {
+	d := t.TempDir()
+	ls := strings.Join([]string{
+		"Jan  9 10:00:00 host sshd[1]: Invalid user a from 192.0.2.1 port 1",
+		"Jan  9 10:00:10 host sshd[1]: Invalid user b from 192.0.2.1 port 1",
+		"Jan  9 10:00:00 host sshd[1]: Invalid user a from 192.0.2.2 port 1",
+		"Jan  9 10:05:00 host sshd[1]: Invalid user a from 192.0.2.2 port 1",
+		"Jan  9 10:05:00 host sshd[1]: Invalid user a from 10.0.0.1 port 1",
+		"Jan  9 10:05:00 host sshd[1]: Connection closed by 198.51.100.7 port 1",
+		"Jan  9 10:05:00 host sshd[1]: Server listening on :: port 22.",
+	}, "\n") + "\n"
+	p, gp := filepath.Join(d, "auth.log"), filepath.Join(d, "auth.log.gz")
+	testNoError(t, os.WriteFile(p, []byte(ls), 0600))
+	f, err := os.Create(gp)
+	testNoError(t, err)
+	w := gzip.NewWriter(f)
+	_, err = w.Write([]byte(ls))
+	testNoError(t, err)
+	testNoError(t, w.Close())
+	testNoError(t, f.Close())
+
+	rp := func(p string) {
+		t.Helper()
+		rn, err := newTestRunner()
+		testNoError(t, err)
+		rn.configuration.Ignore = []string{"10.0.0.0/8"}
+		r := newTestValidRule()
+		r.Aggregate = nil
+		r.Regexp = []string{`Invalid user \S+ from %ip%`}
+		r.Occurrences = []string{"2", "1m"}
+		rn.configuration.Rules = map[string]*rule{"ssh": r}
+
+		rr, err := rn.Replay("ssh", p)
+		testNoError(t, err)
+		if rr.Lines != 7 || len(rr.Matched) != 5 || rr.Ignored != 1 {
+			t.Errorf("unexpected result %+v", rr)
+		}
+		if len(rr.Suspicious) != 1 || !strings.Contains(rr.Suspicious[0], "198.51.100.7") {
+			t.Errorf("unexpected suspicious lines %v", rr.Suspicious)
+		}
+		if len(rr.Bans) != 1 || *rr.Bans[0] != (ReplayBan{IP: "192.0.2.1", Matches: 2, Bans: 1}) {
+			t.Errorf("unexpected bans %v", rr.Bans)
+		}
+	}
+
+	rp(p)
+	rp(gp)
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	_, err = rn.Replay("unknown", p)
+	testError(t, err)
+	_, err = rn.Replay("test", filepath.Join(d, "missing.log"))
+	testError(t, err)
+}
+
+func TestReplayAggregate(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	r := newTestValidRule()
+	r.Regexp = []string{`from %ip% id %id%`}
+	r.Aggregate = []string{"1s", `done %id%`}
+	testNoError(t, r.initialize(rn))
+	r.replay = &replay{now: time.Date(2026, 1, 10, 0, 0, 0, 0, time.Local)}
+
+	ma := func(l1, l2 string, e bool) {
+		t.Helper()
+		_, err := r.match(l1)
+		testError(t, err)
+		m, err := r.match(l2)
+		if e != (err == nil) {
+			t.Errorf(`unexpected result for "%s"`, l2)
+		}
+		if e && !m.time.Equal(time.Date(2026, 1, 9, 10, 0, 1, 0, time.Local)) {
+			t.Errorf("unexpected time %s", m.time)
+		}
+	}
+
+	ma("Jan  9 10:00:00 from 192.0.2.1 id x", "Jan  9 10:00:01 done x", true)
+	// Interval of 1s exceeded
+	ma("Jan  9 10:00:00 from 192.0.2.1 id y", "Jan  9 10:00:05 done y", false)
+}
+
+func TestReplaySpaceSeparatedTimestamps(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "app.log")
+	testNoError(t, os.WriteFile(p, []byte(
+		"2024-01-01 12:00:00+00:00 login failed from 192.0.2.1\n"+
+			"2024-01-01 12:02:00+00:00 login failed from 192.0.2.1\n"), 0600))
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	r := newTestValidRule()
+	r.Aggregate = nil
+	r.Regexp = []string{`login failed from %ip%`}
+	r.Occurrences = []string{"2", "1m"}
+	rn.configuration.Rules = map[string]*rule{"app": r}
+
+	// Two minutes apart, thus not within the interval
+	rr, err := rn.Replay("app", p)
+	testNoError(t, err)
+	if len(rr.Matched) != 2 || len(rr.Bans) != 0 {
+		t.Errorf("unexpected result %+v", rr)
+	}
+}
+
+func TestReplayWithoutTimestamps(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "app.log")
+	testNoError(t, os.WriteFile(p, []byte(strings.Repeat("login failed from 192.0.2.1\n", 3)+
+		"2024-01-01 12:00:00+00:00 login failed from 192.0.2.1\n"+
+		"login failed from 192.0.2.1\n"), 0600))
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	r := newTestValidRule()
+	r.Aggregate = nil
+	r.Regexp = []string{`login failed from %ip%`}
+	r.Occurrences = []string{"2", "1m"}
+	rn.configuration.Rules = map[string]*rule{"app": r}
+
+	// Only the last line takes the time of the line before
+	rr, err := rn.Replay("app", p)
+	testNoError(t, err)
+	if len(rr.Matched) != 5 || rr.Untimed != 3 {
+		t.Errorf("unexpected result %+v", rr)
+	}
+	if len(rr.Bans) != 1 || *rr.Bans[0] != (ReplayBan{IP: "192.0.2.1", Matches: 5, Bans: 1}) {
+		t.Errorf("unexpected bans %v", rr.Bans)
+	}
+}
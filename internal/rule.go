@@ -2,15 +2,19 @@ package gerberos
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -34,14 +38,44 @@ type rule struct {
 	Action      []string
 	Aggregate   []string
 	Occurrences []string
+	CatchUp     []string
+	Multiline   []string
+	JSON        []string
+	Ignore      []string
+	Timestamp   []string
+
+	runner       *Runner
+	name         string
+	source       source
+	sharedSource *sharedSource
+	regexp       []*regexp.Regexp
+	action       action
+	aggregate    *aggregate
+	occurrences  *occurrences
+	catchUp      time.Duration
+	multiline    *multiline
+	json         *jsonRule
+	ignore       *ignoreList
+	timestamp    *timestamp
+	counters     ruleCounters
+	// Only set while replaying lines
+	replay *replay
+	// Cancelled once the rule is removed or changed by a reload
+	stopped context.Context
+	stop    context.CancelFunc
+}
 
-	runner      *Runner
-	name        string
-	source      source
-	regexp      []*regexp.Regexp
-	action      action
-	aggregate   *aggregate
-	occurrences *occurrences
+// ruleCounters are updated by the worker and reported by the control socket
+// and the metrics endpoint.
+type ruleCounters struct {
+	lines          atomic.Uint64
+	matches        atomic.Uint64
+	matchFailures  atomic.Uint64
+	occurrences    atomic.Uint64
+	actions        atomic.Uint64
+	actionFailures atomic.Uint64
+	respawns       atomic.Uint64
+	droppedLines   atomic.Uint64
 }
 
 func (r *rule) initializeSource() error {
@@ -53,9 +87,18 @@ func (r *rule) initializeSource() error {
 		return errors.New("empty source")
 	}
 
+	// Rules with identical source definitions share a single source
+	k := r.sourceKey()
+	if s, e := r.runner.sources[k]; e {
+		r.source, r.sharedSource = s.source, s
+		return nil
+	}
+
 	switch r.Source[0] {
 	case "file":
 		r.source = &fileSource{}
+	case "glob":
+		r.source = &globSource{}
 	case "systemd":
 		r.source = &systemdSource{}
 	case "kernel":
@@ -64,14 +107,45 @@ func (r *rule) initializeSource() error {
 		r.source = &testSource{}
 	case "process":
 		r.source = &processSource{}
+	case "syslog":
+		r.source = &syslogSource{}
+	case "journal":
+		r.source = &journalSource{}
+	case "docker":
+		r.source = &dockerSource{}
+	case "kmsg":
+		r.source = &kmsgSource{}
 	default:
 		return errors.New("unknown source")
 	}
 
-	return r.source.initialize(r)
+	// Sources access the shared source once reading
+	r.sharedSource = newSharedSource(r.runner.stopped, r.source)
+	if err := r.source.initialize(r); err != nil {
+		r.sharedSource.stop()
+		return err
+	}
+	r.runner.sources[k] = r.sharedSource
+
+	return nil
+}
+
+// sourceKey identifies the source definition of the rule. This includes the
+// catch-up option since it affects how a source is read.
+func (r *rule) sourceKey() string {
+	b, _ := json.Marshal([][]string{r.Source, r.CatchUp})
+	return string(b)
 }
 
 func (r *rule) initializeRegexp() error {
+	// Lines are matched by their fields instead
+	if r.JSON != nil {
+		if r.Regexp != nil {
+			return errors.New("regexp must not be used with the json option")
+		}
+		return nil
+	}
+
 	if r.Regexp == nil {
 		return errors.New("missing regexp")
 	}
@@ -98,12 +172,19 @@ func (r *rule) initializeRegexp() error {
 			return fmt.Errorf(`"%s" must appear exactly once in regexp if the aggregate option is used`, idMagicText)
 		}
 
-		t := strings.Replace(s, ipMagicText, ipRegexpText, 1)
+		t, err := r.expandTimestamp(s)
+		if err != nil {
+			return err
+		}
+		t = strings.Replace(t, ipMagicText, ipRegexpText, 1)
 		t = strings.Replace(t, idMagicText, idRegexpText, 1)
 		re, err := regexp.Compile(t)
 		if err != nil {
 			return err
 		}
+		if r.timestamp != nil && re.SubexpIndex(timeGroupName) == -1 {
+			return fmt.Errorf(`"%s" or a subexpression named "%s" must appear in regexp if the timestamp option is used`, timeMagicText, timeGroupName)
+		}
 		r.regexp = append(r.regexp, re)
 	}
 
@@ -122,6 +203,8 @@ func (r *rule) initializeAction() error {
 	switch r.Action[0] {
 	case "ban":
 		r.action = &banAction{}
+	case "unban":
+		r.action = &unbanAction{}
 	case "log":
 		r.action = &logAction{}
 	case "test":
@@ -160,7 +243,12 @@ func (r *rule) initializeAggregate() error {
 			return fmt.Errorf(`"%s" must appear exactly once in regexp`, idMagicRegexp)
 		}
 
-		re, err := regexp.Compile(strings.Replace(s, idMagicText, idRegexpText, 1))
+		// Completing lines may also carry a timestamp
+		t, err := r.expandTimestamp(s)
+		if err != nil {
+			return err
+		}
+		re, err := regexp.Compile(strings.Replace(t, idMagicText, idRegexpText, 1))
 		if err != nil {
 			return err
 		}
@@ -201,33 +289,158 @@ func (r *rule) initializeOccurrences() error {
 	return nil
 }
 
-func (r *rule) initialize(rn *Runner) error {
-	r.runner = rn
+func (r *rule) initializeCatchUp() error {
+	if r.CatchUp == nil {
+		return nil
+	}
 
-	if err := r.initializeSource(); err != nil {
-		return err
+	if len(r.CatchUp) < 1 {
+		return errors.New("missing look-back parameter")
+	}
+	d, err := time.ParseDuration(r.CatchUp[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse look-back parameter: %s", err)
+	}
+	if d <= 0 {
+		return errors.New("invalid look-back parameter: must be > 0")
 	}
 
-	if err := r.initializeRegexp(); err != nil {
-		return err
+	if len(r.CatchUp) > 1 {
+		return errors.New("superfluous parameter(s)")
 	}
 
-	if err := r.initializeAction(); err != nil {
-		return err
+	if len(r.Source) > 0 {
+		switch r.Source[0] {
+		case "file", "systemd", "kernel", "journal", "kmsg":
+		default:
+			return errors.New("source does not support catching up")
+		}
+	}
+
+	if r.runner.cursors == nil {
+		return errors.New("catching up requires saveFilePath to be set")
+	}
+
+	r.catchUp = d
+
+	return nil
+}
+
+func (r *rule) initializeMultiline() error {
+	if r.Multiline == nil {
+		return nil
 	}
 
-	if err := r.initializeAggregate(); err != nil {
+	if len(r.Multiline) < 1 {
+		return errors.New("missing timeout parameter")
+	}
+	t, err := time.ParseDuration(r.Multiline[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse timeout parameter: %s", err)
+	}
+	if t <= 0 {
+		return errors.New("invalid timeout parameter: must be > 0")
+	}
+
+	if len(r.Multiline) < 2 {
+		return errors.New("missing mode parameter")
+	}
+	var s bool
+	switch r.Multiline[1] {
+	case "start":
+		s = true
+	case "continuation":
+	default:
+		return errors.New(`invalid mode parameter: must be "start" or "continuation"`)
+	}
+
+	if len(r.Multiline) < 3 {
+		return errors.New("missing regexp")
+	}
+	re, err := regexp.Compile(r.Multiline[2])
+	if err != nil {
 		return err
 	}
 
-	if err := r.initializeOccurrences(); err != nil {
+	if len(r.Multiline) > 3 {
+		return errors.New("superfluous parameter(s)")
+	}
+
+	r.multiline = newMultiline(t, s, re)
+
+	return nil
+}
+
+func (r *rule) initializeIgnore() error {
+	if r.Ignore == nil {
+		return nil
+	}
+
+	il, err := newIgnoreList(r.Ignore)
+	if err != nil {
 		return err
 	}
+	r.ignore = il
 
 	return nil
 }
 
-func (r *rule) processScanner(name string, args ...string) (chan *match, error) {
+// ignores reports whether an IP is on the global or the rule's ignore list.
+func (r *rule) ignores(ip net.IP) bool {
+	return r.runner.ignore.Load().contains(ip) || r.ignore.contains(ip)
+}
+
+// ignoresAny reports whether a network overlaps with the global or the rule's
+// ignore list.
+func (r *rule) ignoresAny(n *net.IPNet) bool {
+	return r.runner.ignore.Load().overlaps(n) || r.ignore.overlaps(n)
+}
+
+func (r *rule) initialize(rn *Runner) error {
+	return errors.Join(r.initializeOptions(rn)...)
+}
+
+// initializeOptions initializes all options, continuing after errors. The
+// errors are prefixed with the names of the options.
+func (r *rule) initializeOptions(rn *Runner) []error {
+	r.runner = rn
+	r.stopped, r.stop = context.WithCancel(rn.stopped)
+
+	errs := make([]error, 0)
+	for _, o := range []struct {
+		name       string
+		initialize func() error
+	}{
+		// The source depends on the catch-up option
+		{"catchUp", r.initializeCatchUp},
+		{"source", r.initializeSource},
+		// The regexps depend on the timestamp option
+		{"timestamp", r.initializeTimestamp},
+		{"regexp", r.initializeRegexp},
+		{"action", r.initializeAction},
+		{"aggregate", r.initializeAggregate},
+		{"json", r.initializeJSON},
+		{"occurrences", r.initializeOccurrences},
+		{"multiline", r.initializeMultiline},
+		{"ignore", r.initializeIgnore},
+	} {
+		if err := o.initialize(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", o.name, err))
+		}
+	}
+
+	return errs
+}
+
+func (r *rule) processScanner(name string, args ...string) (chan *line, error) {
+	return r.processScannerFunc(func(l string, c chan *line) {
+		c <- &line{text: l}
+	}, name, args...)
+}
+
+// processScannerFunc is like processScanner, but passes each line to f instead
+// of sending it to the returned channel directly.
+func (r *rule) processScannerFunc(f func(l string, c chan *line), name string, args ...string) (chan *line, error) {
 	stop := make(chan bool, 1)
 
 	cmd := exec.Command(name, args...)
@@ -245,10 +458,11 @@ func (r *rule) processScanner(name string, args ...string) (chan *match, error)
 	}
 	log.Info().Str("rule", r.name).Str("command", cmd.String()).Msg("scanning process stdout and stderr")
 
+	ctx := r.sharedSource.reading
 	go func() {
 		select {
 		case <-stop:
-		case <-r.runner.stopped.Done():
+		case <-ctx.Done():
 		}
 		if cmd.Process != nil {
 			cmd.Process.Signal(os.Interrupt)
@@ -258,7 +472,7 @@ func (r *rule) processScanner(name string, args ...string) (chan *match, error)
 	}()
 
 	rcs := []io.ReadCloser{o, e}
-	c := make(chan *match, len(rcs))
+	c := make(chan *line, len(rcs))
 	go func() {
 		wg := &sync.WaitGroup{}
 		wg.Add(len(rcs))
@@ -266,11 +480,7 @@ func (r *rule) processScanner(name string, args ...string) (chan *match, error)
 			go func(rc io.ReadCloser) {
 				sc := bufio.NewScanner(rc)
 				for sc.Scan() {
-					if m, err := r.match(sc.Text()); err == nil {
-						c <- m
-					} else {
-						log.Debug().Str("rule", r.name).Err(err).Msg("failed to create match")
-					}
+					f(sc.Text(), c)
 				}
 				if err := sc.Err(); err != nil {
 					log.Warn().Str("rule", r.name).Str("command", cmd.String()).Err(err).Msg("failed to scan command output")
@@ -299,34 +509,87 @@ func (r *rule) processScanner(name string, args ...string) (chan *match, error)
 }
 
 func (r *rule) worker(requeue bool) error {
-	c, err := r.source.matches()
+	sc, err := r.sharedSource.subscribe(r)
 	if err != nil {
-		log.Warn().Str("rule", r.name).Err(err).Msg("failed to initialize matches channel")
+		log.Warn().Str("rule", r.name).Err(err).Msg("failed to initialize lines channel")
+		if requeue {
+			r.requeueWorker()
+		}
 		return err
 	}
+	c := sc
+	if r.multiline != nil {
+		c = r.multiline.assemble(sc)
+	}
 
-	for m := range c {
-		p := true
-		if r.occurrences != nil {
-			p = r.occurrences.add(m.ip)
-		}
-
-		if p {
-			if err := r.action.perform(m); err != nil {
-				log.Warn().Str("rule", r.name).Err(err).Msg("failed to perform action")
+loop:
+	for {
+		select {
+		case <-r.stopped.Done():
+			r.sharedSource.unsubscribe(sc)
+			for range c {
 			}
+			log.Info().Str("rule", r.name).Msg("stopped worker")
+			return nil
+		case l, ok := <-c:
+			if !ok {
+				break loop
+			}
+			r.process(l)
 		}
 	}
 
 	if requeue {
-		select {
-		case <-r.runner.stopped.Done():
-			return nil
-		default:
-		}
-		log.Info().Str("rule", r.name).Msg("queuing worker for respawn")
-		r.runner.respawnWorkerChan <- r
+		r.requeueWorker()
 	}
 
 	return nil
 }
+
+// requeueWorker queues the worker for respawn unless the rule is stopped.
+func (r *rule) requeueWorker() {
+	select {
+	case <-r.stopped.Done():
+		return
+	default:
+	}
+	log.Info().Str("rule", r.name).Msg("queuing worker for respawn")
+	select {
+	case r.runner.respawnWorkerChan <- r:
+	case <-r.stopped.Done():
+	}
+}
+
+func (r *rule) process(l *line) {
+	r.counters.lines.Add(1)
+	m, err := r.match(l.text)
+	if err != nil {
+		r.counters.matchFailures.Add(1)
+		log.Debug().Str("rule", r.name).Err(err).Msg("failed to create match")
+		return
+	}
+	m.origin = l.origin
+	r.counters.matches.Add(1)
+
+	if r.ignores(m.ip) {
+		log.Debug().Str("rule", r.name).IPAddr("ip", m.ip).Msg("ignored match")
+		return
+	}
+
+	p := true
+	if r.occurrences != nil {
+		p = r.occurrences.add(m.ip, m.time)
+		if p {
+			r.counters.occurrences.Add(1)
+		}
+	}
+
+	if p {
+		if err := r.action.perform(m); err != nil {
+			r.counters.actionFailures.Add(1)
+			log.Warn().Str("rule", r.name).Err(err).Msg("failed to perform action")
+		} else {
+			r.counters.actions.Add(1)
+		}
+	}
+}
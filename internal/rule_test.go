@@ -2,6 +2,7 @@ package gerberos
 
 import (
 	"testing"
+	"time"
 )
 
 func TestRulesValue(t *testing.T) {
@@ -38,6 +39,109 @@ func TestRulesValue(t *testing.T) {
 	ir(func(r *rule) {
 		r.Source = []string{"process", "kek", "se"}
 	})
+	ir(func(r *rule) {
+		r.Source = []string{"syslog", "udp://127.0.0.1:5514", "hostname=a,b", "app=sshd", "severity=warning"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"syslog", "unix:///run/gerberos.sock"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"journal"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"kmsg"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"kmsg", "test/kmsg"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"docker", "name=web", "label=app=nginx", "socket=/run/podman/podman.sock"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"glob", "/var/log/nginx/*.access.log", "/var/log"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"journal", "unit=a", "unit=b", "priority=err", "_COMM=sshd", "MESSAGE~^Failed"}
+	})
+	ir(func(r *rule) {
+		r.Multiline = []string{"1s", "start", `^\S`}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"ban", "1d", "escalate=1w,4w,permanent", "window=30d"}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"ban", "1h", "escalate=x2"}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefix=24,64"}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefix=32,128", "prefixThreshold=5", "window=1d"}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"ban", "1h", "ports=22"}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"ban", "1h", "protocol=udp", "ports=53,5353"}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"unban"}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"unban", "message=login of {{.user}}"}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"log", "simple", "message={{.user}} from {{.ip}}"}
+	})
+	ir(func(r *rule) {
+		r.Action = []string{"ban", "1h", "message=brute force against {{.user}}"}
+	})
+	ir(func(r *rule) {
+		r.Ignore = []string{"127.0.0.1", "10.0.0.0/8", "::1", "fe80::/10"}
+	})
+	ir(func(r *rule) {
+		r.Regexp = nil
+		r.Aggregate = nil
+		r.JSON = []string{"request.remote_ip", "status=401", "level!=debug", "msg~^failed", "msg!~ok$"}
+	})
+	ir(func(r *rule) {
+		r.Multiline = []string{"500ms", "continuation", `^\s+at `}
+	})
+	ir(func(r *rule) {
+		r.Regexp = []string{`^%time% %ip%\s%id%`}
+		r.Timestamp = []string{"syslog"}
+	})
+	ir(func(r *rule) {
+		r.Regexp = []string{`^(?P<time>\d+/\d+/\d+) %ip%\s%id%`}
+		r.Aggregate = []string{"1s", `%time% a\s%id%`}
+		r.Timestamp = []string{"rfc3339"}
+	})
+	ir(func(r *rule) {
+		r.Regexp = []string{`^(?P<time>\d+/\d+/\d+) %ip%\s%id%`}
+		r.Timestamp = []string{"2006/01/02"}
+	})
+
+	rn.cursors = newCursorStore("")
+	ir(func(r *rule) {
+		r.Source = []string{"file", "FILE"}
+		r.CatchUp = []string{"1h"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"systemd", "service"}
+		r.CatchUp = []string{"1h"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"kernel"}
+		r.CatchUp = []string{"1h"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"journal", "unit=a"}
+		r.CatchUp = []string{"1h"}
+	})
+	ir(func(r *rule) {
+		r.Source = []string{"kmsg"}
+		r.CatchUp = []string{"1h"}
+	})
 }
 
 func TestRulesInvalid(t *testing.T) {
@@ -67,8 +171,23 @@ func TestRulesInvalid(t *testing.T) {
 	ee("log action: invalid type parameter", func(r *rule) {
 		r.Action = []string{"log", "invalid"}
 	})
+	ee("log action: invalid parameter", func(r *rule) {
+		r.Action = []string{"log", "simple", "invalid"}
+	})
 	ee("log action: superfluous parameter", func(r *rule) {
-		r.Action = []string{"log", "simple", "superfluous"}
+		r.Action = []string{"log", "simple", "message=x", "superfluous"}
+	})
+	ee("log action: invalid message parameter", func(r *rule) {
+		r.Action = []string{"log", "simple", "message={{.user"}
+	})
+	ee("unban action: invalid parameter", func(r *rule) {
+		r.Action = []string{"unban", "1h"}
+	})
+	ee("unban action: superfluous parameter", func(r *rule) {
+		r.Action = []string{"unban", "message=x", "superfluous"}
+	})
+	ee("ban action: invalid message parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "message={{"}
 	})
 	ee("ban action: missing duration parameter", func(r *rule) {
 		r.Action = []string{"ban"}
@@ -79,6 +198,72 @@ func TestRulesInvalid(t *testing.T) {
 	ee("ban action: superfluous parameter", func(r *rule) {
 		r.Action = []string{"ban", "1h", "superfluous"}
 	})
+	ee("ban action: unknown parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "unknown=1"}
+	})
+	ee("ban action: invalid escalate parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "escalate=1d,1y"}
+	})
+	ee("ban action: invalid escalate parameter 2", func(r *rule) {
+		r.Action = []string{"ban", "1h", "escalate=x1"}
+	})
+	ee("ban action: invalid escalate parameter 3", func(r *rule) {
+		r.Action = []string{"ban", "1h", "escalate=xx"}
+	})
+	ee("ban action: invalid escalate parameter 4", func(r *rule) {
+		r.Action = []string{"ban", "permanent", "escalate=x2"}
+	})
+	ee("ban action: invalid window parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "escalate=1d", "window=1y"}
+	})
+	ee("ban action: invalid window parameter 2", func(r *rule) {
+		r.Action = []string{"ban", "1h", "escalate=1d", "window=0s"}
+	})
+	ee("ban action: invalid prefix parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefix=24"}
+	})
+	ee("ban action: invalid prefix parameter 2", func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefix=33,64"}
+	})
+	ee("ban action: invalid prefix parameter 3", func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefix=24,0"}
+	})
+	ee("ban action: invalid prefix parameter 4", func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefix=a,64"}
+	})
+	ee("ban action: invalid ports parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "ports=0"}
+	})
+	ee("ban action: invalid ports parameter 2", func(r *rule) {
+		r.Action = []string{"ban", "1h", "ports=22,a"}
+	})
+	ee("ban action: invalid ports parameter 3", func(r *rule) {
+		r.Action = []string{"ban", "1h", "ports=65536"}
+	})
+	ee("ban action: duplicate port", func(r *rule) {
+		r.Action = []string{"ban", "1h", "ports=22,22"}
+	})
+	ee("ban action: invalid protocol parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "protocol=icmp", "ports=22"}
+	})
+	ee("ban action: protocol parameter without ports parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "protocol=tcp"}
+	})
+	ee("ban action: ports parameter with prefix parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefix=24,64", "ports=22"}
+	})
+	ee("ban action: invalid prefixThreshold parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefix=24,64", "prefixThreshold=1"}
+	})
+	ee("ban action: invalid prefixThreshold parameter 2", func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefix=24,64", "prefixThreshold=a"}
+	})
+	ee("ban action: prefixThreshold parameter without prefix parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "prefixThreshold=3"}
+	})
+	ee("ban action: window parameter without escalate parameter", func(r *rule) {
+		r.Action = []string{"ban", "1h", "window=1d"}
+	})
 	ee("missing regexp", func(r *rule) {
 		r.Regexp = nil
 	})
@@ -133,6 +318,60 @@ func TestRulesInvalid(t *testing.T) {
 	ee("process source: missing name", func(r *rule) {
 		r.Source = []string{"process"}
 	})
+	ee("syslog source: missing address parameter", func(r *rule) {
+		r.Source = []string{"syslog"}
+	})
+	ee("syslog source: unknown network", func(r *rule) {
+		r.Source = []string{"syslog", "sctp://127.0.0.1:5514"}
+	})
+	ee("syslog source: missing host", func(r *rule) {
+		r.Source = []string{"syslog", "udp://"}
+	})
+	ee("syslog source: missing path", func(r *rule) {
+		r.Source = []string{"syslog", "unix://"}
+	})
+	ee("syslog source: invalid filter parameter", func(r *rule) {
+		r.Source = []string{"syslog", "udp://127.0.0.1:5514", "app"}
+	})
+	ee("syslog source: unknown filter parameter", func(r *rule) {
+		r.Source = []string{"syslog", "udp://127.0.0.1:5514", "facility=auth"}
+	})
+	ee("syslog source: unknown severity", func(r *rule) {
+		r.Source = []string{"syslog", "udp://127.0.0.1:5514", "severity=loud"}
+	})
+	ee("glob source: missing pattern parameter", func(r *rule) {
+		r.Source = []string{"glob"}
+	})
+	ee("glob source: invalid pattern", func(r *rule) {
+		r.Source = []string{"glob", "/var/log/[.log"}
+	})
+	ee("docker source: missing name or label parameter", func(r *rule) {
+		r.Source = []string{"docker", "socket=/run/podman/podman.sock"}
+	})
+	ee("docker source: invalid parameter", func(r *rule) {
+		r.Source = []string{"docker", "name"}
+	})
+	ee("docker source: unknown parameter", func(r *rule) {
+		r.Source = []string{"docker", "image=nginx"}
+	})
+	ee("kmsg source: superfluous parameter", func(r *rule) {
+		r.Source = []string{"kmsg", "/dev/kmsg", "superfluous"}
+	})
+	ee("journal source: invalid filter parameter", func(r *rule) {
+		r.Source = []string{"journal", "unit"}
+	})
+	ee("journal source: empty filter value", func(r *rule) {
+		r.Source = []string{"journal", "unit="}
+	})
+	ee("journal source: invalid field name", func(r *rule) {
+		r.Source = []string{"journal", "comm=sshd"}
+	})
+	ee("journal source: invalid priority", func(r *rule) {
+		r.Source = []string{"journal", "priority=loud"}
+	})
+	ee("journal source: invalid regexp", func(r *rule) {
+		r.Source = []string{"journal", "MESSAGE~["}
+	})
 	ee("occurrences: missing count parameter", func(r *rule) {
 		r.Occurrences = []string{}
 	})
@@ -169,4 +408,139 @@ func TestRulesInvalid(t *testing.T) {
 	ee("occurrences: invalid interval parameter", func(r *rule) {
 		r.Occurrences = []string{"5", "5g"}
 	})
+	ee("multiline: missing timeout parameter", func(r *rule) {
+		r.Multiline = []string{}
+	})
+	ee("multiline: invalid timeout parameter", func(r *rule) {
+		r.Multiline = []string{"5g", "start", "^"}
+	})
+	ee("multiline: invalid timeout parameter 2", func(r *rule) {
+		r.Multiline = []string{"0s", "start", "^"}
+	})
+	ee("multiline: missing mode parameter", func(r *rule) {
+		r.Multiline = []string{"1s"}
+	})
+	ee("multiline: invalid mode parameter", func(r *rule) {
+		r.Multiline = []string{"1s", "end", "^"}
+	})
+	ee("multiline: missing regexp", func(r *rule) {
+		r.Multiline = []string{"1s", "start"}
+	})
+	ee("multiline: syntactically incorrect regexp", func(r *rule) {
+		r.Multiline = []string{"1s", "start", "["}
+	})
+	ee("multiline: superfluous parameter", func(r *rule) {
+		r.Multiline = []string{"1s", "start", "^", "superfluous"}
+	})
+	ee("json: missing IP field parameter", func(r *rule) {
+		r.Regexp = nil
+		r.Aggregate = nil
+		r.JSON = []string{}
+	})
+	ee("json: regexp", func(r *rule) {
+		r.Aggregate = nil
+		r.JSON = []string{"ip"}
+	})
+	ee("json: aggregate", func(r *rule) {
+		r.Regexp = nil
+		r.JSON = []string{"ip"}
+	})
+	ee("json: invalid condition", func(r *rule) {
+		r.Regexp = nil
+		r.Aggregate = nil
+		r.JSON = []string{"ip", "status"}
+	})
+	ee("json: invalid condition 2", func(r *rule) {
+		r.Regexp = nil
+		r.Aggregate = nil
+		r.JSON = []string{"ip", "!=x"}
+	})
+	ee("json: syntactically incorrect condition regexp", func(r *rule) {
+		r.Regexp = nil
+		r.Aggregate = nil
+		r.JSON = []string{"ip", "msg~["}
+	})
+	ee("ignore: invalid IP", func(r *rule) {
+		r.Ignore = []string{"1.2.3"}
+	})
+	ee("ignore: invalid CIDR", func(r *rule) {
+		r.Ignore = []string{"1.2.3.4/33"}
+	})
+	ee("ignore: missing file", func(r *rule) {
+		r.Ignore = []string{"file:test/unknown"}
+	})
+	ee("catch-up: missing look-back parameter", func(r *rule) {
+		r.CatchUp = []string{}
+	})
+	ee("catch-up: invalid look-back parameter", func(r *rule) {
+		r.CatchUp = []string{"5g"}
+	})
+	ee("catch-up: invalid look-back parameter 2", func(r *rule) {
+		r.CatchUp = []string{"0s"}
+	})
+	ee("catch-up: superfluous parameter", func(r *rule) {
+		r.CatchUp = []string{"1h", "superfluous"}
+	})
+	ee("catch-up: missing save file path", func(r *rule) {
+		r.Source = []string{"file", "FILE"}
+		r.CatchUp = []string{"1h"}
+	})
+
+	ee("timestamp: missing layout parameter", func(r *rule) {
+		r.Timestamp = []string{}
+	})
+	ee("timestamp: superfluous parameter", func(r *rule) {
+		r.Regexp = []string{`%time% %ip%\s%id%`}
+		r.Timestamp = []string{"syslog", "superfluous"}
+	})
+	ee("timestamp: missing subexpression", func(r *rule) {
+		r.Timestamp = []string{"syslog"}
+	})
+	ee("timestamp: magic text without preset", func(r *rule) {
+		r.Regexp = []string{`%time% %ip%\s%id%`}
+		r.Timestamp = []string{"2006/01/02"}
+	})
+	ee("timestamp: magic text without option", func(r *rule) {
+		r.Regexp = []string{`%time% %ip%\s%id%`}
+	})
+	ee("timestamp: subexpression without option", func(r *rule) {
+		r.Regexp = []string{`(?P<time>\S+) %ip%\s%id%`}
+	})
+	ee("timestamp: magic text twice", func(r *rule) {
+		r.Regexp = []string{`%time% %time% %ip%\s%id%`}
+		r.Timestamp = []string{"syslog"}
+	})
+	ee("timestamp: json", func(r *rule) {
+		r.Regexp = nil
+		r.Aggregate = nil
+		r.JSON = []string{"ip"}
+		r.Timestamp = []string{"rfc3339"}
+	})
+
+	rn.cursors = newCursorStore("")
+	ee("catch-up: unsupported source", func(r *rule) {
+		r.CatchUp = []string{"1h"}
+	})
+}
+
+func TestRuleWorkerRequeueSubscribeError(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	testNoError(t, rn.Initialize())
+	r := rn.configuration.Rules["test"]
+	r.source.(*testSource).linesErr = errFault
+
+	go r.worker(true)
+	select {
+	case qr := <-rn.respawnWorkerChan:
+		if qr != r {
+			t.Error("expected rule to be queued")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected worker to be queued for respawn")
+	}
+
+	// Not queued once stopped
+	r.stop()
+	testError(t, r.worker(true))
 }
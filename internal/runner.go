@@ -4,8 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,35 +22,76 @@ type Runner struct {
 	configuration      *Configuration
 	backend            backend
 	respawnWorkerDelay time.Duration
+	saveInterval       time.Duration
 	respawnWorkerChan  chan *rule
 	executor           executor
-	stop               context.CancelFunc
-	stopped            context.Context
+	cursors            *cursorStore
+	// Replaced by reloads
+	ignore          atomic.Pointer[ignoreList]
+	offences        *offenceStore
+	bans            *banRegistry
+	control         net.Listener
+	metrics         *http.Server
+	metricsListener net.Listener
+	timedExecutor   *timedExecutor
+	settings        string
+	dryRun          bool
+	started         time.Time
+	sources         map[string]*sharedSource
+	stop            context.CancelFunc
+	stopped         context.Context
+	// Guards the rules of the configuration, which are replaced by reloads
+	mutex sync.Mutex
 }
 
 func (rn *Runner) Initialize() error {
 	if rn.configuration == nil {
 		return errors.New("configuration has not been set")
 	}
+	// Taken before the backend fills in defaults
+	rn.settings = rn.configuration.settings()
 
 	// Backend
-	switch rn.configuration.Backend {
-	case "":
-		return errors.New("missing configuration value for backend")
-	case "ipset":
-		rn.backend = &ipsetBackend{runner: rn}
-	case "nft":
-		rn.backend = &nftBackend{runner: rn}
-	case "test":
-		rn.backend = &testBackend{runner: rn}
-	default:
-		return fmt.Errorf("unknown backend: %s", rn.configuration.Backend)
+	b, err := rn.newBackend()
+	if err != nil {
+		return err
+	}
+	rn.backend = b
+	if rn.dryRun {
+		log.Warn().Msg("dry run, not touching the firewall and not saving state")
+		rn.backend = &noopBackend{}
 	}
 	if err := rn.backend.initialize(); err != nil {
 		return fmt.Errorf("failed to initialize backend: %w", err)
 	}
 
+	// Cursors
+	if p := rn.configuration.SaveFilePath; p != "" {
+		rn.cursors = newCursorStore(p + ".cursors")
+		if err := rn.cursors.load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warn().Str("path", rn.cursors.path).Err(err).Msg("failed to load cursors")
+		}
+	}
+
+	// Offences
+	if p := rn.configuration.SaveFilePath; p != "" {
+		rn.offences = newOffenceStore(p + ".offences")
+		if err := rn.offences.load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warn().Str("path", rn.offences.path).Err(err).Msg("failed to load offences")
+		}
+	} else {
+		rn.offences = newOffenceStore("")
+	}
+
+	// Ignore list
+	il, err := newIgnoreList(rn.configuration.Ignore)
+	if err != nil {
+		return fmt.Errorf("failed to initialize ignore list: %w", err)
+	}
+	rn.ignore.Store(il)
+
 	// Rules
+	rn.sources = make(map[string]*sharedSource)
 	for n, r := range rn.configuration.Rules {
 		r.name = n
 		if err := r.initialize(rn); err != nil {
@@ -52,10 +99,73 @@ func (rn *Runner) Initialize() error {
 		}
 	}
 
+	// Not used by dry runs to leave running instances alone
+	if !rn.dryRun {
+		// Control socket
+		if err := rn.initializeControl(); err != nil {
+			return err
+		}
+
+		// Metrics
+		if err := rn.initializeMetrics(); err != nil {
+			return err
+		}
+	}
+	rn.started = time.Now()
+
 	return nil
 }
 
+// newBackend creates the configured backend without initializing it.
+func (rn *Runner) newBackend() (backend, error) {
+	switch rn.configuration.Backend {
+	case "":
+		return nil, errors.New("missing configuration value for backend")
+	case "ipset":
+		return &ipsetBackend{runner: rn}, nil
+	case "ipset-netlink":
+		return &ipsetNetlinkBackend{ipsetBackend: ipsetBackend{runner: rn}}, nil
+	case "nft":
+		return &nftBackend{runner: rn}, nil
+	case "nft-netlink":
+		return &nftNetlinkBackend{runner: rn}, nil
+	case "test":
+		return &testBackend{runner: rn}, nil
+	}
+
+	return nil, fmt.Errorf("unknown backend: %s", rn.configuration.Backend)
+}
+
 func (rn *Runner) Finalize() error {
+	if rn.control != nil {
+		// Also removes the socket
+		if err := rn.control.Close(); err != nil {
+			log.Warn().Err(err).Msg("failed to close control socket")
+		}
+	}
+
+	if rn.metrics != nil {
+		if err := rn.metrics.Close(); err != nil {
+			log.Warn().Err(err).Msg("failed to close metrics server")
+		}
+	}
+
+	if rn.dryRun {
+		return nil
+	}
+
+	if rn.cursors != nil {
+		if err := rn.cursors.save(); err != nil {
+			return fmt.Errorf(`failed to save cursors to "%s": %w`, rn.cursors.path, err)
+		}
+	}
+
+	if rn.offences.path != "" {
+		if err := rn.offences.save(); err != nil {
+			return fmt.Errorf(`failed to save offences to "%s": %w`, rn.offences.path, err)
+		}
+	}
+
 	if err := rn.backend.finalize(); err != nil {
 		return fmt.Errorf("failed to finalize backend: %w", err)
 	}
@@ -63,10 +173,44 @@ func (rn *Runner) Finalize() error {
 	return nil
 }
 
+// liftBans unbans all elements covering the IP, i.e. bans of the IP itself,
+// bans from specific ports and bans of subnets containing it. The elements
+// unbanned are returned in order, also if an error occurs.
+func (rn *Runner) liftBans(ip net.IP, ipv6 bool) ([]string, error) {
+	es, err := rn.backend.list()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list banned IPs: %w", err)
+	}
+
+	ks := make([]string, 0)
+	for k := range es {
+		n, p, err := parseElement(k)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to parse element "%s": %w`, k, err)
+		}
+		if !n.Contains(ip) {
+			continue
+		}
+		if err := rn.backend.unban(n, ipv6, p); err != nil {
+			if errors.Is(err, errNotBanned) {
+				// Expired meanwhile
+				continue
+			}
+			slices.Sort(ks)
+			return ks, fmt.Errorf(`failed to unban element "%s": %w`, k, err)
+		}
+		rn.bans.remove(k)
+		ks = append(ks, k)
+	}
+	slices.Sort(ks)
+
+	return ks, nil
+}
+
 func (rn *Runner) spawnWorker(r *rule, requeue bool) {
 	go func() {
 		select {
-		case <-rn.stopped.Done():
+		case <-r.stopped.Done():
 		default:
 			r.worker(requeue)
 		}
@@ -75,18 +219,29 @@ func (rn *Runner) spawnWorker(r *rule, requeue bool) {
 }
 
 func (rn *Runner) Run(requeueWorkers bool) {
-	for _, r := range rn.configuration.Rules {
+	for _, r := range rn.rules() {
 		rn.spawnWorker(r, requeueWorkers)
 	}
+	if rn.control != nil {
+		go rn.serveControl()
+	}
+	if rn.metrics != nil {
+		go rn.serveMetrics()
+	}
+
+	if !rn.dryRun {
+		go rn.saveRegularly()
+	}
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	defer signal.Stop(signalChan)
 
 	go func() {
 		for {
 			select {
 			case r := <-rn.respawnWorkerChan:
+				r.counters.respawns.Add(1)
 				time.Sleep(rn.respawnWorkerDelay)
 				rn.spawnWorker(r, requeueWorkers)
 			case <-rn.stopped.Done():
@@ -95,21 +250,125 @@ func (rn *Runner) Run(requeueWorkers bool) {
 		}
 	}()
 
-	select {
-	case <-rn.stopped.Done():
-	case s := <-signalChan:
-		log.Info().Str("signal", s.String()).Msg("received signal")
-		rn.stop()
+	for {
+		select {
+		case <-rn.stopped.Done():
+			return
+		case s := <-signalChan:
+			log.Info().Str("signal", s.String()).Msg("received signal")
+			if s == syscall.SIGHUP {
+				if err := rn.reload(requeueWorkers); err != nil {
+					log.Error().Err(err).Msg("failed to reload configuration, keeping current one")
+				}
+				continue
+			}
+			rn.stop()
+			return
+		}
 	}
 }
 
+// saveRegularly saves the state also kept on termination, so that little is
+// lost if gerberos crashes or is killed.
+func (rn *Runner) saveRegularly() {
+	t := time.NewTicker(rn.saveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if rn.cursors != nil {
+				if err := rn.cursors.save(); err != nil {
+					log.Warn().Str("path", rn.cursors.path).Err(err).Msg("failed to save cursors")
+				}
+			}
+			if rn.offences.path != "" {
+				if err := rn.offences.save(); err != nil {
+					log.Warn().Str("path", rn.offences.path).Err(err).Msg("failed to save offences")
+				}
+			}
+		case <-rn.stopped.Done():
+			return
+		}
+	}
+}
+
+// SetDryRun makes the runner log bans instead of performing them. The firewall
+// is not touched and nothing is saved. It must be called before Initialize.
+func (rn *Runner) SetDryRun(dryRun bool) {
+	rn.dryRun = dryRun
+}
+
+// Check validates the configuration including all rules without touching the
+// firewall or starting to read any source. All errors found are returned.
+func (rn *Runner) Check() []error {
+	c := rn.configuration
+	errs := make([]error, 0)
+
+	// Validated like the backends do when initialized
+	var hooks []string
+	verdict := ""
+	b, err := rn.newBackend()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	switch b.(type) {
+	case *ipsetBackend, *ipsetNetlinkBackend:
+		hooks, verdict = ipsetHooks, "drop"
+	case *nftBackend, *nftNetlinkBackend:
+		hooks, verdict = nftHooks, "reject"
+	}
+	if hooks != nil {
+		fw := c.Firewall
+		if err := fw.initialize(hooks, verdict); err != nil {
+			errs = append(errs, fmt.Errorf("invalid firewall configuration: %w", err))
+		}
+	}
+	rn.backend = &noopBackend{}
+
+	if c.SaveFilePath != "" {
+		// Not loaded, only required by the catch-up option
+		rn.cursors = newCursorStore("")
+	}
+
+	il, err := newIgnoreList(c.Ignore)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to initialize ignore list: %w", err))
+	}
+	rn.ignore.Store(il)
+
+	ns := make([]string, 0, len(c.Rules))
+	for n := range c.Rules {
+		ns = append(ns, n)
+	}
+	slices.Sort(ns)
+	rn.sources = make(map[string]*sharedSource)
+	for _, n := range ns {
+		r := c.Rules[n]
+		r.name = n
+		for _, err := range r.initializeOptions(rn) {
+			errs = append(errs, fmt.Errorf(`rule "%s": %w`, n, err))
+		}
+		r.stop()
+	}
+	for _, s := range rn.sources {
+		s.stop()
+	}
+
+	return errs
+}
+
 func NewRunner(c *Configuration) *Runner {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Runner{
 		configuration:      c,
 		respawnWorkerDelay: 5 * time.Second,
+		saveInterval:       time.Minute,
 		respawnWorkerChan:  make(chan *rule),
 		executor:           &defaultExecutor{},
+		sources:            make(map[string]*sharedSource),
+		offences:           newOffenceStore(""),
+		bans:               newBanRegistry(),
 		stop:               cancel,
 		stopped:            ctx,
 	}
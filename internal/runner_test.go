@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -36,6 +37,12 @@ func TestRunnerBackendInitializeInvalid(t *testing.T) {
 
 	tbi("")
 	tbi("unknown")
+
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.configuration.Backend = "ipset"
+	rn.configuration.Firewall.Hooks = []string{"prerouting"}
+	testError(t, rn.Initialize())
 }
 
 func TestRunnerBackendInitializeFaulty(t *testing.T) {
@@ -47,7 +54,7 @@ func TestRunnerBackendInitializeFaulty(t *testing.T) {
 		testError(t, rn.Initialize())
 	}
 
-	c, s4, s6 := "gerberos", "gerberos4", "gerberos6"
+	c, s4, s6, n4, n6 := "gerberos", "gerberos4", "gerberos6", "gerberos4net", "gerberos6net"
 	fi("ipset", "", 1, exec.ErrNotFound, "ipset", "list")
 	fi("ipset", "", 1, errFault, "ipset", "list")
 	fi("ipset", "", 1, exec.ErrNotFound, "iptables", "-L")
@@ -64,11 +71,21 @@ func TestRunnerBackendInitializeFaulty(t *testing.T) {
 	fi("ipset", "", 3, errFault, "ip6tables", "-X", c)
 	fi("ipset", "", 2, errFault, "ipset", "destroy", s4)
 	fi("ipset", "", 2, errFault, "ipset", "destroy", s6)
+	fi("ipset", "", 2, errFault, "ipset", "destroy", n4)
+	fi("ipset", "", 2, errFault, "ipset", "destroy", n6)
+	fi("ipset", "", 1, errFault, "ipset", "-exist", "create", n4, "hash:net", "timeout", "0")
+	fi("ipset", "", 1, errFault, "ipset", "-exist", "create", n6, "hash:net", "family", "inet6", "timeout", "0")
+	fi("ipset", "", 1, errFault, "ipset", "-exist", "create", "gerberos4port", "hash:ip,port", "timeout", "0")
+	fi("ipset", "", 1, errFault, "ipset", "-exist", "create", "gerberos6port", "hash:ip,port", "family", "inet6", "timeout", "0")
 	fi("ipset", "", 1, errFault, "iptables", "-N", c)
 	fi("ipset", "", 1, errFault, "iptables", "-I", c, "-j", "DROP", "-m", "set", "--match-set", s4, "src")
+	fi("ipset", "", 1, errFault, "iptables", "-I", c, "-j", "DROP", "-m", "set", "--match-set", n4, "src")
+	fi("ipset", "", 1, errFault, "iptables", "-I", c, "-j", "DROP", "-m", "set", "--match-set", "gerberos4port", "src,dst")
 	fi("ipset", "", 1, errFault, "iptables", "-I", "INPUT", "-j", c)
 	fi("ipset", "", 1, errFault, "ip6tables", "-N", c)
 	fi("ipset", "", 1, errFault, "ip6tables", "-I", c, "-j", "DROP", "-m", "set", "--match-set", s6, "src")
+	fi("ipset", "", 1, errFault, "ip6tables", "-I", c, "-j", "DROP", "-m", "set", "--match-set", n6, "src")
+	fi("ipset", "", 1, errFault, "ip6tables", "-I", c, "-j", "DROP", "-m", "set", "--match-set", "gerberos6port", "src,dst")
 	fi("ipset", "", 1, errFault, "ip6tables", "-I", "INPUT", "-j", c)
 
 	t4, s4, t6, s6 := "gerberos4", "set4", "gerberos6", "set6"
@@ -76,14 +93,22 @@ func TestRunnerBackendInitializeFaulty(t *testing.T) {
 	fi("nft", "", 1, errFault, "nft", "list", "ruleset")
 	fi("nft", "", 1, errFault, "nft", "add", "table", "ip", t4)
 	fi("nft", "", 1, errFault, "nft", "add", "set", "ip", t4, s4, "{ type ipv4_addr; flags timeout; }")
+	fi("nft", "", 1, errFault, "nft", "add", "set", "ip", t4, "net4", "{ type ipv4_addr; flags interval, timeout; }")
 	fi("nft", "", 1, errFault, "nft", "add", "chain", "ip", t4, "input", "{ type filter hook input priority 0; policy accept; }")
 	fi("nft", "", 1, errFault, "nft", "flush", "chain", "ip", t4, "input")
 	fi("nft", "", 1, errFault, "nft", "add", "rule", "ip", t4, "input", "ip", "saddr", "@"+s4, "reject")
+	fi("nft", "", 1, errFault, "nft", "add", "rule", "ip", t4, "input", "ip", "saddr", "@net4", "reject")
+	fi("nft", "", 1, errFault, "nft", "add", "set", "ip", t4, "port4", "{ type ipv4_addr . inet_proto . inet_service; flags timeout; }")
+	fi("nft", "", 1, errFault, "nft", "add", "rule", "ip", t4, "input", "ip", "saddr", ".", "meta", "l4proto", ".", "th", "dport", "@port4", "reject")
 	fi("nft", "", 1, errFault, "nft", "add", "table", "ip6", t6)
 	fi("nft", "", 1, errFault, "nft", "add", "set", "ip6", t6, s6, "{ type ipv6_addr; flags timeout; }")
+	fi("nft", "", 1, errFault, "nft", "add", "set", "ip6", t6, "net6", "{ type ipv6_addr; flags interval, timeout; }")
 	fi("nft", "", 1, errFault, "nft", "add", "chain", "ip6", t6, "input", "{ type filter hook input priority 0; policy accept; }")
 	fi("nft", "", 1, errFault, "nft", "flush", "chain", "ip6", t6, "input")
 	fi("nft", "", 1, errFault, "nft", "add", "rule", "ip6", t6, "input", "ip6", "saddr", "@"+s6, "reject")
+	fi("nft", "", 1, errFault, "nft", "add", "rule", "ip6", t6, "input", "ip6", "saddr", "@net6", "reject")
+	fi("nft", "", 1, errFault, "nft", "add", "set", "ip6", t6, "port6", "{ type ipv6_addr . inet_proto . inet_service; flags timeout; }")
+	fi("nft", "", 1, errFault, "nft", "add", "rule", "ip6", t6, "input", "ip6", "saddr", ".", "meta", "l4proto", ".", "th", "dport", "@port6", "reject")
 }
 
 func TestRunnerBackendFinalizeFaulty(t *testing.T) {
@@ -102,11 +127,15 @@ func TestRunnerBackendFinalizeFaulty(t *testing.T) {
 	}
 
 	t4, s4, t6, s6 := "gerberos4", "set4", "gerberos6", "set6"
-	ff("ipset", "", 1, errFault, "ipset", "save")
+	ff("ipset", "", 1, errFault, "ipset", "save", "gerberos4")
 	ff("nft", "", 1, errFault, "nft", "delete", "table", "ip", t4)
 	ff("nft", "", 1, errFault, "nft", "delete", "table", "ip6", t6)
 	ff("nft", "", 1, errFault, "nft", "list", "set", "ip", t4, s4)
 	ff("nft", "", 1, errFault, "nft", "list", "set", "ip6", t6, s6)
+	ff("nft", "", 1, errFault, "nft", "list", "set", "ip", t4, "net4")
+	ff("nft", "", 1, errFault, "nft", "list", "set", "ip6", t6, "net6")
+	ff("nft", "", 1, errFault, "nft", "list", "set", "ip", t4, "port4")
+	ff("nft", "", 1, errFault, "nft", "list", "set", "ip6", t6, "port6")
 }
 
 func TestRunnerExecute(t *testing.T) {
@@ -167,8 +196,14 @@ func TestRunnerPersistence(t *testing.T) {
 			rn.configuration.Backend = b
 			rn.configuration.SaveFilePath = tn
 			testNoError(t, rn.Initialize())
-			rn.backend.ban(net.ParseIP("123.123.123.123"), false, time.Hour)
-			rn.backend.ban(net.ParseIP("affe::affe"), true, time.Hour)
+			rn.backend.ban(hostNet(net.ParseIP("123.123.123.123")), false, time.Hour, nil)
+			rn.backend.ban(hostNet(net.ParseIP("affe::affe")), true, time.Hour, nil)
+			_, n4, _ := net.ParseCIDR("123.123.0.0/16")
+			rn.backend.ban(n4, false, time.Hour, nil)
+			_, n6, _ := net.ParseCIDR("affe::/64")
+			rn.backend.ban(n6, true, time.Hour, nil)
+			rn.backend.ban(hostNet(net.ParseIP("123.123.123.123")), false, time.Hour, &port{"tcp", 22})
+			rn.backend.ban(hostNet(net.ParseIP("affe::affe")), true, time.Hour, &port{"udp", 53})
 			testNoError(t, rn.Finalize())
 		}
 		{
@@ -227,7 +262,7 @@ func TestRunnerIpsetBackendRestoreFaulty(t *testing.T) {
 		testNoError(t, err)
 		rn.configuration.Backend = "ipset"
 		rn.configuration.SaveFilePath = tn
-		rn.executor = newTestFaultyExecutor("", 1, errFault, "ipset", "restore")
+		rn.executor = newTestFaultyExecutor("", 1, errFault, "ipset", "-exist", "restore")
 		testNoError(t, rn.Initialize())
 		rn.executor = newTestFaultyExecutor("", 1, errFault, "ipset", "create", "gerberos4", "hash:ip", "timeout", "0")
 		testError(t, rn.Initialize())
@@ -240,7 +275,10 @@ func TestRunnerIpsetBackendBanFaulty(t *testing.T) {
 	rn.configuration.Backend = "ipset"
 	testNoError(t, rn.Initialize())
 	rn.executor = newTestFaultyExecutor("", 1, errFault, "ipset", "add", "gerberos4", "123.123.123.123", "timeout", "3600")
-	testError(t, rn.backend.ban(net.ParseIP("123.123.123.123"), false, time.Hour))
+	testError(t, rn.backend.ban(hostNet(net.ParseIP("123.123.123.123")), false, time.Hour, nil))
+	_, n, _ := net.ParseCIDR("123.123.123.0/24")
+	rn.executor = newTestFaultyExecutor("", 1, errFault, "ipset", "add", "gerberos4net", "123.123.123.0/24", "timeout", "3600")
+	testError(t, rn.backend.ban(n, false, time.Hour, nil))
 }
 
 func TestRunnerIpsetBackendFinalizeFaulty(t *testing.T) {
@@ -258,13 +296,16 @@ func TestRunnerNftBackendBanFaulty(t *testing.T) {
 	rn.configuration.Backend = "nft"
 	testNoError(t, rn.Initialize())
 	rn.executor = newTestFaultyExecutor("", 1, errFault, "nft", "add", "element", "ip6", "gerberos6", "set6", "{ affe::affe timeout 3600s }")
-	testNoError(t, rn.backend.ban(net.ParseIP("affe::affe"), true, time.Hour))
+	testNoError(t, rn.backend.ban(hostNet(net.ParseIP("affe::affe")), true, time.Hour, nil))
 	rn.executor = newTestFaultyExecutor("", 2, errFault, "nft", "add", "element", "ip6", "gerberos6", "set6", "{ affe::affe timeout 3600s }")
-	testError(t, rn.backend.ban(net.ParseIP("affe::affe"), true, time.Hour))
+	testError(t, rn.backend.ban(hostNet(net.ParseIP("affe::affe")), true, time.Hour, nil))
 	rn.executor = newTestFaultyExecutor("", 1, errFault, "nft", "add", "element", "ip", "gerberos4", "set4", "{ 123.123.123.123 timeout 3600s }")
-	testNoError(t, rn.backend.ban(net.ParseIP("123.123.123.123"), false, time.Hour))
+	testNoError(t, rn.backend.ban(hostNet(net.ParseIP("123.123.123.123")), false, time.Hour, nil))
 	rn.executor = newTestFaultyExecutor("", 2, errFault, "nft", "add", "element", "ip", "gerberos4", "set4", "{ 123.123.123.123 timeout 3600s }")
-	testError(t, rn.backend.ban(net.ParseIP("123.123.123.123"), false, time.Hour))
+	testError(t, rn.backend.ban(hostNet(net.ParseIP("123.123.123.123")), false, time.Hour, nil))
+	_, n, _ := net.ParseCIDR("affe::/64")
+	rn.executor = newTestFaultyExecutor("", 2, errFault, "nft", "add", "element", "ip6", "gerberos6", "net6", "{ affe::/64 timeout 3600s }")
+	testError(t, rn.backend.ban(n, true, time.Hour, nil))
 }
 
 func TestRunnerRulesWorker(t *testing.T) {
@@ -300,7 +341,7 @@ func TestRunnerRulesWorkerMatchesFaulty(t *testing.T) {
 	testNoError(t, err)
 	testNoError(t, rn.Initialize())
 	r := rn.configuration.Rules["test"]
-	r.source.(*testSource).matchesErr = errFault
+	r.source.(*testSource).linesErr = errFault
 	r.worker(false)
 }
 
@@ -311,6 +352,56 @@ func TestRunnerRulesInvalid(t *testing.T) {
 	testError(t, rn.Initialize())
 }
 
+func TestRunnerIgnoreInvalid(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	rn.configuration.Ignore = []string{"10.0.0.0/33"}
+	testError(t, rn.Initialize())
+}
+
+func TestRunnerCheck(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	if errs := rn.Check(); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+	if len(rn.sources) != 1 {
+		t.Errorf("expected 1 source, got %d", len(rn.sources))
+	}
+	for k, s := range rn.sources {
+		if s.stopped.Err() == nil {
+			t.Errorf("expected source %s to be stopped", k)
+		}
+	}
+
+	rn, err = newTestRunner()
+	testNoError(t, err)
+	rn.configuration.Backend = "nft"
+	rn.configuration.Firewall.Hooks = []string{"docker-user"}
+	rn.configuration.Ignore = []string{"192.0.2.0/33"}
+	r := newTestValidRule()
+	r.Regexp = []string{"x"}
+	r.Action = []string{"ban", "1x"}
+	rn.configuration.Rules["invalid"] = r
+	errs := rn.Check()
+	for i, e := range []string{
+		"invalid firewall configuration",
+		"ignore list",
+		`rule "invalid": regexp:`,
+		`rule "invalid": action:`,
+	} {
+		if i >= len(errs) {
+			t.Fatalf("expected error containing %q, got %v", e, errs)
+		}
+		if !strings.Contains(errs[i].Error(), e) {
+			t.Errorf("expected error containing %q, got %q", e, errs[i])
+		}
+	}
+	if len(errs) != 4 {
+		t.Errorf("expected 4 errors, got %v", errs)
+	}
+}
+
 func TestRunnerRulesWorkerInvalidProcess(t *testing.T) {
 	rn, err := newTestRunner()
 	testNoError(t, err)
@@ -350,6 +441,7 @@ func TestRunnerSources(t *testing.T) {
 	ts([]string{"file", "test/empty"})
 	ts([]string{"systemd", "service"})
 	ts([]string{"kernel"})
+	ts([]string{"journal", "unit=service", "PRIORITY=6"})
 	ts([]string{"process", "test/quitter"})
 }
 
@@ -1,23 +1,58 @@
 package gerberos
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
 )
 
 type source interface {
 	initialize(r *rule) error
-	matches() (chan *match, error)
+	lines() (chan *line, error)
+	rule() *rule
+	setRule(r *rule)
+}
+
+// sourceRule refers to one of the rules reading a source. It provides the
+// options all of them share and names the source in logs. Once the rule is
+// removed by a reload, another one takes its place.
+type sourceRule struct {
+	owner atomic.Pointer[rule]
+}
+
+func (s *sourceRule) rule() *rule {
+	return s.owner.Load()
+}
+
+func (s *sourceRule) setRule(r *rule) {
+	s.owner.Store(r)
+}
+
+// line is a line read from a source.
+type line struct {
+	text string
+	// Optional, identifies where the line originates from within the source
+	// (for example, a file matched by a glob pattern)
+	origin string
 }
 
 type fileSource struct {
-	rule *rule
-	path string
+	sourceRule
+	path   string
+	tailer *tailer
 }
 
 func (s *fileSource) initialize(r *rule) error {
-	s.rule = r
+	s.setRule(r)
 
 	if len(r.Source) < 2 {
 		return errors.New("missing path parameter")
@@ -32,20 +67,199 @@ func (s *fileSource) initialize(r *rule) error {
 		return errors.New("superfluous parameter(s)")
 	}
 
+	s.tailer = newTailer(s.path)
+	if r.catchUp > 0 {
+		s.tailer.resume = r.runner.cursors.get(r.sourceKey(), r.catchUp)
+		s.tailer.checkpoint = func(c *cursor) {
+			r.runner.cursors.set(r.sourceKey(), c)
+		}
+	}
+
 	return nil
 }
 
-func (s *fileSource) matches() (chan *match, error) {
-	return s.rule.processScanner("tail", "-n", "0", "-F", s.path)
+func (s *fileSource) lines() (chan *line, error) {
+	c := make(chan *line, 1)
+	log.Info().Str("rule", s.rule().name).Str("path", s.path).Msg("following file")
+
+	ctx := s.rule().sharedSource.reading
+	go func() {
+		defer close(c)
+		if err := s.tailer.follow(ctx, func(l string) {
+			c <- &line{text: l}
+		}); err != nil {
+			log.Warn().Str("rule", s.rule().name).Str("path", s.path).Err(err).Msg("failed to follow file")
+		}
+	}()
+
+	return c, nil
+}
+
+const globInterval = time.Second
+
+// globRotatedRegexp matches names of rotated and compressed files, which are
+// not followed unless a pattern explicitly ends with such a suffix.
+var globRotatedRegexp = regexp.MustCompile(`(\.\d+|-\d{8}|\.old)(\.(gz|bz2|xz|zst|lz4))?$|\.(gz|bz2|xz|zst|lz4)$`)
+
+// globSource follows all files matching any of its patterns. Patterns are
+// evaluated periodically, so files created later on are followed from their
+// start and deleted files are no longer followed. Files appearing later on
+// but created before, like rotated ones, are followed from their end.
+type globSource struct {
+	sourceRule
+	patterns []string
+	interval time.Duration
+	tailers  map[string]*tailer
+	scanned  bool
+	started  time.Time
+}
+
+type globFollower struct {
+	path   string
+	cancel context.CancelFunc
+}
+
+func (s *globSource) initialize(r *rule) error {
+	s.setRule(r)
+
+	if len(r.Source) < 2 {
+		return errors.New("missing pattern parameter")
+	}
+
+	s.patterns = make([]string, 0)
+	for _, p := range r.Source[1:] {
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			p = filepath.Join(p, "*")
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf(`invalid pattern "%s": %w`, p, err)
+		}
+		s.patterns = append(s.patterns, p)
+	}
+
+	s.interval = globInterval
+	s.tailers = make(map[string]*tailer)
+
+	return nil
+}
+
+func (s *globSource) glob() map[string]struct{} {
+	ps := make(map[string]struct{})
+	for _, p := range s.patterns {
+		ms, _ := filepath.Glob(p)
+		rotated := globRotatedRegexp.MatchString(p)
+		for _, m := range ms {
+			if !rotated && globRotatedRegexp.MatchString(m) {
+				continue
+			}
+			if fi, err := os.Stat(m); err == nil && !fi.IsDir() {
+				ps[m] = struct{}{}
+			}
+		}
+	}
+
+	return ps
+}
+
+func (s *globSource) lines() (chan *line, error) {
+	c := make(chan *line, 1)
+	log.Info().Str("rule", s.rule().name).Strs("patterns", s.patterns).Msg("following files matching patterns")
+
+	if !s.scanned {
+		s.started = time.Now()
+	}
+	ctx := s.rule().sharedSource.reading
+	go func() {
+		wg := &sync.WaitGroup{}
+		fs := make(map[string]*globFollower)
+		ended := make(chan *globFollower)
+
+		tk := time.NewTicker(s.interval)
+		defer tk.Stop()
+		for {
+			ps := s.glob()
+			for p := range ps {
+				if _, e := fs[p]; e {
+					continue
+				}
+
+				t, e := s.tailers[p]
+				if !e {
+					t = newTailer(p)
+					// Files created after the initial scan are read from their start
+					t.positioned = s.scanned && !fileCreated(p).Before(s.started)
+					s.tailers[p] = t
+				}
+
+				fctx, cancel := context.WithCancel(ctx)
+				f := &globFollower{path: p, cancel: cancel}
+				fs[p] = f
+				log.Info().Str("rule", s.rule().name).Str("path", p).Msg("following file")
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := t.follow(fctx, func(l string) {
+						c <- &line{text: l, origin: p}
+					}); err != nil {
+						log.Warn().Str("rule", s.rule().name).Str("path", p).Err(err).Msg("failed to follow file")
+					}
+					select {
+					case ended <- f:
+					case <-ctx.Done():
+					}
+				}()
+			}
+
+			for p, f := range fs {
+				if _, e := ps[p]; !e {
+					f.cancel()
+					delete(fs, p)
+					delete(s.tailers, p)
+					log.Info().Str("rule", s.rule().name).Str("path", p).Msg("stopped following deleted file")
+				}
+			}
+			s.scanned = true
+
+			select {
+			case <-ctx.Done():
+				wg.Wait()
+				close(c)
+				return
+			case f := <-ended:
+				// Following is retried with the next scan
+				if fs[f.path] == f {
+					delete(fs, f.path)
+				}
+			case <-tk.C:
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// fileCreated returns the birth time of a file or, if the file system does
+// not record it, its modification time.
+func fileCreated(path string) time.Time {
+	st := unix.Statx_t{}
+	if err := unix.Statx(unix.AT_FDCWD, path, 0, unix.STATX_BTIME|unix.STATX_MTIME, &st); err != nil {
+		return time.Time{}
+	}
+	if st.Mask&unix.STATX_BTIME != 0 {
+		return time.Unix(st.Btime.Sec, int64(st.Btime.Nsec))
+	}
+
+	return time.Unix(st.Mtime.Sec, int64(st.Mtime.Nsec))
 }
 
 type systemdSource struct {
-	rule    *rule
+	sourceRule
 	service string
+	journal *journalFollower
 }
 
 func (s *systemdSource) initialize(r *rule) error {
-	s.rule = r
+	s.setRule(r)
 
 	if len(r.Source) < 2 {
 		return errors.New("missing service parameter")
@@ -56,63 +270,80 @@ func (s *systemdSource) initialize(r *rule) error {
 		return errors.New("superfluous parameter(s)")
 	}
 
+	if r.catchUp > 0 {
+		s.journal = newJournalFollower(&s.sourceRule, journalEntry.short)
+	}
+
 	return nil
 }
 
-func (s *systemdSource) matches() (chan *match, error) {
-	return s.rule.processScanner("journalctl", "-n", "0", "-f", "-u", s.service)
+func (s *systemdSource) lines() (chan *line, error) {
+	if s.journal != nil {
+		return s.journal.lines("-u", s.service)
+	}
+
+	return s.rule().processScanner("journalctl", "-n", "0", "-f", "-u", s.service)
 }
 
 type kernelSource struct {
-	rule *rule
+	sourceRule
+	journal *journalFollower
 }
 
 func (k *kernelSource) initialize(r *rule) error {
-	k.rule = r
+	k.setRule(r)
 
 	if len(r.Source) > 1 {
 		return errors.New("superfluous parameter(s)")
 	}
 
+	if r.catchUp > 0 {
+		k.journal = newJournalFollower(&k.sourceRule, journalEntry.short)
+	}
+
 	return nil
 }
 
-func (k *kernelSource) matches() (chan *match, error) {
-	return k.rule.processScanner("journalctl", "-kf", "-n", "0")
+func (k *kernelSource) lines() (chan *line, error) {
+	if k.journal != nil {
+		return k.journal.lines("-k")
+	}
+
+	return k.rule().processScanner("journalctl", "-kf", "-n", "0")
 }
 
 type testSource struct {
-	rule        *rule
-	matchesErr  error
+	sourceRule
+	linesErr    error
 	processPath string
 }
 
 func (s *testSource) initialize(r *rule) error {
-	s.rule = r
+	s.setRule(r)
 
 	return nil
 }
 
-func (s *testSource) matches() (chan *match, error) {
-	if s.matchesErr != nil {
-		return nil, s.matchesErr
+func (s *testSource) lines() (chan *line, error) {
+	if s.linesErr != nil {
+		return nil, s.linesErr
 	}
 
 	p := "test/producer"
 	if s.processPath != "" {
 		p = s.processPath
 	}
-	return s.rule.processScanner(p)
+	return s.rule().processScanner(p)
 }
 
 type processSource struct {
-	rule *rule
+	sourceRule
 	name string
 	args []string
 }
 
 func (s *processSource) initialize(r *rule) error {
-	s.rule = r
+	s.setRule(r)
 
 	if len(r.Source) < 2 {
 		return errors.New("missing process name")
@@ -124,6 +355,186 @@ func (s *processSource) initialize(r *rule) error {
 	return nil
 }
 
-func (s *processSource) matches() (chan *match, error) {
-	return s.rule.processScanner(s.name, s.args...)
+func (s *processSource) lines() (chan *line, error) {
+	return s.rule().processScanner(s.name, s.args...)
+}
+
+// sharedSourceBuffer is the number of lines buffered for each subscription.
+const sharedSourceBuffer = 1024
+
+// sharedSource fans out the lines of a source to all workers subscribed to it.
+// The source is read as long as there are subscribers. Once it is exhausted,
+// all subscriptions end.
+type sharedSource struct {
+	source      source
+	mutex       sync.Mutex
+	subscribers map[chan *line]*subscription
+	running     bool
+	// Closed once the source has been read to its end
+	done chan struct{}
+	// Cancelled once no rule uses the source anymore
+	stopped context.Context
+	stop    context.CancelFunc
+	// Cancelled once the last subscription ends, renewed when reading again
+	reading     context.Context
+	stopReading context.CancelFunc
+}
+
+// subscription buffers lines for a single worker. Lines are dropped while the
+// buffer is full, so that a slow worker does not hold up the others.
+type subscription struct {
+	rule  *rule
+	lines chan *line
+	// Guards closing lines against sends
+	mutex    sync.Mutex
+	closed   bool
+	dropping bool
+}
+
+func (sb *subscription) send(l *line) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	if sb.closed {
+		return
+	}
+	select {
+	case sb.lines <- l:
+		sb.dropping = false
+	default:
+		sb.rule.counters.droppedLines.Add(1)
+		if !sb.dropping {
+			log.Warn().Str("rule", sb.rule.name).Msg("dropping lines, worker is too slow")
+			sb.dropping = true
+		}
+	}
+}
+
+func (sb *subscription) close() {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	if !sb.closed {
+		close(sb.lines)
+		sb.closed = true
+	}
+}
+
+func (s *sharedSource) subscribe(r *rule) (chan *line, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Replaces a rule removed by a reload
+	if o := s.source.rule(); o == nil || o.stopped == nil || o.stopped.Err() != nil {
+		s.source.setRule(r)
+	}
+
+	// Read again once the previous reading has ended
+	for s.running && s.reading.Err() != nil {
+		d := s.done
+		s.mutex.Unlock()
+		<-d
+		s.mutex.Lock()
+	}
+	if !s.running {
+		if s.reading.Err() != nil {
+			s.reading, s.stopReading = context.WithCancel(s.stopped)
+		}
+		ls, err := s.source.lines()
+		if err != nil {
+			return nil, err
+		}
+		s.running = true
+		s.done = make(chan struct{})
+		go s.fanOut(ls)
+	}
+
+	sb := &subscription{
+		rule:  r,
+		lines: make(chan *line, sharedSourceBuffer),
+	}
+	s.subscribers[sb.lines] = sb
+
+	return sb.lines, nil
+}
+
+// unsubscribe ends a subscription before the source is exhausted. Lines still
+// pending are discarded. The source stops being read along with the last
+// subscription.
+func (s *sharedSource) unsubscribe(c chan *line) {
+	s.mutex.Lock()
+	sb, ok := s.subscribers[c]
+	if ok {
+		delete(s.subscribers, c)
+		if s.source.rule() == sb.rule {
+			for _, o := range s.subscribers {
+				s.source.setRule(o.rule)
+				break
+			}
+		}
+		if len(s.subscribers) == 0 {
+			s.stopReading()
+		}
+	}
+	s.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	sb.close()
+}
+
+func (s *sharedSource) fanOut(ls chan *line) {
+	for l := range ls {
+		// Sent without holding the mutex, so that subscriptions may change
+		s.mutex.Lock()
+		sbs := make([]*subscription, 0, len(s.subscribers))
+		for _, sb := range s.subscribers {
+			sbs = append(sbs, sb)
+		}
+		s.mutex.Unlock()
+		for _, sb := range sbs {
+			sb.send(l)
+		}
+	}
+
+	s.mutex.Lock()
+	for c, sb := range s.subscribers {
+		sb.close()
+		delete(s.subscribers, c)
+	}
+	s.running = false
+	close(s.done)
+	s.mutex.Unlock()
+}
+
+// wait blocks until the source has been read to its end, so that resources
+// like listening sockets are released, or until the timeout has passed.
+func (s *sharedSource) wait(timeout time.Duration) bool {
+	s.mutex.Lock()
+	d := s.done
+	s.mutex.Unlock()
+	if d == nil {
+		return true
+	}
+
+	select {
+	case <-d:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func newSharedSource(ctx context.Context, s source) *sharedSource {
+	ctx, cancel := context.WithCancel(ctx)
+	rctx, rcancel := context.WithCancel(ctx)
+	return &sharedSource{
+		source:      s,
+		subscribers: make(map[chan *line]*subscription),
+		stopped:     ctx,
+		stop:        cancel,
+		reading:     rctx,
+		stopReading: rcancel,
+	}
 }
@@ -0,0 +1,172 @@
+package gerberos
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedSource(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	p := filepath.Join(t.TempDir(), "log")
+	testTailerAppend(t, p, "")
+
+	r1, r2, r3 := newTestValidRule(), newTestValidRule(), newTestValidRule()
+	r1.Source = []string{"file", p}
+	r2.Source = []string{"file", p}
+	r3.Source = []string{"file", p + ".other"}
+	for _, r := range []*rule{r1, r2, r3} {
+		testNoError(t, r.initialize(rn))
+	}
+	if r1.sharedSource != r2.sharedSource || r1.source != r2.source {
+		t.Error("expected identical sources to be shared")
+	}
+	if r1.sharedSource == r3.sharedSource {
+		t.Error("expected different sources not to be shared")
+	}
+
+	c1, err := r1.sharedSource.subscribe(r1)
+	testNoError(t, err)
+	c2, err := r2.sharedSource.subscribe(r2)
+	testNoError(t, err)
+	time.Sleep(2 * tailerInterval)
+	testTailerAppend(t, p, "line\n")
+	for _, c := range []chan *line{c1, c2} {
+		select {
+		case l := <-c:
+			if l.text != "line" {
+				t.Errorf(`unexpected line "%s"`, l.text)
+			}
+		case <-time.After(time.Second):
+			t.Error("expected line")
+		}
+	}
+
+	rn.stop()
+	for _, c := range []chan *line{c1, c2} {
+		for range c {
+		}
+	}
+}
+
+func TestSharedSourceSlowSubscriber(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	defer rn.stop()
+	p := filepath.Join(t.TempDir(), "log")
+	testTailerAppend(t, p, "")
+
+	r1, r2 := newTestValidRule(), newTestValidRule()
+	r1.Source = []string{"file", p}
+	r2.Source = []string{"file", p}
+	for _, r := range []*rule{r1, r2} {
+		testNoError(t, r.initialize(rn))
+	}
+	ss := r1.sharedSource
+	c1, err := ss.subscribe(r1)
+	testNoError(t, err)
+	c2, err := ss.subscribe(r2)
+	testNoError(t, err)
+	time.Sleep(2 * tailerInterval)
+
+	// The first subscriber never reads
+	rc := func(c chan *line, m int) {
+		t.Helper()
+		for i := 0; i < m; i++ {
+			select {
+			case <-c:
+			case <-time.After(time.Second):
+				t.Fatalf("expected line %d", i)
+			}
+		}
+	}
+	for i := 0; i < sharedSourceBuffer/128+1; i++ {
+		testTailerAppend(t, p, strings.Repeat("line\n", 128))
+		rc(c2, 128)
+	}
+	if d := r1.counters.droppedLines.Load(); d != 128 {
+		t.Errorf("expected 128 dropped lines, got %d", d)
+	}
+	if d := r2.counters.droppedLines.Load(); d != 0 {
+		t.Errorf("expected no dropped lines, got %d", d)
+	}
+
+	ss.unsubscribe(c1)
+	if ss.source.rule() != r2 {
+		t.Error("expected remaining subscriber to own the source")
+	}
+
+	// Not read without subscribers, read again once subscribed
+	ss.unsubscribe(c2)
+	if !ss.wait(time.Second) {
+		t.Error("expected source to stop being read")
+	}
+	c2, err = ss.subscribe(r2)
+	testNoError(t, err)
+	time.Sleep(2 * tailerInterval)
+	testTailerAppend(t, p, "again\n")
+	rc(c2, 1)
+}
+
+func TestGlobSource(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+	d := t.TempDir()
+	a, b := filepath.Join(d, "a.log"), filepath.Join(d, "b.log")
+	testTailerAppend(t, a, "old\n")
+	testTailerAppend(t, filepath.Join(d, "ignored"), "")
+	m, o := filepath.Join(d, "m.log"), filepath.Join(t.TempDir(), "m.log")
+	testTailerAppend(t, o, "moved\n")
+
+	r := newTestValidRule()
+	r.Source = []string{"glob", filepath.Join(d, "*.log")}
+	testNoError(t, r.initialize(rn))
+	s := r.source.(*globSource)
+	s.interval = 10 * time.Millisecond
+	c, err := s.lines()
+	testNoError(t, err)
+	time.Sleep(2 * tailerInterval)
+
+	ex := func(text, origin string) {
+		t.Helper()
+		select {
+		case l := <-c:
+			if l.text != text || l.origin != origin {
+				t.Errorf(`expected line "%s" from "%s", got "%s" from "%s"`, text, origin, l.text, l.origin)
+			}
+		case <-time.After(time.Second):
+			t.Error("expected line")
+		}
+	}
+
+	testTailerAppend(t, a, "new\n")
+	ex("new", a)
+	testTailerAppend(t, b, "created later\n")
+	ex("created later", b)
+
+	// Rotated and compressed files are not followed
+	testNoError(t, os.Rename(b, b+".1"))
+	testTailerAppend(t, b+".1", "rotated\n")
+	testTailerAppend(t, b+".gz", "compressed\n")
+	// Files created before the source started are followed from their end
+	testNoError(t, os.Rename(o, m))
+	time.Sleep(2 * tailerInterval)
+	testTailerAppend(t, m, "after move\n")
+	ex("after move", m)
+	if ps := (&globSource{patterns: []string{filepath.Join(d, "*.gz")}}).glob(); len(ps) != 1 {
+		t.Errorf("expected explicitly matched compressed file, got %v", ps)
+	}
+
+	testNoError(t, os.Remove(a))
+	time.Sleep(2 * tailerInterval)
+
+	rn.stop()
+	for range c {
+	}
+	if _, e := s.tailers[a]; e {
+		t.Error("expected deleted file not to be followed")
+	}
+}
@@ -0,0 +1,390 @@
+package gerberos
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const syslogMaxMessageLength = 64 * 1024
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+type syslogMessage struct {
+	facility int
+	severity int
+	hostname string
+	appName  string
+	procID   string
+	msgID    string
+	message  string
+}
+
+func parseSyslogSeverity(s string) (int, error) {
+	switch s {
+	case "error":
+		s = "err"
+	case "warn":
+		s = "warning"
+	}
+	if i := slices.Index(syslogSeverities, s); i >= 0 {
+		return i, nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i >= len(syslogSeverities) {
+		return 0, fmt.Errorf(`unknown severity "%s"`, s)
+	}
+
+	return i, nil
+}
+
+// syslogField splits off the next field delimited by a space.
+func syslogField(s string) (string, string) {
+	f, r, _ := strings.Cut(s, " ")
+	return f, r
+}
+
+func syslogNil(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// parseSyslogMessage parses messages formatted according to RFC 5424 or,
+// leniently, RFC 3164.
+func parseSyslogMessage(s string) (*syslogMessage, error) {
+	s = strings.TrimRight(s, "\r\n\x00")
+
+	if !strings.HasPrefix(s, "<") {
+		return nil, errors.New("missing priority")
+	}
+	e := strings.IndexByte(s, '>')
+	if e < 2 || e > 4 {
+		return nil, errors.New("invalid priority")
+	}
+	p, err := strconv.Atoi(s[1:e])
+	if err != nil || p < 0 || p > 191 {
+		return nil, errors.New("invalid priority")
+	}
+	m := &syslogMessage{
+		facility: p / 8,
+		severity: p % 8,
+	}
+	s = s[e+1:]
+
+	if strings.HasPrefix(s, "1 ") {
+		return m, m.parseRFC5424(s[2:])
+	}
+
+	m.parseRFC3164(s)
+
+	return m, nil
+}
+
+func (m *syslogMessage) parseRFC5424(s string) error {
+	var f string
+	_, s = syslogField(s) // Timestamp
+	f, s = syslogField(s)
+	m.hostname = syslogNil(f)
+	f, s = syslogField(s)
+	m.appName = syslogNil(f)
+	f, s = syslogField(s)
+	m.procID = syslogNil(f)
+	f, s = syslogField(s)
+	m.msgID = syslogNil(f)
+
+	// Structured data
+	switch {
+	case strings.HasPrefix(s, "-"):
+		s = s[1:]
+	case strings.HasPrefix(s, "["):
+		q, esc := false, false
+		i := 0
+	sd:
+		for ; i < len(s); i++ {
+			switch {
+			case esc:
+				esc = false
+			case s[i] == '\\':
+				esc = true
+			case s[i] == '"':
+				q = !q
+			case !q && s[i] == ']' && (i+1 == len(s) || s[i+1] != '['):
+				i++
+				break sd
+			}
+		}
+		if q {
+			return errors.New("unterminated structured data")
+		}
+		s = s[i:]
+	default:
+		return errors.New("missing structured data")
+	}
+
+	s = strings.TrimPrefix(s, " ")
+	m.message = strings.TrimPrefix(s, "\ufeff")
+
+	return nil
+}
+
+func (m *syslogMessage) parseRFC3164(s string) {
+	// Timestamp ("Mmm dd hh:mm:ss"), which some senders omit
+	if len(s) >= 16 && s[15] == ' ' {
+		if _, err := time.Parse(time.Stamp, s[:15]); err == nil {
+			s = s[16:]
+
+			// Hostname, unless the field is already the tag
+			if f, r := syslogField(s); r != "" && !strings.ContainsAny(f, ":[") {
+				m.hostname, s = f, r
+			}
+		}
+	}
+
+	// Tag with optional process ID
+	i := strings.IndexFunc(s, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_-./", c))
+	})
+	if i > 0 && i <= 48 {
+		t, r := s[:i], s[i:]
+		if strings.HasPrefix(r, "[") {
+			if j := strings.Index(r, "]"); j > 0 {
+				m.procID, r = r[1:j], r[j+1:]
+			}
+		}
+		if strings.HasPrefix(r, ":") {
+			m.appName, s = t, strings.TrimPrefix(r[1:], " ")
+		}
+	}
+
+	m.message = s
+}
+
+type syslogSource struct {
+	sourceRule
+	network   string
+	address   string
+	hostnames []string
+	appNames  []string
+	severity  int
+}
+
+func (s *syslogSource) initialize(r *rule) error {
+	s.setRule(r)
+
+	if len(r.Source) < 2 {
+		return errors.New("missing address parameter")
+	}
+	u, err := url.Parse(r.Source[1])
+	if err != nil {
+		return fmt.Errorf("failed to parse address parameter: %w", err)
+	}
+	s.network = u.Scheme
+	switch s.network {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return errors.New("missing host in address parameter")
+		}
+		s.address = u.Host
+	case "unix", "unixgram":
+		if u.Path == "" {
+			return errors.New("missing path in address parameter")
+		}
+		s.address = u.Path
+	default:
+		return fmt.Errorf(`unknown network "%s" in address parameter`, s.network)
+	}
+
+	s.severity = len(syslogSeverities) - 1
+	for _, p := range r.Source[2:] {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || v == "" {
+			return fmt.Errorf(`invalid filter parameter "%s"`, p)
+		}
+		switch k {
+		case "hostname":
+			s.hostnames = strings.Split(v, ",")
+		case "app":
+			s.appNames = strings.Split(v, ",")
+		case "severity":
+			if s.severity, err = parseSyslogSeverity(v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf(`unknown filter parameter "%s"`, k)
+		}
+	}
+
+	return nil
+}
+
+func (s *syslogSource) processMessage(b string, c chan *line) {
+	m, err := parseSyslogMessage(b)
+	if err != nil {
+		log.Debug().Str("rule", s.rule().name).Err(err).Msg("failed to parse syslog message")
+		return
+	}
+
+	if m.severity > s.severity ||
+		s.hostnames != nil && !slices.Contains(s.hostnames, m.hostname) ||
+		s.appNames != nil && !slices.Contains(s.appNames, m.appName) {
+		return
+	}
+
+	c <- &line{text: m.message}
+}
+
+func (s *syslogSource) servePacketConn(pc net.PacketConn, c chan *line) error {
+	b := make([]byte, syslogMaxMessageLength)
+	for {
+		n, _, err := pc.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+		s.processMessage(string(b[:n]), c)
+	}
+}
+
+// scanSyslogFrames splits a stream into messages framed by octet counting or,
+// if a frame does not start with a digit, by line feeds (RFC 6587).
+func scanSyslogFrames(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) > 0 && data[0] >= '0' && data[0] <= '9' {
+		i := bytes.IndexByte(data, ' ')
+		if i < 0 {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		n, err := strconv.Atoi(string(data[:i]))
+		if err != nil || n > syslogMaxMessageLength {
+			return 0, nil, errors.New("invalid frame length")
+		}
+		if len(data) < i+1+n {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			return 0, nil, nil
+		}
+		return i + 1 + n, data[i+1 : i+1+n], nil
+	}
+
+	return bufio.ScanLines(data, atEOF)
+}
+
+func (s *syslogSource) serveConn(conn net.Conn, c chan *line) {
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), syslogMaxMessageLength+16)
+	sc.Split(scanSyslogFrames)
+	for sc.Scan() {
+		if len(sc.Bytes()) > 0 {
+			s.processMessage(sc.Text(), c)
+		}
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Debug().Str("rule", s.rule().name).Err(err).Msg("failed to read syslog connection")
+	}
+}
+
+func (s *syslogSource) serveListener(l net.Listener, c chan *line) error {
+	conns := make(map[net.Conn]struct{})
+	mutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	defer func() {
+		mutex.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mutex.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		mutex.Lock()
+		conns[conn] = struct{}{}
+		mutex.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveConn(conn, c)
+			conn.Close()
+			mutex.Lock()
+			delete(conns, conn)
+			mutex.Unlock()
+		}()
+	}
+}
+
+func (s *syslogSource) lines() (chan *line, error) {
+	if s.network == "unix" || s.network == "unixgram" {
+		// Remove stale socket
+		if err := os.Remove(s.address); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	var (
+		cl    io.Closer
+		serve func(c chan *line) error
+	)
+	switch s.network {
+	case "udp", "unixgram":
+		pc, err := net.ListenPacket(s.network, s.address)
+		if err != nil {
+			return nil, err
+		}
+		cl, serve = pc, func(c chan *line) error {
+			return s.servePacketConn(pc, c)
+		}
+	default:
+		l, err := net.Listen(s.network, s.address)
+		if err != nil {
+			return nil, err
+		}
+		cl, serve = l, func(c chan *line) error {
+			return s.serveListener(l, c)
+		}
+	}
+	log.Info().Str("rule", s.rule().name).Str("network", s.network).Str("address", s.address).Msg("listening for syslog messages")
+
+	ctx := s.rule().sharedSource.reading
+	c := make(chan *line, 1)
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		cl.Close()
+	}()
+	go func() {
+		if err := serve(c); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Warn().Str("rule", s.rule().name).Str("network", s.network).Str("address", s.address).Err(err).Msg("failed to receive syslog messages")
+		}
+		// Closed before the channel, so that the address can be reused right away
+		cl.Close()
+		close(done)
+		close(c)
+	}()
+
+	return c, nil
+}
@@ -0,0 +1,112 @@
+package gerberos
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogParse(t *testing.T) {
+	p := func(s string, severity int, hostname, appName, procID, message string) {
+		t.Helper()
+		m, err := parseSyslogMessage(s)
+		testNoError(t, err)
+		if m == nil {
+			return
+		}
+		if m.severity != severity || m.hostname != hostname || m.appName != appName || m.procID != procID || m.message != message {
+			t.Errorf("unexpected result for %q: %+v", s, m)
+		}
+	}
+
+	p("<34>Oct 11 22:14:15 mymachine su: 'su root' failed", 2, "mymachine", "su", "", "'su root' failed")
+	p("<38>Oct  1 22:14:15 host sshd[123]: Failed password from 1.2.3.4\n", 6, "host", "sshd", "123", "Failed password from 1.2.3.4")
+	p("<38>Oct  1 22:14:15 sshd[123]: no hostname", 6, "", "sshd", "123", "no hostname")
+	p("<13>no header at all", 5, "", "", "", "no header at all")
+	p("<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut=\"3\" eventSource=\"Appl]ication\"][other@1 a=\"\\\"\"] An application event", 5, "mymachine.example.com", "evntslog", "", "An application event")
+	p("<86>1 2024-01-01T00:00:00Z host sshd 42 - - \ufeffFailed password", 6, "host", "sshd", "42", "Failed password")
+	p("<86>1 - - - - - -", 6, "", "", "", "")
+
+	e := func(s string) {
+		t.Helper()
+		_, err := parseSyslogMessage(s)
+		testError(t, err)
+	}
+
+	e("no priority")
+	e("<>empty priority")
+	e("<192>priority too large")
+	e("<1234>priority too long")
+	e("<86>1 - - - - - missing structured data")
+	e(`<86>1 - - - - - [id a="unterminated]`)
+}
+
+func TestSyslogScanFrames(t *testing.T) {
+	sc := bufio.NewScanner(strings.NewReader("5 <1>ab<1>line\n\n3 <1>"))
+	sc.Split(scanSyslogFrames)
+	var fs []string
+	for sc.Scan() {
+		fs = append(fs, sc.Text())
+	}
+	if strings.Join(fs, "|") != "<1>ab|<1>line||<1>" {
+		t.Errorf("unexpected frames %q", fs)
+	}
+
+	sc = bufio.NewScanner(strings.NewReader("10 <1>"))
+	sc.Split(scanSyslogFrames)
+	for sc.Scan() {
+	}
+	testError(t, sc.Err())
+}
+
+func TestSyslogSource(t *testing.T) {
+	ts := func(address, network, dialAddress string, filters ...string) {
+		t.Helper()
+		rn, err := newTestRunner()
+		testNoError(t, err)
+		r := newTestValidRule()
+		r.Source = append([]string{"syslog", address}, filters...)
+		testNoError(t, r.initialize(rn))
+		c, err := r.source.lines()
+		testNoError(t, err)
+		if err != nil {
+			return
+		}
+
+		conn, err := net.Dial(network, dialAddress)
+		testNoError(t, err)
+		for _, m := range []string{
+			"<38>Oct  1 22:14:15 other sshd[1]: from 1.1.1.1",
+			"<39>Oct  1 22:14:15 host sshd[1]: from 2.2.2.2",
+			"<38>Oct  1 22:14:15 host sshd[1]: from 3.3.3.3",
+		} {
+			if network == "tcp" || network == "unix" {
+				m = fmt.Sprintf("%d %s", len(m), m)
+			}
+			_, err = conn.Write([]byte(m))
+			testNoError(t, err)
+		}
+		select {
+		case l := <-c:
+			if l.text != "from 3.3.3.3" {
+				t.Errorf(`unexpected line "%s"`, l.text)
+			}
+		case <-time.After(time.Second):
+			t.Error("expected line")
+		}
+		conn.Close()
+		rn.stop()
+		for range c {
+		}
+	}
+
+	p := filepath.Join(t.TempDir(), "syslog.sock")
+	ts("udp://127.0.0.1:55140", "udp", "127.0.0.1:55140", "hostname=host", "severity=info")
+	ts("tcp://127.0.0.1:55140", "tcp", "127.0.0.1:55140", "app=sshd,su", "hostname=host", "severity=6")
+	ts("unix://"+p, "unix", p, "hostname=host", "severity=info")
+	ts("unixgram://"+p, "unixgram", p, "hostname=host", "severity=info")
+}
@@ -0,0 +1,187 @@
+package gerberos
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+const (
+	tailerInterval      = 250 * time.Millisecond
+	tailerMaxLineLength = 64 * 1024
+)
+
+// tailer follows a file by name the way "tail -n 0 -F" does. The file does
+// not need to exist, and truncation as well as rotation by renaming and
+// recreating it are detected. Since the offset is kept between calls to
+// follow, no lines are lost if following is interrupted and resumed.
+type tailer struct {
+	path     string
+	interval time.Duration
+	info     os.FileInfo
+	offset   int64
+	// Whether the initial position has been determined. Only a file that
+	// already exists the first time it is looked for is read from its end.
+	positioned bool
+	// If set, the initial position is taken from this cursor as long as it
+	// refers to the same file.
+	resume *cursor
+	// If set, this function is called whenever the offset has advanced.
+	checkpoint func(c *cursor)
+	buffer     []byte
+}
+
+func (t *tailer) open() (*os.File, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	switch {
+	case t.info != nil && os.SameFile(t.info, fi) && fi.Size() >= t.offset:
+		// Resume where reading stopped
+	case !t.positioned && t.resume != nil:
+		t.offset = 0
+		if d, i := fileIdentity(fi); d == t.resume.Device && i == t.resume.Inode && fi.Size() >= t.resume.Offset {
+			t.offset = t.resume.Offset
+		}
+	case !t.positioned:
+		t.offset = fi.Size()
+	default:
+		t.offset = 0
+	}
+	t.info = fi
+
+	return f, nil
+}
+
+func (t *tailer) read(f *os.File, line func(string)) error {
+	o := t.offset
+	defer func() {
+		if t.checkpoint != nil && t.offset != o {
+			d, i := fileIdentity(t.info)
+			t.checkpoint(&cursor{Device: d, Inode: i, Offset: t.offset})
+		}
+	}()
+
+	var p []byte
+	for {
+		n, err := f.ReadAt(t.buffer, t.offset+int64(len(p)))
+		p = append(p, t.buffer[:n]...)
+		for {
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				if len(p) < tailerMaxLineLength {
+					break
+				}
+				i = len(p)
+			}
+			t.offset += int64(i)
+			if i < len(p) {
+				t.offset++
+			}
+			line(string(bytes.TrimSuffix(p[:i], []byte{'\r'})))
+			p = p[min(i+1, len(p)):]
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rotated reports whether the file at the tailer's path has been replaced.
+// A truncated file is read from the start again.
+func (t *tailer) rotated(f *os.File) (bool, error) {
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			// Keep reading the old file until a new one appears
+			return false, nil
+		}
+		return false, err
+	}
+
+	if !os.SameFile(t.info, fi) {
+		return true, nil
+	}
+
+	if fi, err = f.Stat(); err != nil {
+		return false, err
+	}
+	if fi.Size() < t.offset {
+		t.offset = 0
+	}
+
+	return false, nil
+}
+
+func (t *tailer) follow(ctx context.Context, line func(string)) error {
+	if t.buffer == nil {
+		t.buffer = make([]byte, 32*1024)
+	}
+
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	tk := time.NewTicker(t.interval)
+	defer tk.Stop()
+	for {
+		if f == nil {
+			var err error
+			if f, err = t.open(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			t.positioned = true
+		}
+
+		if f != nil {
+			if err := t.read(f, line); err != nil {
+				return err
+			}
+
+			r, err := t.rotated(f)
+			if err != nil {
+				return err
+			}
+			if r {
+				// Lines might have been written to the old file after the last read
+				if err := t.read(f, line); err != nil {
+					return err
+				}
+				f.Close()
+				f, t.info = nil, nil
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tk.C:
+		}
+	}
+}
+
+func newTailer(path string) *tailer {
+	return &tailer{
+		path:     path,
+		interval: tailerInterval,
+	}
+}
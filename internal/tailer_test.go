@@ -0,0 +1,138 @@
+package gerberos
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testTailerFollow(t *testing.T, tl *tailer) (chan string, context.CancelFunc) {
+	t.Helper()
+	tl.interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan string, 100)
+	go func() {
+		tl.follow(ctx, func(l string) { c <- l })
+		close(c)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	return c, cancel
+}
+
+func testTailerExpect(t *testing.T, c chan string, ls ...string) {
+	t.Helper()
+	var r []string
+	for range ls {
+		select {
+		case l := <-c:
+			r = append(r, l)
+		case <-time.After(time.Second):
+		}
+	}
+	if !reflect.DeepEqual(r, ls) {
+		t.Errorf("expected lines %q, got %q", ls, r)
+	}
+}
+
+func testTailerAppend(t *testing.T, p, s string) {
+	t.Helper()
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	testNoError(t, err)
+	_, err = f.WriteString(s)
+	testNoError(t, err)
+	testNoError(t, f.Close())
+}
+
+func TestTailerStartAtEnd(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "log")
+	testTailerAppend(t, p, "old\n")
+	c, cancel := testTailerFollow(t, newTailer(p))
+	defer cancel()
+	testTailerAppend(t, p, "new 1\nnew 2\r\npartial")
+	testTailerExpect(t, c, "new 1", "new 2")
+	testTailerAppend(t, p, " line\n")
+	testTailerExpect(t, c, "partial line")
+}
+
+func TestTailerMissingFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "log")
+	c, cancel := testTailerFollow(t, newTailer(p))
+	defer cancel()
+	testTailerAppend(t, p, "first\nsecond\n")
+	testTailerExpect(t, c, "first", "second")
+}
+
+func TestTailerTruncate(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "log")
+	testTailerAppend(t, p, "")
+	c, cancel := testTailerFollow(t, newTailer(p))
+	defer cancel()
+	testTailerAppend(t, p, "before truncation\n")
+	testTailerExpect(t, c, "before truncation")
+	testNoError(t, os.Truncate(p, 0))
+	time.Sleep(50 * time.Millisecond)
+	testTailerAppend(t, p, "after\n")
+	testTailerExpect(t, c, "after")
+}
+
+func TestTailerRotate(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "log")
+	testTailerAppend(t, p, "")
+	c, cancel := testTailerFollow(t, newTailer(p))
+	defer cancel()
+	testTailerAppend(t, p, "before rotation\n")
+	testTailerExpect(t, c, "before rotation")
+	testNoError(t, os.Rename(p, p+".1"))
+	testTailerAppend(t, p+".1", "late\n")
+	testTailerAppend(t, p, "after rotation\n")
+	testTailerExpect(t, c, "late", "after rotation")
+}
+
+func TestTailerResume(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "log")
+	testTailerAppend(t, p, "")
+	tl := newTailer(p)
+	c, cancel := testTailerFollow(t, tl)
+	testTailerAppend(t, p, "one\n")
+	testTailerExpect(t, c, "one")
+	cancel()
+	for range c {
+	}
+	testTailerAppend(t, p, "two\n")
+	c, cancel = testTailerFollow(t, tl)
+	defer cancel()
+	testTailerExpect(t, c, "two")
+}
+
+func TestTailerResumeCursor(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "log")
+	testTailerAppend(t, p, "seen\nmissed\n")
+	fi, err := os.Stat(p)
+	testNoError(t, err)
+	d, i := fileIdentity(fi)
+
+	tl := newTailer(p)
+	tl.resume = &cursor{Device: d, Inode: i, Offset: 5}
+	var cs []*cursor
+	tl.checkpoint = func(c *cursor) {
+		cs = append(cs, c)
+	}
+	c, cancel := testTailerFollow(t, tl)
+	testTailerExpect(t, c, "missed")
+	cancel()
+	for range c {
+	}
+	if len(cs) != 1 || cs[0].Offset != 12 || cs[0].Inode != i {
+		t.Errorf("unexpected checkpoints %v", cs)
+	}
+
+	tl = newTailer(p)
+	tl.resume = &cursor{Device: d, Inode: i + 1, Offset: 5}
+	c, cancel = testTailerFollow(t, tl)
+	defer cancel()
+	testTailerExpect(t, c, "seen", "missed")
+}
@@ -7,10 +7,15 @@ import (
 	"os/exec"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
+const (
+	testNetworkNamespaceEnv = "GERBEROS_TEST_NETNS"
+)
+
 var (
 	errFault = errors.New("fault")
 )
@@ -108,3 +113,27 @@ func testCountChildren() (int, error) {
 	}
 	return child, nil
 }
+
+// testInNetworkNamespace reports whether the test runs inside an unprivileged
+// user and network namespace. Otherwise, the test is run again inside one and
+// its result is reported.
+func testInNetworkNamespace(t *testing.T) bool {
+	t.Helper()
+	if os.Getenv(testNetworkNamespaceEnv) != "" {
+		return true
+	}
+
+	c := exec.Command("unshare", "-Urn", os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	c.Env = append(os.Environ(), testNetworkNamespaceEnv+"=1")
+	o, err := c.CombinedOutput()
+	if err != nil && !strings.Contains(string(o), "--- FAIL") {
+		t.Skipf("failed to enter network namespace: %s", err)
+	}
+	if err != nil {
+		t.Errorf("failed inside network namespace:\n%s", o)
+	} else if strings.Contains(string(o), "--- SKIP") {
+		t.Skipf("skipped inside network namespace:\n%s", o)
+	}
+
+	return false
+}
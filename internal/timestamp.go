@@ -0,0 +1,132 @@
+package gerberos
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	timeMagicText = "%time%"
+	timeGroupName = "time"
+)
+
+var timeMagicRegexp = regexp.MustCompile(timeMagicText)
+
+type timestampPreset struct {
+	layout string
+	regexp *regexp.Regexp
+}
+
+var timestampPresets = map[string]*timestampPreset{
+	"rfc3339": {time.RFC3339, regexp.MustCompile(`\d{4}-\d\d-\d\d[T ]\d\d:\d\d:\d\d(\.\d+)?(Z|[+-]\d\d:\d\d)`)},
+	"syslog":  {time.Stamp, regexp.MustCompile(`[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d`)},
+	"clf":     {"02/Jan/2006:15:04:05 -0700", regexp.MustCompile(`\d\d/[A-Z][a-z]{2}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}`)},
+}
+
+// timestamp parses the times captured by the regexps of a rule.
+type timestamp struct {
+	layout string
+	// Only set for presets, replaces the magic text in regexps
+	preset *timestampPreset
+}
+
+// parse parses the text as a time in the local time zone unless the layout
+// includes one. Times without a year are assumed to lie within the year before
+// now.
+func (ts *timestamp) parse(s string, now time.Time) (time.Time, error) {
+	// RFC 3339 permits a space instead of the "T", which time.Parse does not
+	if ts.layout == time.RFC3339 && len(s) > 10 && s[10] == ' ' {
+		s = s[:10] + "T" + s[11:]
+	}
+	t, err := time.ParseInLocation(ts.layout, s, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return timestampYear(t, now), nil
+}
+
+func timestampYear(t time.Time, now time.Time) time.Time {
+	if t.Year() != 0 {
+		return t
+	}
+
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now) {
+		t = t.AddDate(-1, 0, 0)
+	}
+
+	return t
+}
+
+func (r *rule) initializeTimestamp() error {
+	if r.Timestamp == nil {
+		return nil
+	}
+
+	if r.JSON != nil {
+		return errors.New("timestamp option must not be used with the json option")
+	}
+
+	if len(r.Timestamp) < 1 || r.Timestamp[0] == "" {
+		return errors.New("missing layout parameter")
+	}
+
+	if len(r.Timestamp) > 1 {
+		return errors.New("superfluous parameter(s)")
+	}
+
+	ts := &timestamp{layout: r.Timestamp[0]}
+	if p, e := timestampPresets[r.Timestamp[0]]; e {
+		ts.layout, ts.preset = p.layout, p
+	}
+	r.timestamp = ts
+
+	return nil
+}
+
+// expandTimestamp replaces the magic text for timestamps in the regexp by the
+// regexp of the preset.
+func (r *rule) expandTimestamp(s string) (string, error) {
+	if strings.Contains(s, "(?P<"+timeGroupName+">") && r.timestamp == nil {
+		return "", fmt.Errorf(`regexp must not contain a subexpression named "%s" ("(?P<%s>") unless the timestamp option is used`, timeGroupName, timeGroupName)
+	}
+
+	switch len(timeMagicRegexp.FindAllStringIndex(s, -1)) {
+	case 0:
+		return s, nil
+	case 1:
+	default:
+		return "", fmt.Errorf(`"%s" must not appear more than once in regexp`, timeMagicText)
+	}
+	if r.timestamp == nil || r.timestamp.preset == nil {
+		return "", fmt.Errorf(`"%s" requires the timestamp option with a preset (rfc3339, syslog or clf)`, timeMagicText)
+	}
+
+	return strings.Replace(s, timeMagicText, fmt.Sprintf("(?P<%s>%s)", timeGroupName, r.timestamp.preset.regexp), 1), nil
+}
+
+// matchTime returns the time captured by the regexp if the timestamp option is
+// used, otherwise the fallback.
+func (r *rule) matchTime(re *regexp.Regexp, sm []string, fallback time.Time) time.Time {
+	if r.timestamp == nil {
+		return fallback
+	}
+
+	i := re.SubexpIndex(timeGroupName)
+	if i == -1 || sm[i] == "" {
+		return fallback
+	}
+	t, err := r.timestamp.parse(sm[i], time.Now())
+	if err != nil {
+		log.Debug().Str("rule", r.name).Err(err).Msg("failed to parse timestamp")
+		return fallback
+	}
+
+	return t
+}
@@ -0,0 +1,85 @@
+package gerberos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampParse(t *testing.T) {
+	now := time.Date(2026, 1, 10, 0, 0, 0, 0, time.Local)
+	tp := func(l, s string, e time.Time) {
+		t.Helper()
+		ts := &timestamp{layout: l}
+		if p, f := timestampPresets[l]; f {
+			ts.layout = p.layout
+		}
+		pt, err := ts.parse(s, now)
+		testNoError(t, err)
+		if !pt.Equal(e) {
+			t.Errorf(`expected "%s" to be parsed as %s, got %s`, s, e, pt)
+		}
+	}
+
+	tp("rfc3339", "2025-12-31T23:59:59Z", time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC))
+	tp("rfc3339", "2025-12-31 23:59:59+01:00", time.Date(2025, 12, 31, 22, 59, 59, 0, time.UTC))
+	tp("clf", "09/Jan/2026:10:00:00 +0100", time.Date(2026, 1, 9, 9, 0, 0, 0, time.UTC))
+	tp("syslog", "Jan  9 10:00:00", time.Date(2026, 1, 9, 10, 0, 0, 0, time.Local))
+	tp("syslog", "Dec 31 10:00:00", time.Date(2025, 12, 31, 10, 0, 0, 0, time.Local))
+	tp("2006/01/02 15:04", "2026/01/09 10:00", time.Date(2026, 1, 9, 10, 0, 0, 0, time.Local))
+
+	_, err := (&timestamp{layout: time.Stamp}).parse("Foo  9 10:00:00", now)
+	testError(t, err)
+}
+
+func TestTimestampMatch(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+
+	r := newTestValidRule()
+	r.Aggregate = nil
+	r.Regexp = []string{`^%time% \S+ sshd\[\d+\]: Invalid user \S+ from %ip%`}
+	r.Timestamp = []string{"rfc3339"}
+	r.Occurrences = []string{"3", "1m"}
+	testNoError(t, r.initialize(rn))
+
+	m, err := r.match("2026-01-09T10:00:00Z host sshd[1]: Invalid user a from 192.0.2.1")
+	testNoError(t, err)
+	if e := time.Date(2026, 1, 9, 10, 0, 0, 0, time.UTC); !m.time.Equal(e) {
+		t.Errorf("expected time %s, got %s", e, m.time)
+	}
+
+	// Unparsable timestamps are replaced by the current time
+	m, err = r.match("2026-13-09T10:00:00Z host sshd[1]: Invalid user a from 192.0.2.1")
+	testNoError(t, err)
+	if time.Since(m.time) > time.Second {
+		t.Errorf("expected current time, got %s", m.time)
+	}
+
+	// A backlog read at once is spread over the times of its lines
+	for i, s := range []string{"10:00:00", "10:01:00", "10:01:30", "10:01:45"} {
+		m, err := r.match("2026-01-09T" + s + "Z host sshd[1]: Invalid user a from 192.0.2.2")
+		testNoError(t, err)
+		if e := i == 3; r.occurrences.add(m.ip, m.time) != e {
+			t.Errorf("unexpected occurrences result for %s", s)
+		}
+	}
+}
+
+func TestTimestampAggregate(t *testing.T) {
+	rn, err := newTestRunner()
+	testNoError(t, err)
+
+	r := newTestValidRule()
+	r.Regexp = []string{`^(?P<time>\S+ \S+) from %ip% id %id%`}
+	r.Aggregate = []string{"1s", `done %id%`}
+	r.Timestamp = []string{"2006-01-02 15:04:05"}
+	testNoError(t, r.initialize(rn))
+
+	_, err = r.match("2026-01-09 10:00:00 from 192.0.2.1 id x")
+	testError(t, err)
+	m, err := r.match("done x")
+	testNoError(t, err)
+	if e := time.Date(2026, 1, 9, 10, 0, 0, 0, time.Local); !m.time.Equal(e) {
+		t.Errorf("expected time of first line %s, got %s", e, m.time)
+	}
+}